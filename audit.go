@@ -7,10 +7,11 @@ import (
 	"fmt"
 	"log"
 	"log/syslog"
+	"net"
 	"os"
-	"os/exec"
 	"os/signal"
 	"os/user"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
@@ -30,18 +31,13 @@ var Build string
 var l = log.New(os.Stdout, "", 0)
 var el = log.New(os.Stderr, "", 0)
 
-type executor func(string, ...string) error
-
-func lExec(s string, a ...string) error {
-	return exec.Command(s, a...).Run()
-}
-
 func loadConfig(configFile string) (*viper.Viper, error) {
 	config := viper.New()
 	config.SetConfigFile(configFile)
 
 	config.SetDefault("events.min", 1300)
 	config.SetDefault("events.max", 1399)
+	config.SetDefault("events.complete_after", COMPLETE_AFTER.String())
 	config.SetDefault("message_tracking.enabled", true)
 	config.SetDefault("message_tracking.log_out_of_order", false)
 	config.SetDefault("message_tracking.max_out_of_order", 500)
@@ -49,10 +45,62 @@ func loadConfig(configFile string) (*viper.Viper, error) {
 	config.SetDefault("output.syslog.priority", int(syslog.LOG_LOCAL0|syslog.LOG_WARNING))
 	config.SetDefault("output.syslog.tag", "go-audit")
 	config.SetDefault("output.syslog.attempts", "3")
+	config.SetDefault("output.syslog.format", "rfc3164")
+	config.SetDefault("output.syslog.framing", "octet_counting")
+	config.SetDefault("output.syslog.tls.enabled", false)
+	config.SetDefault("output.file.rotate.max_size", 0)
+	config.SetDefault("output.file.rotate.interval", "0s")
+	config.SetDefault("output.file.rotate.keep", 5)
+	config.SetDefault("output.file.rotate.compression", "none")
 	config.SetDefault("output.gelf.attempts", 3)
 	config.SetDefault("output.gelf.network", "udp")
 	config.SetDefault("output.gelf.compression.level", int(flate.BestSpeed))
 	config.SetDefault("output.gelf.compression.type", int(gelf.CompressGzip))
+	config.SetDefault("output.kafka.enabled", false)
+	config.SetDefault("output.kafka.attempts", 3)
+	config.SetDefault("output.kafka.topic", "go-audit")
+	config.SetDefault("output.kafka.key", "hostname")
+	config.SetDefault("output.kafka.acks", "all")
+	config.SetDefault("output.kafka.batch_size", KAFKA_BATCH_SIZE)
+	config.SetDefault("output.kafka.batch_timeout", KAFKA_BATCH_TIMEOUT.String())
+	config.SetDefault("output.kafka.timeout", KAFKA_TIMEOUT.String())
+	config.SetDefault("output.kafka.compression", "none")
+	config.SetDefault("output.kafka.tls.enabled", false)
+	config.SetDefault("output.http.enabled", false)
+	config.SetDefault("output.http.attempts", 3)
+	config.SetDefault("output.http.format", "ndjson")
+	config.SetDefault("output.http.compression", "none")
+	config.SetDefault("output.http.batch_size", HTTP_BATCH_SIZE)
+	config.SetDefault("output.http.flush_interval", HTTP_FLUSH_INTERVAL.String())
+	config.SetDefault("output.http.timeout", HTTP_TIMEOUT.String())
+	config.SetDefault("output.http.tls.enabled", false)
+	config.SetDefault("spool.enabled", false)
+	config.SetDefault("spool.directory", "/var/lib/go-audit/spool")
+	config.SetDefault("spool.max_size", 1024*1024*1024)
+	config.SetDefault("spool.full_policy", "drop_oldest")
+	config.SetDefault("spool.max_attempts", 0)
+	config.SetDefault("rules_check.enabled", false)
+	config.SetDefault("rules_check.interval", "1m")
+	config.SetDefault("rules_check.reapply", false)
+	config.SetDefault("message_fields.enabled", false)
+	config.SetDefault("metrics.enabled", false)
+	config.SetDefault("metrics.address", "127.0.0.1:9393")
+	config.SetDefault("metrics.path", "/metrics")
+	config.SetDefault("kernel_status.enabled", false)
+	config.SetDefault("kernel_status.interval", "1m")
+	config.SetDefault("multicast.enabled", false)
+	config.SetDefault("shutdown.restore_rules", false)
+	config.SetDefault("enrichment.workers", ENRICHMENT_WORKERS)
+	config.SetDefault("enrichment.queue_size", ENRICHMENT_QUEUE_SIZE)
+	config.SetDefault("enrichment.timeout", ENRICHMENT_TIMEOUT.String())
+	config.SetDefault("dedup.enabled", false)
+	config.SetDefault("dedup.key", []string{"exe", "uid", "cwd", "argv"})
+	config.SetDefault("dedup.window", DEDUP_WINDOW.String())
+	config.SetDefault("dedup.max_keys", DEDUP_MAX_KEYS)
+	config.SetDefault("rate_limit.events_per_second", 0)
+	config.SetDefault("capture.enabled", false)
+	config.SetDefault("capture.path", "/var/lib/go-audit/capture")
+	config.SetDefault("capture.max_size", "100MB")
 	config.SetDefault("log.flags", 0)
 
 	if err := config.ReadInConfig(); err != nil {
@@ -65,83 +113,242 @@ func loadConfig(configFile string) (*viper.Viper, error) {
 	return config, nil
 }
 
-func setRules(config *viper.Viper, e executor) error {
-	// Clear existing rules
-	if err := e("auditctl", "-D"); err != nil {
-		return fmt.Errorf("Failed to flush existing audit rules. Error: %s", err)
+// parseRules parses every configured rule without touching the kernel, the rule numbers are returned alongside them
+// for error messages
+func parseRules(config *viper.Viper) ([]*AuditRuleCommand, []int, error) {
+	// In multicast mode another audit daemon owns the rules, we only add ours alongside them
+	multicast := config.GetBool("multicast.enabled")
+
+	var cmds []*AuditRuleCommand
+	var nums []int
+	for i, v := range config.GetStringSlice("rules") {
+		// Skip rules with no content
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+
+		cmd, err := ParseAuditRule(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to parse rule #%d. Error: %s", i+1, err)
+		}
+
+		if multicast && cmd.op == ruleDeleteAll {
+			return nil, nil, fmt.Errorf("Rule #%d would flush the audit rules, this is not allowed in multicast mode", i+1)
+		}
+
+		cmds = append(cmds, cmd)
+		nums = append(nums, i+1)
 	}
 
-	l.Println("Flushed existing audit rules")
+	if len(cmds) == 0 && !multicast {
+		return nil, nil, errors.New("No audit rules found")
+	}
 
-	// Add ours in
-	if rules := config.GetStringSlice("rules"); len(rules) != 0 {
-		for i, v := range rules {
-			// Skip rules with no content
-			if v == "" {
-				continue
-			}
+	return cmds, nums, nil
+}
 
-			if err := e("auditctl", strings.Fields(v)...); err != nil {
-				return fmt.Errorf("Failed to add rule #%d. Error: %s", i+1, err)
-			}
+func setRules(config *viper.Viper, c AuditRuleClient) error {
+	// Parse everything before touching the kernel so a bad rule doesn't leave us with nothing loaded
+	cmds, nums, err := parseRules(config)
+	if err != nil {
+		return err
+	}
+
+	multicast := config.GetBool("multicast.enabled")
+	if len(cmds) == 0 {
+		l.Println("No audit rules found, leaving the kernel audit rules alone")
+		return nil
+	}
 
-			l.Printf("Added audit rule #%d\n", i+1)
+	if !multicast {
+		// Clear existing rules
+		if err := deleteAllRules(c); err != nil {
+			return fmt.Errorf("Failed to flush existing audit rules. Error: %s", err)
 		}
-	} else {
-		return errors.New("No audit rules found")
+
+		l.Println("Flushed existing audit rules")
+	}
+
+	// Add ours in
+	for i, cmd := range cmds {
+		err := cmd.apply(c)
+		if multicast && cmd.op == ruleAdd && err == syscall.EEXIST {
+			// The other daemon, or an earlier run of ours, already loaded it
+			l.Printf("Audit rule #%d is already loaded\n", nums[i])
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to add rule #%d. Error: %s", nums[i], err)
+		}
+
+		l.Printf("Added audit rule #%d\n", nums[i])
 	}
 
 	return nil
 }
 
-func createOutput(config *viper.Viper) (*AuditWriter, error) {
-	var writer *AuditWriter
-	var err error
-	i := 0
+func createRuleChecker(config *viper.Viper, c AuditRuleClient, w GroupWriter) (*RuleChecker, error) {
+	if config.GetDuration("rules_check.interval") <= 0 {
+		return nil, fmt.Errorf("rules_check.interval must be greater than 0, got `%s`", config.GetString("rules_check.interval"))
+	}
+
+	expected, err := createExpectedRules(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRuleChecker(c, w, expected, config.GetBool("multicast.enabled"), createRuleReapply(config, c)), nil
+}
+
+// createExpectedRules returns the rules the kernel should have loaded once the configured ones are in place
+func createExpectedRules(config *viper.Viper) ([]*AuditRule, error) {
+	cmds, _, err := parseRules(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return expectedRules(cmds), nil
+}
+
+// createRuleReapply returns what the rule checker calls to load the configured rules again, nil if it shouldn't
+func createRuleReapply(config *viper.Viper, c AuditRuleClient) func() error {
+	if !config.GetBool("rules_check.reapply") {
+		return nil
+	}
+
+	return func() error {
+		return setRules(config, c)
+	}
+}
+
+func createOutput(config *viper.Viper) (*MultiAuditWriter, error) {
+	writers := NewMultiAuditWriter()
 
 	if config.GetBool("output.syslog.enabled") == true {
-		i++
-		writer, err = createSyslogOutput(config)
+		writer, err := createSyslogOutput(config)
 		if err != nil {
+			writers.Close()
+			return nil, err
+		}
+
+		if err := addOutput(config, writers, "syslog", writer); err != nil {
+			writers.Close()
 			return nil, err
 		}
 	}
 
 	if config.GetBool("output.file.enabled") == true {
-		i++
-		writer, err = createFileOutput(config)
+		writer, err := createFileOutput(config)
 		if err != nil {
+			writers.Close()
 			return nil, err
 		}
 
-		go handleLogRotation(config, writer)
+		handleLogRotation(config, writer, writers.Done())
+		if err := addOutput(config, writers, "file", writer); err != nil {
+			writers.Close()
+			return nil, err
+		}
 	}
 
 	if config.GetBool("output.stdout.enabled") == true {
-		i++
-		writer, err = createStdOutOutput(config)
+		writer, err := createStdOutOutput(config)
 		if err != nil {
+			writers.Close()
+			return nil, err
+		}
+
+		if err := addOutput(config, writers, "stdout", writer); err != nil {
+			writers.Close()
 			return nil, err
 		}
 	}
 
 	if config.GetBool("output.gelf.enabled") == true {
-		i++
-		writer, err = createGELFOutput(config)
+		writer, err := createGELFOutput(config)
 		if err != nil {
+			writers.Close()
+			return nil, err
+		}
+
+		if err := addOutput(config, writers, "gelf", writer); err != nil {
+			writers.Close()
 			return nil, err
 		}
 	}
 
-	if i > 1 {
-		return nil, errors.New("Only one output can be enabled at a time")
+	if config.GetBool("output.kafka.enabled") == true {
+		writer, err := createKafkaOutput(config)
+		if err != nil {
+			writers.Close()
+			return nil, err
+		}
+
+		if err := addOutput(config, writers, "kafka", writer); err != nil {
+			writers.Close()
+			return nil, err
+		}
 	}
 
-	if writer == nil {
+	if config.GetBool("output.http.enabled") == true {
+		writer, err := createHTTPOutput(config)
+		if err != nil {
+			writers.Close()
+			return nil, err
+		}
+
+		if err := addOutput(config, writers, "http", writer); err != nil {
+			writers.Close()
+			return nil, err
+		}
+	}
+
+	if writers.Len() == 0 {
 		return nil, errors.New("No outputs were configured")
 	}
 
-	return writer, nil
+	return writers, nil
+}
+
+// addOutput hands a writer to the fan out with the encoding configured for it, putting a spool in front of it if one
+// is configured
+func addOutput(config *viper.Viper, writers *MultiAuditWriter, name string, writer *AuditWriter) error {
+	switch encoding := config.GetString("output." + name + ".encoding"); encoding {
+	case "", "json":
+	case "ecs":
+		writer.encode = func(msg *AuditMessageGroup) interface{} { return newECSDocument(msg) }
+	default:
+		return fmt.Errorf("Unknown encoding `%s` for output %s, must be `json` or `ecs`", encoding, name)
+	}
+
+	if !config.GetBool("spool.enabled") {
+		writers.Add(name, writer, config.GetInt("output."+name+".queue_size"))
+		return nil
+	}
+
+	var block bool
+	switch policy := config.GetString("spool.full_policy"); policy {
+	case "drop_oldest":
+		block = false
+	case "block":
+		block = true
+	default:
+		return fmt.Errorf("Unknown spool full_policy `%s`, must be `drop_oldest` or `block`", policy)
+	}
+
+	maxAttempts := config.GetInt("spool.max_attempts")
+	if maxAttempts < 0 {
+		return fmt.Errorf("Spool max_attempts must be 0 or more, %v provided", maxAttempts)
+	}
+
+	spool, err := OpenSpool(path.Join(config.GetString("spool.directory"), name), config.GetInt64("spool.max_size"), block)
+	if err != nil {
+		return fmt.Errorf("Failed to open spool for output %s. Error: %s", name, err)
+	}
+
+	writers.AddSpooled(name, writer, spool, maxAttempts)
+	return nil
 }
 
 func createGELFOutput(config *viper.Viper) (*AuditWriter, error) {
@@ -185,6 +392,14 @@ func createSyslogOutput(config *viper.Viper) (*AuditWriter, error) {
 		return nil, fmt.Errorf("Output attempts for syslog must be at least 1, %v provided", attempts)
 	}
 
+	switch format := config.GetString("output.syslog.format"); format {
+	case "", "rfc3164":
+	case "rfc5424":
+		return createRFC5424Output(config, attempts)
+	default:
+		return nil, fmt.Errorf("Output format for syslog must be `rfc3164` or `rfc5424`, got `%s`", format)
+	}
+
 	syslogWriter, err := syslog.Dial(
 		config.GetString("output.syslog.network"),
 		config.GetString("output.syslog.address"),
@@ -210,69 +425,95 @@ func createFileOutput(config *viper.Viper) (*AuditWriter, error) {
 		return nil, errors.New("Output file mode should be greater than 0000")
 	}
 
-	f, err := os.OpenFile(
-		config.GetString("output.file.path"),
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode,
-	)
+	maxSize := int64(config.GetSizeInBytes("output.file.rotate.max_size"))
+	interval := config.GetDuration("output.file.rotate.interval")
+	if interval < 0 {
+		return nil, fmt.Errorf("Output rotate.interval for file can not be negative, got `%s`", config.GetString("output.file.rotate.interval"))
+	}
 
-	if err != nil {
-		return nil, fmt.Errorf("Failed to open output file. Error: %s", err)
+	keep := config.GetInt("output.file.rotate.keep")
+	if (maxSize > 0 || interval > 0) && keep < 1 {
+		return nil, fmt.Errorf("Output rotate.keep for file must be at least 1, %v provided", keep)
 	}
 
-	if err := f.Chmod(mode); err != nil {
-		return nil, fmt.Errorf("Failed to set file permissions. Error: %s", err)
+	compression := config.GetString("output.file.rotate.compression")
+	if compression == "" {
+		compression = "none"
+	}
+
+	// The owner is set once it is known, -1 leaves it alone
+	f, err := NewRotatingFile(config.GetString("output.file.path"), mode, -1, -1, maxSize, interval, keep, compression)
+	if err != nil {
+		return nil, err
 	}
 
 	uname := config.GetString("output.file.user")
 	u, err := user.Lookup(uname)
 	if err != nil {
+		f.Close()
 		return nil, fmt.Errorf("Could not find uid for user %s. Error: %s", uname, err)
 	}
 
 	gname := config.GetString("output.file.group")
 	g, err := user.LookupGroup(gname)
 	if err != nil {
+		f.Close()
 		return nil, fmt.Errorf("Could not find gid for group %s. Error: %s", gname, err)
 	}
 
 	uid, err := strconv.ParseInt(u.Uid, 10, 32)
 	if err != nil {
+		f.Close()
 		return nil, fmt.Errorf("Found uid could not be parsed. Error: %s", err)
 	}
 
 	gid, err := strconv.ParseInt(g.Gid, 10, 32)
 	if err != nil {
+		f.Close()
 		return nil, fmt.Errorf("Found gid could not be parsed. Error: %s", err)
 	}
 
 	if err = f.Chown(int(uid), int(gid)); err != nil {
-		return nil, fmt.Errorf("Could not chown output file. Error: %s", err)
+		f.Close()
+		return nil, err
+	}
+
+	if maxSize > 0 || interval > 0 {
+		l.Printf("Rotating %s at %d bytes or every %s, keeping %d files\n", f.path, maxSize, interval, keep)
 	}
 
 	return NewAuditWriter(f, attempts), nil
 }
 
-func handleLogRotation(config *viper.Viper, writer *AuditWriter) {
+func handleLogRotation(config *viper.Viper, writer *AuditWriter, done <-chan struct{}) {
 	// Re-open our log file. This is triggered by a USR1 signal and is meant to be used upon log rotation
+	// The signal is caught from the moment this returns until done is closed, when the output is closed or replaced by
+	// a config reload
 
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGUSR1)
 
-	for range sigc {
-		newWriter, err := createFileOutput(config)
-		if err != nil {
-			el.Fatalln("Error re-opening log file. Exiting.")
-		}
+	go func() {
+		defer signal.Stop(sigc)
 
-		oldFile := writer.w.(*os.File)
-		writer.w = newWriter.w
-		writer.e = newWriter.e
+		for {
+			select {
+			case <-done:
+				return
+			case <-sigc:
+			}
 
-		err = oldFile.Close()
-		if err != nil {
-			el.Printf("Error closing old log file: %+v\n", err)
+			f, ok := writer.w.(*RotatingFile)
+			if !ok {
+				continue
+			}
+
+			// Losing the output over a failed reopen is worse than writing to the moved file for a while longer
+			if err := f.Reopen(); err != nil {
+				el.Printf("Failed to reopen the log file, still writing to the old one. Error: %s\n", err)
+			}
 		}
-	}
+	}()
 }
 
 func createStdOutOutput(config *viper.Viper) (*AuditWriter, error) {
@@ -310,8 +551,25 @@ func createFilters(config *viper.Viper) ([]AuditFilter, error) {
 		}
 
 		af := AuditFilter{}
+		action := ""
 		for k, v := range f2 {
 			switch k {
+			case "expression":
+				ex, ok := v.(string)
+				if !ok {
+					return filters, fmt.Errorf("`expression` in filter %d could not be parsed; Value: `%+v`", i+1, v)
+				}
+
+				if af.expression, err = parseFilterExpression(ex); err != nil {
+					return filters, fmt.Errorf("`expression` in filter %d could not be parsed; Value: `%+v`; Error: %s", i+1, v, err)
+				}
+
+			case "action":
+				if action, ok = v.(string); !ok || (action != "drop" && action != "keep") {
+					return filters, fmt.Errorf("`action` in filter %d must be `drop` or `keep`; Value: `%+v`", i+1, v)
+				}
+				af.keep = action == "keep"
+
 			case "message_type":
 				if ev, ok := v.(string); ok {
 					fv, err := strconv.ParseUint(ev, 10, 64)
@@ -337,9 +595,25 @@ func createFilters(config *viper.Viper) ([]AuditFilter, error) {
 					return filters, fmt.Errorf("`regex` in filter %d could not be parsed; Value: `%+v`; Error: %s", i+1, v, err)
 				}
 
+			case "cidr":
+				cidr, ok := v.(string)
+				if !ok {
+					return filters, fmt.Errorf("`cidr` in filter %d could not be parsed; Value: `%+v`", i+1, v)
+				}
+
+				if _, af.cidr, err = net.ParseCIDR(cidr); err != nil {
+					return filters, fmt.Errorf("`cidr` in filter %d could not be parsed; Value: `%+v`; Error: %s", i+1, v, err)
+				}
+
 			case "syscall":
 				if af.syscall, ok = v.(string); ok {
-					// All is good
+					// Anything that isn't a number has to be a syscall name we know about
+					if _, err := strconv.Atoi(af.syscall); err != nil {
+						af.syscall = strings.ToLower(af.syscall)
+						if !isSyscallName(af.syscall) {
+							return filters, fmt.Errorf("`syscall` in filter %d is not a known syscall name; Value: `%+v`", i+1, v)
+						}
+					}
 				} else if ev, ok := v.(int); ok {
 					af.syscall = strconv.Itoa(ev)
 				} else {
@@ -348,8 +622,26 @@ func createFilters(config *viper.Viper) ([]AuditFilter, error) {
 			}
 		}
 
-		if af.regex == nil {
-			return filters, fmt.Errorf("Filter %d is missing the `regex` entry", i+1)
+		if af.expression != nil {
+			if af.regex != nil || af.cidr != nil || af.messageType != 0 || af.syscall != "" {
+				return filters, fmt.Errorf("Filter %d can not have `syscall`, `message_type`, `regex` or `cidr` along with `expression`", i+1)
+			}
+
+			filters = append(filters, af)
+			if af.keep {
+				l.Printf("Keeping only message groups matching `%s`\n", af.expression)
+			} else {
+				l.Printf("Ignoring message groups matching `%s`\n", af.expression)
+			}
+			continue
+		}
+
+		if action != "" {
+			return filters, fmt.Errorf("`action` in filter %d needs an `expression`", i+1)
+		}
+
+		if af.regex == nil && af.cidr == nil {
+			return filters, fmt.Errorf("Filter %d is missing the `regex` or `cidr` entry", i+1)
 		}
 
 		if af.messageType == 0 {
@@ -357,7 +649,16 @@ func createFilters(config *viper.Viper) ([]AuditFilter, error) {
 		}
 
 		filters = append(filters, af)
-		l.Printf("Ignoring syscall `%v` containing message type `%v` matching string `%s`\n", af.syscall, af.messageType, af.regex.String())
+		var matching []string
+		if af.regex != nil {
+			matching = append(matching, fmt.Sprintf("matching string `%s`", af.regex.String()))
+		}
+
+		if af.cidr != nil {
+			matching = append(matching, fmt.Sprintf("with an address in `%s`", af.cidr.String()))
+		}
+
+		l.Printf("Ignoring syscall `%v` containing message type `%v` %s\n", af.syscall, af.messageType, strings.Join(matching, " and "))
 	}
 
 	return filters, nil
@@ -366,6 +667,8 @@ func createFilters(config *viper.Viper) ([]AuditFilter, error) {
 func main() {
 	configFile := flag.String("config", "", "Config file location")
 	printVersion := flag.Bool("version", false, "Print version")
+	replayFile := flag.String("replay", "", "Send the records in an audit log or capture file through the filters and outputs then exit, `-` reads stdin")
+	replayTiming := flag.Bool("replay-timing", false, "Keep the time between frames when replaying a capture file")
 
 	flag.Parse()
 
@@ -385,51 +688,192 @@ func main() {
 		el.Fatal(err)
 	}
 
+	parseMessageFields = config.GetBool("message_fields.enabled")
+
+	completeAfter = config.GetDuration("events.complete_after")
+	if completeAfter <= 0 {
+		el.Fatalf("events.complete_after must be greater than 0, got `%s`", config.GetString("events.complete_after"))
+	}
+
 	// output needs to be created before anything that write to stdout
 	writer, err := createOutput(config)
 	if err != nil {
 		el.Fatal(err)
 	}
 
-	if err := setRules(config, lExec); err != nil {
+	if *replayFile != "" {
+		if err := runReplay(config, writer, *replayFile, *replayTiming); err != nil {
+			el.Fatal(err)
+		}
+		return
+	}
+
+	controlClient, err := NewNetlinkControlClient()
+	if err != nil {
+		el.Fatal(err)
+	}
+
+	if config.GetBool("metrics.enabled") {
+		server, listener, err := createMetricsServer(config, controlClient)
+		if err != nil {
+			el.Fatal(err)
+		}
+
+		go func() {
+			el.Fatal("Metrics server stopped. Error: ", server.Serve(listener))
+		}()
+	}
+
+	// Remember the rules someone else loaded so they can be put back when we stop
+	var savedRules []*AuditRule
+	if config.GetBool("shutdown.restore_rules") {
+		if config.GetBool("multicast.enabled") {
+			el.Fatal("shutdown.restore_rules can not be used in multicast mode")
+		}
+
+		savedRules, err = controlClient.ListRules()
+		if err != nil {
+			el.Fatalf("Failed to list the loaded audit rules. Error: %s", err)
+		}
+
+		if savedRules == nil {
+			// There were none, ours still have to be flushed on the way out
+			savedRules = []*AuditRule{}
+		}
+	}
+
+	if err := setRules(config, controlClient); err != nil {
+		el.Fatal(err)
+	}
+
+	kernelSettings, err := createKernelSettings(config)
+	if err != nil {
 		el.Fatal(err)
 	}
 
+	if kernelSettings != nil {
+		if err := applyKernelSettings(controlClient, kernelSettings); err != nil {
+			el.Fatal(err)
+		}
+	}
+
+	var checker *RuleChecker
+	if config.GetBool("rules_check.enabled") {
+		checker, err = createRuleChecker(config, controlClient, writer)
+		if err != nil {
+			el.Fatal(err)
+		}
+
+		go checker.Run(config.GetDuration("rules_check.interval"))
+	}
+
+	if config.GetBool("kernel_status.enabled") {
+		interval := config.GetDuration("kernel_status.interval")
+		if interval <= 0 {
+			el.Fatalf("kernel_status.interval must be greater than 0, got `%s`", config.GetString("kernel_status.interval"))
+		}
+
+		go NewStatusMonitor(controlClient, writer).Run(interval)
+	}
+
 	filters, err := createFilters(config)
 	if err != nil {
 		el.Fatal(err)
 	}
 
-	nlClient, err := NewNetlinkClient(config.GetInt("socket_buffer.receive"))
+	extraParsers, err := createExtraParsers(config)
 	if err != nil {
 		el.Fatal(err)
 	}
 
-	marshaller := NewAuditMarshaller(
+	var nlClient *NetlinkClient
+	if config.GetBool("multicast.enabled") {
+		// Another audit daemon owns the audit pid, we only read a copy of the events
+		nlClient, err = NewNetlinkMulticastClient(config.GetInt("socket_buffer.receive"))
+		if err != nil {
+			el.Fatal(err)
+		}
+
+		l.Println("Reading audit events from the multicast group, not claiming the audit pid")
+	} else {
+		nlClient, err = NewNetlinkClient(config.GetInt("socket_buffer.receive"))
+		if err != nil {
+			el.Fatal(err)
+		}
+
+		if kernelSettings != nil {
+			nlClient.KeepSettings(kernelSettings)
+		}
+	}
+
+	if config.GetBool("capture.enabled") {
+		maxSize := int64(config.GetSizeInBytes("capture.max_size"))
+		capture, err := NewCaptureWriter(config.GetString("capture.path"), maxSize)
+		if err != nil {
+			el.Fatal(err)
+		}
+
+		nlClient.Capture(capture)
+		l.Printf("Capturing netlink frames to %s, starting a new file every %d bytes\n", config.GetString("capture.path"), maxSize)
+	}
+
+	// Extra parsers can be slow, they run on their own so they never hold up reading from netlink
+	enricher := NewEnricher(
 		writer,
+		extraParsers,
+		config.GetInt("enrichment.workers"),
+		config.GetInt("enrichment.queue_size"),
+		config.GetDuration("enrichment.timeout"),
+	)
+
+	// Repeats and anything over the rate limit are held back before they cost any enrichment
+	throttle, err := createThrottle(config, enricher)
+	if err != nil {
+		el.Fatal(err)
+	}
+	go throttle.Run()
+
+	marshaller := NewAuditMarshaller(
+		throttle,
 		uint16(config.GetInt("events.min")),
 		uint16(config.GetInt("events.max")),
 		config.GetBool("message_tracking.enabled"),
 		config.GetBool("message_tracking.log_out_of_order"),
 		config.GetInt("message_tracking.max_out_of_order"),
 		filters,
-		createExtraParsers(config),
 	)
 
+	// Groups that never get an EOE still go out on a quiet host, checking twice per complete_after keeps them from
+	// waiting much longer than that
+	go marshaller.RunFlusher(completeAfter / 2)
+
+	go NewReloader(*configFile, config, controlClient, writer, marshaller, enricher, checker).Run()
+
 	l.Printf("Started processing events in the range [%d, %d]\n", config.GetInt("events.min"), config.GetInt("events.max"))
 
 	//Main loop. Get data from netlink and send it to the json lib for processing
-	for {
-		msg, err := nlClient.Receive()
-		if err != nil {
-			el.Printf("Error during message receive: %+v\n", err)
-			continue
-		}
+	go func() {
+		for {
+			msg, err := nlClient.Receive()
+			if err != nil {
+				if nlClient.Closed() {
+					// We are shutting down
+					return
+				}
 
-		if msg == nil {
-			continue
+				metricReceiveErrors.Inc()
+				el.Printf("Error during message receive: %+v\n", err)
+				continue
+			}
+
+			if msg == nil {
+				continue
+			}
+
+			marshaller.Consume(msg)
 		}
+	}()
 
-		marshaller.Consume(msg)
-	}
+	waitForShutdown()
+	shutdown(nlClient, marshaller, throttle, enricher, writer, controlClient, checker, savedRules)
 }
@@ -33,11 +33,64 @@ func Test_loadConfig(t *testing.T) {
 	assert.Equal(t, 132, config.GetInt("output.syslog.priority"), "output.syslog.priority should default to 132")
 	assert.Equal(t, "go-audit", config.GetString("output.syslog.tag"), "output.syslog.tag should default to go-audit")
 	assert.Equal(t, 3, config.GetInt("output.syslog.attempts"), "output.syslog.attempts should default to 3")
+	assert.Equal(t, "rfc3164", config.GetString("output.syslog.format"), "output.syslog.format should default to rfc3164")
+	assert.Equal(t, "octet_counting", config.GetString("output.syslog.framing"), "output.syslog.framing should default to octet_counting")
+	assert.Equal(t, false, config.GetBool("output.syslog.tls.enabled"), "output.syslog.tls.enabled should default to false")
+	assert.Equal(t, uint(0), config.GetSizeInBytes("output.file.rotate.max_size"), "output.file.rotate.max_size should default to 0")
+	assert.Equal(t, time.Duration(0), config.GetDuration("output.file.rotate.interval"), "output.file.rotate.interval should default to 0s")
+	assert.Equal(t, 5, config.GetInt("output.file.rotate.keep"), "output.file.rotate.keep should default to 5")
+	assert.Equal(t, "none", config.GetString("output.file.rotate.compression"), "output.file.rotate.compression should default to none")
 	assert.Equal(t, false, config.GetBool("output.gelf.enabled"), "output.gelf.enabled should default to false")
 	assert.Equal(t, 3, config.GetInt("output.gelf.attempts"), "output.gelf.attempts should default to 3")
 	assert.Equal(t, "udp", config.GetString("output.gelf.network"), "output.gelf.network should default to udp")
 	assert.Equal(t, int(flate.BestSpeed), config.GetInt("output.gelf.compression.level"), "output.gelf.compression.level should default to flate.BestSpeed")
 	assert.Equal(t, int(gelf.CompressGzip), config.GetInt("output.gelf.compression.type"), "output.gelf.compression.type should default to gelf.CompressGzip")
+	assert.Equal(t, false, config.GetBool("output.kafka.enabled"), "output.kafka.enabled should default to false")
+	assert.Equal(t, 3, config.GetInt("output.kafka.attempts"), "output.kafka.attempts should default to 3")
+	assert.Equal(t, "go-audit", config.GetString("output.kafka.topic"), "output.kafka.topic should default to go-audit")
+	assert.Equal(t, "hostname", config.GetString("output.kafka.key"), "output.kafka.key should default to hostname")
+	assert.Equal(t, "all", config.GetString("output.kafka.acks"), "output.kafka.acks should default to all")
+	assert.Equal(t, KAFKA_BATCH_SIZE, config.GetInt("output.kafka.batch_size"), "output.kafka.batch_size should default to 100")
+	assert.Equal(t, KAFKA_BATCH_TIMEOUT, config.GetDuration("output.kafka.batch_timeout"), "output.kafka.batch_timeout should default to 1s")
+	assert.Equal(t, KAFKA_TIMEOUT, config.GetDuration("output.kafka.timeout"), "output.kafka.timeout should default to 10s")
+	assert.Equal(t, "none", config.GetString("output.kafka.compression"), "output.kafka.compression should default to none")
+	assert.Equal(t, false, config.GetBool("output.kafka.tls.enabled"), "output.kafka.tls.enabled should default to false")
+	assert.Equal(t, false, config.GetBool("output.http.enabled"), "output.http.enabled should default to false")
+	assert.Equal(t, 3, config.GetInt("output.http.attempts"), "output.http.attempts should default to 3")
+	assert.Equal(t, "ndjson", config.GetString("output.http.format"), "output.http.format should default to ndjson")
+	assert.Equal(t, "none", config.GetString("output.http.compression"), "output.http.compression should default to none")
+	assert.Equal(t, HTTP_BATCH_SIZE, config.GetInt("output.http.batch_size"), "output.http.batch_size should default to 100")
+	assert.Equal(t, HTTP_FLUSH_INTERVAL, config.GetDuration("output.http.flush_interval"), "output.http.flush_interval should default to 1s")
+	assert.Equal(t, HTTP_TIMEOUT, config.GetDuration("output.http.timeout"), "output.http.timeout should default to 10s")
+	assert.Equal(t, false, config.GetBool("output.http.tls.enabled"), "output.http.tls.enabled should default to false")
+	assert.Equal(t, false, config.GetBool("spool.enabled"), "spool.enabled should default to false")
+	assert.Equal(t, "/var/lib/go-audit/spool", config.GetString("spool.directory"), "spool.directory should default to /var/lib/go-audit/spool")
+	assert.Equal(t, int64(1024*1024*1024), config.GetInt64("spool.max_size"), "spool.max_size should default to 1GiB")
+	assert.Equal(t, "drop_oldest", config.GetString("spool.full_policy"), "spool.full_policy should default to drop_oldest")
+	assert.Equal(t, 0, config.GetInt("spool.max_attempts"), "spool.max_attempts should default to 0")
+	assert.Equal(t, false, config.GetBool("rules_check.enabled"), "rules_check.enabled should default to false")
+	assert.Equal(t, time.Minute, config.GetDuration("rules_check.interval"), "rules_check.interval should default to 1m")
+	assert.Equal(t, false, config.GetBool("rules_check.reapply"), "rules_check.reapply should default to false")
+	assert.Equal(t, false, config.GetBool("message_fields.enabled"), "message_fields.enabled should default to false")
+	assert.Equal(t, false, config.GetBool("metrics.enabled"), "metrics.enabled should default to false")
+	assert.Equal(t, "127.0.0.1:9393", config.GetString("metrics.address"), "metrics.address should default to 127.0.0.1:9393")
+	assert.Equal(t, "/metrics", config.GetString("metrics.path"), "metrics.path should default to /metrics")
+	assert.Equal(t, false, config.GetBool("kernel_status.enabled"), "kernel_status.enabled should default to false")
+	assert.Equal(t, time.Minute, config.GetDuration("kernel_status.interval"), "kernel_status.interval should default to 1m")
+	assert.Equal(t, false, config.GetBool("multicast.enabled"), "multicast.enabled should default to false")
+	assert.Equal(t, false, config.GetBool("shutdown.restore_rules"), "shutdown.restore_rules should default to false")
+	assert.Equal(t, time.Second*2, config.GetDuration("events.complete_after"), "events.complete_after should default to 2s")
+	assert.Equal(t, 4, config.GetInt("enrichment.workers"), "enrichment.workers should default to 4")
+	assert.Equal(t, 1024, config.GetInt("enrichment.queue_size"), "enrichment.queue_size should default to 1024")
+	assert.Equal(t, time.Second, config.GetDuration("enrichment.timeout"), "enrichment.timeout should default to 1s")
+	assert.Equal(t, false, config.GetBool("dedup.enabled"), "dedup.enabled should default to false")
+	assert.Equal(t, []string{"exe", "uid", "cwd", "argv"}, config.GetStringSlice("dedup.key"), "dedup.key should default to exe, uid, cwd and argv")
+	assert.Equal(t, time.Minute, config.GetDuration("dedup.window"), "dedup.window should default to 1m")
+	assert.Equal(t, 10000, config.GetInt("dedup.max_keys"), "dedup.max_keys should default to 10000")
+	assert.Equal(t, 0, config.GetInt("rate_limit.events_per_second"), "rate_limit.events_per_second should default to 0")
+	assert.Equal(t, false, config.GetBool("capture.enabled"), "capture.enabled should default to false")
+	assert.Equal(t, "/var/lib/go-audit/capture", config.GetString("capture.path"), "capture.path should default to /var/lib/go-audit/capture")
+	assert.Equal(t, uint(100*1024*1024), config.GetSizeInBytes("capture.max_size"), "capture.max_size should default to 100MB")
 	assert.Equal(t, 0, config.GetInt("log.flags"), "log.flags should default to 0")
 	assert.Equal(t, 0, l.Flags(), "stdout log flags was wrong")
 	assert.Equal(t, 0, el.Flags(), "stderr log flags was wrong")
@@ -51,58 +104,132 @@ func Test_loadConfig(t *testing.T) {
 }
 
 func Test_setRules(t *testing.T) {
+	lb, _ := hookLogger()
 	defer resetLogger()
 
-	// fail to flush rules
+	// fail on 0 rules
 	config := viper.New()
+	c := &fakeRuleClient{}
+	err := setRules(config, c)
+	assert.EqualError(t, err, "No audit rules found")
+	assert.Nil(t, c.calls, "Should not have touched the kernel")
 
-	err := setRules(config, func(s string, a ...string) error {
-		if s == "auditctl" && a[0] == "-D" {
-			return errors.New("testing")
-		}
-
-		return nil
-	})
+	// fail to parse a rule, nothing should be flushed
+	config.Set("rules", []string{"-a exit,always -S execve", "", "-a -3 -4"})
+	err = setRules(config, c)
+	assert.EqualError(t, err, "Failed to parse rule #3. Error: Unknown list or action `-3` in -a -3")
+	assert.Nil(t, c.calls, "Should not have touched the kernel")
 
+	// fail to flush rules
+	config.Set("rules", []string{"-a exit,always -S execve", "", "-w /etc/passwd -p wa -k passwd"})
+	c = &fakeRuleClient{listErr: errors.New("testing")}
+	err = setRules(config, c)
 	assert.EqualError(t, err, "Failed to flush existing audit rules. Error: testing")
 
-	// fail on 0 rules
-	err = setRules(config, func(s string, a ...string) error { return nil })
-	assert.EqualError(t, err, "No audit rules found")
-
 	// failure to set rule
-	r := 0
-	config.Set("rules", []string{"-a -1 -2", "", "-a -3 -4"})
-	err = setRules(config, func(s string, a ...string) error {
-		if a[0] != "-D" {
-			return errors.New("testing rule")
-		}
+	c = &fakeRuleClient{rules: []*AuditRule{{}}, addErr: errors.New("testing rule")}
+	err = setRules(config, c)
+	assert.EqualError(t, err, "Failed to add rule #1. Error: testing rule")
+	assert.Equal(t, []string{"list", "delete", "add"}, c.calls)
 
-		r++
+	// properly set rules
+	lb.Reset()
+	c = &fakeRuleClient{rules: []*AuditRule{{}, {}}}
+	err = setRules(config, c)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"list", "delete", "delete", "add", "add"}, c.calls)
+	assert.Equal(t, "Flushed existing audit rules\nAdded audit rule #1\nAdded audit rule #3\n", lb.String())
 
-		return nil
-	})
+	// multicast mode never flushes and tolerates rules that are already loaded
+	config.Set("multicast.enabled", true)
+	lb.Reset()
+	c = &fakeRuleClient{rules: []*AuditRule{{}, {}}, addErr: syscall.EEXIST}
+	err = setRules(config, c)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"add", "add"}, c.calls)
+	assert.Equal(t, "Audit rule #1 is already loaded\nAudit rule #3 is already loaded\n", lb.String())
 
-	assert.Equal(t, 1, r, "Wrong number of rule set attempts")
+	c = &fakeRuleClient{addErr: errors.New("testing rule")}
+	err = setRules(config, c)
 	assert.EqualError(t, err, "Failed to add rule #1. Error: testing rule")
 
-	// properly set rules
-	r = 0
-	err = setRules(config, func(s string, a ...string) error {
-		// Skip the flush rules
-		if a[0] != "-a" {
-			return nil
-		}
+	// multicast mode refuses to flush
+	config.Set("rules", []string{"-a exit,always -S execve", "-D"})
+	c = &fakeRuleClient{}
+	err = setRules(config, c)
+	assert.EqualError(t, err, "Rule #2 would flush the audit rules, this is not allowed in multicast mode")
+	assert.Nil(t, c.calls, "Should not have touched the kernel")
 
-		if (a[1] == "-1" && a[2] == "-2") || (a[1] == "-3" && a[2] == "-4") {
-			r++
-		}
+	// rules are optional in multicast mode
+	config.Set("rules", []string{})
+	lb.Reset()
+	err = setRules(config, c)
+	assert.Nil(t, err)
+	assert.Nil(t, c.calls, "Should not have touched the kernel")
+	assert.Equal(t, "No audit rules found, leaving the kernel audit rules alone\n", lb.String())
+}
 
-		return nil
-	})
+func Test_createRuleChecker(t *testing.T) {
+	config := viper.New()
+	config.Set("rules_check.interval", "0s")
+	rc, err := createRuleChecker(config, &fakeRuleClient{}, &groupRecorder{})
+	assert.EqualError(t, err, "rules_check.interval must be greater than 0, got `0s`")
+	assert.Nil(t, rc)
+
+	config.Set("rules_check.interval", "10s")
+	config.Set("rules", []string{"-a exit,always -S execve", "-a nope"})
+	rc, err = createRuleChecker(config, &fakeRuleClient{}, &groupRecorder{})
+	assert.EqualError(t, err, "Failed to parse rule #2. Error: Unknown list or action `nope` in -a nope")
+	assert.Nil(t, rc)
+
+	// What we expect comes from the config, not from what happens to be loaded
+	config.Set("rules", []string{"-a exit,always -S execve"})
+	c := &fakeRuleClient{}
+	rc, err = createRuleChecker(config, c, &groupRecorder{})
+	assert.Nil(t, err)
+	assert.Nil(t, c.calls)
+	assert.Len(t, rc.expected, 1)
+	assert.False(t, rc.shared)
+	assert.Nil(t, rc.reapply)
+
+	config.Set("multicast.enabled", true)
+	rc, err = createRuleChecker(config, c, &groupRecorder{})
+	assert.Nil(t, err)
+	assert.True(t, rc.shared)
+	config.Set("multicast.enabled", false)
 
-	assert.Equal(t, 2, r, "Wrong number of correct rule set attempts")
+	config.Set("rules_check.reapply", true)
+	rc, err = createRuleChecker(config, &fakeRuleClient{}, &groupRecorder{})
 	assert.Nil(t, err)
+	assert.NotNil(t, rc.reapply)
+}
+
+// fakeRuleClient records what setRules asked the kernel to do
+type fakeRuleClient struct {
+	calls   []string
+	rules   []*AuditRule
+	listErr error
+	addErr  error
+}
+
+func (c *fakeRuleClient) AddRule(rule *AuditRule) error {
+	c.calls = append(c.calls, "add")
+	return c.addErr
+}
+
+func (c *fakeRuleClient) DeleteRule(rule *AuditRule) error {
+	c.calls = append(c.calls, "delete")
+	return nil
+}
+
+func (c *fakeRuleClient) ListRules() ([]*AuditRule, error) {
+	c.calls = append(c.calls, "list")
+	return c.rules, c.listErr
+}
+
+func (c *fakeRuleClient) SetStatus(status *AuditStatusPayload) error {
+	c.calls = append(c.calls, "status")
+	return nil
 }
 
 func Test_createFileOutput(t *testing.T) {
@@ -180,7 +307,7 @@ func Test_createFileOutput(t *testing.T) {
 	w, err = createFileOutput(c)
 	assert.Nil(t, err)
 	assert.NotNil(t, w)
-	assert.IsType(t, &os.File{}, w.w)
+	assert.IsType(t, &RotatingFile{}, w.w)
 }
 
 func Test_createSyslogOutput(t *testing.T) {
@@ -357,8 +484,13 @@ func Test_createOutput(t *testing.T) {
 	c.Set("output.file.group", g.Name)
 
 	w, err = createOutput(c)
-	assert.EqualError(t, err, "Only one output can be enabled at a time")
-	assert.Nil(t, w)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, w.Len())
+	assert.Equal(t, "syslog", w.outputs[0].name)
+	assert.IsType(t, &syslog.Writer{}, w.outputs[0].writer.w)
+	assert.Equal(t, "file", w.outputs[1].name)
+	assert.IsType(t, &RotatingFile{}, w.outputs[1].writer.w)
+	w.Close()
 
 	// syslog error
 	c = viper.New()
@@ -386,13 +518,15 @@ func Test_createOutput(t *testing.T) {
 
 	// All good syslog
 	c = viper.New()
+	c.Set("output.syslog.enabled", true)
 	c.Set("output.syslog.attempts", 1)
 	c.Set("output.syslog.network", "tcp")
 	c.Set("output.syslog.address", l.Addr().String())
-	w, err = createSyslogOutput(c)
+	w, err = createOutput(c)
 	assert.Nil(t, err)
 	assert.NotNil(t, w)
-	assert.IsType(t, &syslog.Writer{}, w.w)
+	assert.IsType(t, &syslog.Writer{}, w.outputs[0].writer.w)
+	w.Close()
 
 	// All good file
 	c = viper.New()
@@ -405,8 +539,40 @@ func Test_createOutput(t *testing.T) {
 	w, err = createOutput(c)
 	assert.Nil(t, err)
 	assert.NotNil(t, w)
-	assert.IsType(t, &AuditWriter{}, w)
-	assert.IsType(t, &os.File{}, w.w)
+	assert.Equal(t, 1, w.Len())
+	assert.IsType(t, &AuditWriter{}, w.outputs[0].writer)
+	assert.IsType(t, &RotatingFile{}, w.outputs[0].writer.w)
+
+	// Spooled stdout
+	dir := t.TempDir()
+	c = viper.New()
+	c.Set("output.stdout.enabled", true)
+	c.Set("output.stdout.attempts", 1)
+	c.Set("spool.enabled", true)
+	c.Set("spool.directory", dir)
+	c.Set("spool.max_size", 1024*1024)
+	c.Set("spool.full_policy", "block")
+	c.Set("spool.max_attempts", 5)
+	w, err = createOutput(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, w.outputs[0].spool)
+	assert.True(t, w.outputs[0].spool.block)
+	assert.Equal(t, 5, w.outputs[0].maxAttempts)
+	assert.DirExists(t, path.Join(dir, "stdout"))
+	w.Close()
+
+	// Bad spool attempts
+	c.Set("spool.max_attempts", -1)
+	w, err = createOutput(c)
+	assert.EqualError(t, err, "Spool max_attempts must be 0 or more, -1 provided")
+	assert.Nil(t, w)
+
+	// Bad spool policy
+	c.Set("spool.max_attempts", 0)
+	c.Set("spool.full_policy", "nope")
+	w, err = createOutput(c)
+	assert.EqualError(t, err, "Unknown spool full_policy `nope`, must be `drop_oldest` or `block`")
+	assert.Nil(t, w)
 
 	// File rotation
 	os.Rename(path.Join(os.TempDir(), "go-audit.test.log"), path.Join(os.TempDir(), "go-audit.test.log.rotated"))
@@ -489,13 +655,22 @@ func Test_createFilters(t *testing.T) {
 	assert.EqualError(t, err, "`syscall` in filter 1 could not be parsed; Value: `[]`")
 	assert.Empty(t, f)
 
+	// Bad syscall - unknown name
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"syscall": "nope"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "`syscall` in filter 1 is not a known syscall name; Value: `nope`")
+	assert.Empty(t, f)
+
 	// Missing regex
 	c = viper.New()
 	rf = make([]interface{}, 0)
 	rf = append(rf, map[string]interface{}{"syscall": "1", "message_type": "1"})
 	c.Set("filters", rf)
 	f, err = createFilters(c)
-	assert.EqualError(t, err, "Filter 1 is missing the `regex` entry")
+	assert.EqualError(t, err, "Filter 1 is missing the `regex` or `cidr` entry")
 	assert.Empty(t, f)
 
 	// Missing message_type
@@ -536,10 +711,122 @@ func Test_createFilters(t *testing.T) {
 	assert.Equal(t, "1", f[0].regex.String())
 	assert.Empty(t, elb.String())
 	assert.Equal(t, "Ignoring syscall `1` containing message type `1` matching string `1`\n", lb.String())
+
+	// Good with names
+	lb.Reset()
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"message_type": 1306, "regex": "1", "syscall": "Bind"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.Nil(t, err)
+	assert.Equal(t, "bind", f[0].syscall)
+	assert.Equal(t, "Ignoring syscall `bind` containing message type `1306` matching string `1`\n", lb.String())
+
+	// Bad cidr
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"cidr": "10.0.0.0"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "`cidr` in filter 1 could not be parsed; Value: `10.0.0.0`; Error: invalid CIDR address: 10.0.0.0")
+	assert.Empty(t, f)
+
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"cidr": 10})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "`cidr` in filter 1 could not be parsed; Value: `10`")
+	assert.Empty(t, f)
+
+	// Good with a cidr, with and without a regex
+	lb.Reset()
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"message_type": 1306, "cidr": "10.1.0.0/16", "syscall": "connect"})
+	rf = append(rf, map[string]interface{}{"message_type": 1306, "cidr": "fd00::/8", "regex": "saddr=0A", "syscall": "bind"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.Nil(t, err)
+	assert.Len(t, f, 2)
+	assert.Equal(t, "10.1.0.0/16", f[0].cidr.String())
+	assert.Nil(t, f[0].regex)
+	assert.Equal(
+		t,
+		"Ignoring syscall `connect` containing message type `1306` with an address in `10.1.0.0/16`\n"+
+			"Ignoring syscall `bind` containing message type `1306` matching string `saddr=0A` and with an address in `fd00::/8`\n",
+		lb.String(),
+	)
+
+	// Bad expression
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"expression": "uid =="})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "`expression` in filter 1 could not be parsed; Value: `uid ==`; Error: Unexpected end of expression")
+	assert.Empty(t, f)
+
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"expression": 1})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "`expression` in filter 1 could not be parsed; Value: `1`")
+	assert.Empty(t, f)
+
+	// Expressions stand on their own
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"expression": "uid == 0", "syscall": "bind"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "Filter 1 can not have `syscall`, `message_type`, `regex` or `cidr` along with `expression`")
+	assert.Empty(t, f)
+
+	// Bad action
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"expression": "uid == 0", "action": "nope"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "`action` in filter 1 must be `drop` or `keep`; Value: `nope`")
+	assert.Empty(t, f)
+
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"message_type": 1306, "regex": "1", "action": "keep"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "`action` in filter 1 needs an `expression`")
+	assert.Empty(t, f)
+
+	// Good expressions
+	lb.Reset()
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"expression": `exe == "/usr/bin/ps" && !tty`})
+	rf = append(rf, map[string]interface{}{"expression": `syscall_name == "connect"`, "action": "keep"})
+	rf = append(rf, map[string]interface{}{"expression": `uid == 0`, "action": "drop"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.Nil(t, err)
+	assert.Len(t, f, 3)
+	assert.False(t, f[0].keep)
+	assert.True(t, f[1].keep)
+	assert.False(t, f[2].keep)
+	assert.Equal(
+		t,
+		"Ignoring message groups matching `exe == \"/usr/bin/ps\" && !tty`\n"+
+			"Keeping only message groups matching `syscall_name == \"connect\"`\n"+
+			"Ignoring message groups matching `uid == 0`\n",
+		lb.String(),
+	)
 }
 
 func Benchmark_MultiPacketMessage(b *testing.B) {
-	marshaller := NewAuditMarshaller(NewAuditWriter(&noopWriter{}, 1), uint16(1300), uint16(1399), false, false, 1, []AuditFilter{}, nil)
+	marshaller := NewAuditMarshaller(NewAuditWriter(&noopWriter{}, 1), uint16(1300), uint16(1399), false, false, 1, []AuditFilter{})
 
 	data := make([][]byte, 6)
 
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	CAPTURE_MAGIC       = "GACAP001" // Starts every capture file, the last digits are the format version
+	CAPTURE_FRAME_START = 28         // Receive time, data length and the netlink header in front of every frame
+	CAPTURE_MAX_DATA    = 1 << 20    // Anything bigger than this isn't a frame we could have received
+)
+
+// CaptureWriter records the netlink frames we receive, with the time they arrived, so they can be replayed later.
+// Every frame is
+//
+//	int64  receive time in nanoseconds since the epoch
+//	uint32 length of the data
+//	the netlink header, Len uint32, Type uint16, Flags uint16, Seq uint32 and Pid uint32
+//	the data
+//
+// all little endian, after the CAPTURE_MAGIC header at the start of the file
+type CaptureWriter struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64 // Move the file to path.1 once the next frame would grow it past this many bytes, 0 for no limit
+	f       *os.File
+	size    int64
+	buf     []byte
+	closed  bool
+}
+
+// NewCaptureWriter opens or creates the capture file at path, frames are appended to whatever is already there.
+// Once the file reaches maxSize it replaces path.1 and a new one is started, so at most two files are kept
+func NewCaptureWriter(path string, maxSize int64) (*CaptureWriter, error) {
+	c := &CaptureWriter{path: path, maxSize: maxSize}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Write appends a frame to the capture file in a single write so a crash can only cut off the last one
+func (c *CaptureWriter) Write(msg *syscall.NetlinkMessage, at time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errors.New("Capture file is closed")
+	}
+
+	c.buf = appendCaptureFrame(c.buf[:0], msg, at)
+	if c.maxSize > 0 && c.size > int64(len(CAPTURE_MAGIC)) && c.size+int64(len(c.buf)) > c.maxSize {
+		// The frame is dropped rather than going over the limit if we can't start a new file
+		if err := c.rotate(); err != nil {
+			return fmt.Errorf("Failed to rotate capture file. Error: %s", err)
+		}
+	}
+
+	n, err := c.f.Write(c.buf)
+	c.size += int64(n)
+	return err
+}
+
+// Close syncs and closes the capture file
+func (c *CaptureWriter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+	if err := c.f.Sync(); err != nil {
+		c.f.Close()
+		return err
+	}
+
+	return c.f.Close()
+}
+
+// open opens the capture file at path, writing the header if it is new
+func (c *CaptureWriter) open() error {
+	f, err := os.OpenFile(c.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open capture file. Error: %s", err)
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to stat capture file. Error: %s", err)
+	}
+
+	size := st.Size()
+	if size == 0 {
+		if _, err := f.WriteString(CAPTURE_MAGIC); err != nil {
+			f.Close()
+			return fmt.Errorf("Failed to write capture file header. Error: %s", err)
+		}
+		size = int64(len(CAPTURE_MAGIC))
+	} else {
+		magic := make([]byte, len(CAPTURE_MAGIC))
+		if _, err := f.ReadAt(magic, 0); err != nil || string(magic) != CAPTURE_MAGIC {
+			f.Close()
+			return fmt.Errorf("%s is not a capture file", c.path)
+		}
+	}
+
+	c.f, c.size = f, size
+	return nil
+}
+
+// rotate moves the full capture file to path.1, replacing the one that was there, and starts a new one
+func (c *CaptureWriter) rotate() error {
+	if err := os.Rename(c.path, c.path+".1"); err != nil {
+		return err
+	}
+
+	old := c.f
+	if err := c.open(); err != nil {
+		return err
+	}
+
+	if err := old.Close(); err != nil {
+		el.Printf("Error closing old capture file: %+v\n", err)
+	}
+
+	return nil
+}
+
+func appendCaptureFrame(buf []byte, msg *syscall.NetlinkMessage, at time.Time) []byte {
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(at.UnixNano()))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(msg.Data)))
+	buf = binary.LittleEndian.AppendUint32(buf, msg.Header.Len)
+	buf = binary.LittleEndian.AppendUint16(buf, msg.Header.Type)
+	buf = binary.LittleEndian.AppendUint16(buf, msg.Header.Flags)
+	buf = binary.LittleEndian.AppendUint32(buf, msg.Header.Seq)
+	buf = binary.LittleEndian.AppendUint32(buf, msg.Header.Pid)
+	return append(buf, msg.Data...)
+}
+
+// CaptureReader reads back the frames written by a CaptureWriter
+type CaptureReader struct {
+	r     io.Reader
+	start [CAPTURE_FRAME_START]byte
+}
+
+// NewCaptureReader checks that r holds a capture file and returns a reader for its frames
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	magic := make([]byte, len(CAPTURE_MAGIC))
+	if _, err := io.ReadFull(r, magic); err != nil || !isCapture(magic) {
+		return nil, errors.New("Not a capture file")
+	}
+
+	return &CaptureReader{r: r}, nil
+}
+
+// Next returns the next frame and the time it was received, io.EOF once there are no more frames
+func (c *CaptureReader) Next() (*syscall.NetlinkMessage, time.Time, error) {
+	if _, err := io.ReadFull(c.r, c.start[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("Capture file ends in the middle of a frame")
+		}
+		return nil, time.Time{}, err
+	}
+
+	b := c.start[:]
+	at := time.Unix(0, int64(binary.LittleEndian.Uint64(b[0:8])))
+	size := binary.LittleEndian.Uint32(b[8:12])
+	if size > CAPTURE_MAX_DATA {
+		return nil, time.Time{}, fmt.Errorf("Capture frame is too big, %d bytes", size)
+	}
+
+	msg := &syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{
+			Len:   binary.LittleEndian.Uint32(b[12:16]),
+			Type:  binary.LittleEndian.Uint16(b[16:18]),
+			Flags: binary.LittleEndian.Uint16(b[18:20]),
+			Seq:   binary.LittleEndian.Uint32(b[20:24]),
+			Pid:   binary.LittleEndian.Uint32(b[24:28]),
+		},
+		Data: make([]byte, size),
+	}
+
+	if _, err := io.ReadFull(c.r, msg.Data); err != nil {
+		return nil, time.Time{}, errors.New("Capture file ends in the middle of a frame")
+	}
+
+	return msg, at, nil
+}
+
+func isCapture(b []byte) bool {
+	return bytes.Equal(b, []byte(CAPTURE_MAGIC))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureWriter(t *testing.T) {
+	file := path.Join(t.TempDir(), "capture")
+
+	c, err := NewCaptureWriter(file, 0)
+	assert.Nil(t, err)
+
+	at := time.Unix(1500000000, 123)
+	assert.Nil(t, c.Write(new1300("1"), at))
+	assert.Nil(t, c.Write(new1320("1"), at.Add(time.Second)))
+	assert.Nil(t, c.Close())
+	assert.EqualError(t, c.Write(new1300("2"), at), "Capture file is closed")
+	assert.Nil(t, c.Close())
+
+	// Frames are appended after a restart
+	c, err = NewCaptureWriter(file, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Write(new1300("2"), at.Add(2*time.Second)))
+	assert.Nil(t, c.Close())
+
+	f, err := os.Open(file)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	r, err := NewCaptureReader(f)
+	assert.Nil(t, err)
+
+	msg, got, err := r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, at, got)
+	assert.Equal(t, new1300("1"), msg)
+
+	msg, got, err = r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, at.Add(time.Second), got)
+	assert.Equal(t, new1320("1"), msg)
+
+	msg, got, err = r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, at.Add(2*time.Second), got)
+	assert.Equal(t, new1300("2"), msg)
+
+	_, _, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// Refuses to append to anything else
+	other := path.Join(t.TempDir(), "other")
+	os.WriteFile(other, []byte("type=SYSCALL"), 0600)
+	_, err = NewCaptureWriter(other, 0)
+	assert.EqualError(t, err, other+" is not a capture file")
+}
+
+func TestCaptureWriter_MaxSize(t *testing.T) {
+	file := path.Join(t.TempDir(), "capture")
+	at := time.Unix(1500000000, 0)
+
+	// Room for two frames
+	frame := len(appendCaptureFrame(nil, new1300("1"), at))
+	c, err := NewCaptureWriter(file, int64(len(CAPTURE_MAGIC)+2*frame))
+	assert.Nil(t, err)
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, c.Write(new1300("1"), at.Add(time.Duration(i)*time.Second)))
+	}
+	assert.Nil(t, c.Close())
+
+	// The older file was replaced, both can be replayed on their own
+	assert.Equal(t, []time.Duration{2 * time.Second, 3 * time.Second}, readCaptureTimes(t, file+".1", at))
+	assert.Equal(t, []time.Duration{4 * time.Second}, readCaptureTimes(t, file, at))
+
+	// A frame bigger than the limit still gets a file to itself
+	c, err = NewCaptureWriter(file, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Write(new1300("1"), at.Add(5*time.Second)))
+	assert.Nil(t, c.Write(new1300("1"), at.Add(6*time.Second)))
+	assert.Nil(t, c.Close())
+
+	assert.Equal(t, []time.Duration{5 * time.Second}, readCaptureTimes(t, file+".1", at))
+	assert.Equal(t, []time.Duration{6 * time.Second}, readCaptureTimes(t, file, at))
+
+	// Nothing is written if a new file can't be started
+	c, err = NewCaptureWriter(file, 1)
+	assert.Nil(t, err)
+	os.Remove(file)
+	assert.Contains(t, c.Write(new1300("1"), at).Error(), "Failed to rotate capture file. Error: ")
+	assert.Nil(t, c.Close())
+}
+
+// readCaptureTimes returns when every frame in a capture file was received, relative to start
+func readCaptureTimes(t *testing.T, file string, start time.Time) []time.Duration {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := NewCaptureReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var times []time.Duration
+	for {
+		_, at, err := r.Next()
+		if err == io.EOF {
+			return times
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		times = append(times, at.Sub(start))
+	}
+}
+
+func TestCaptureReader_Errors(t *testing.T) {
+	_, err := NewCaptureReader(bytes.NewReader([]byte("type=SYSCALL msg=audit(1:1): ")))
+	assert.EqualError(t, err, "Not a capture file")
+
+	frame := appendCaptureFrame([]byte(CAPTURE_MAGIC), new1300("1"), time.Now())
+
+	// A crash can cut off the last frame
+	r, err := NewCaptureReader(bytes.NewReader(frame[:len(frame)-3]))
+	assert.Nil(t, err)
+	_, _, err = r.Next()
+	assert.EqualError(t, err, "Capture file ends in the middle of a frame")
+
+	r, _ = NewCaptureReader(bytes.NewReader(frame[:len(CAPTURE_MAGIC)+10]))
+	_, _, err = r.Next()
+	assert.EqualError(t, err, "Capture file ends in the middle of a frame")
+
+	binary.LittleEndian.PutUint32(frame[len(CAPTURE_MAGIC)+8:], CAPTURE_MAX_DATA+1)
+	r, _ = NewCaptureReader(bytes.NewReader(frame))
+	_, _, err = r.Next()
+	assert.EqualError(t, err, "Capture frame is too big, 1048577 bytes")
+}
+
+func TestNetlinkClient_Capture(t *testing.T) {
+	file := path.Join(t.TempDir(), "capture")
+	c, err := NewCaptureWriter(file, 0)
+	assert.Nil(t, err)
+
+	n := makeNelinkClient(t)
+	n.Capture(c)
+
+	packet := &NetlinkPacket{
+		Type:  uint16(1300),
+		Flags: syscall.NLM_F_REQUEST,
+		Pid:   uint32(1006),
+	}
+
+	before := time.Now()
+	sent := sendReceive(t, n, packet, &AuditStatusPayload{Mask: 4})
+	assert.Nil(t, n.Close())
+
+	f, err := os.Open(file)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	r, err := NewCaptureReader(f)
+	assert.Nil(t, err)
+
+	msg, at, err := r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, sent, msg)
+	assert.False(t, at.Before(before))
+
+	_, _, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -16,6 +17,26 @@ var Endianness = binary.LittleEndian
 const (
 	// MAX_AUDIT_MESSAGE_LENGTH see https://github.com/torvalds/linux/blob/v5.6/include/uapi/linux/audit.h#L441
 	MAX_AUDIT_MESSAGE_LENGTH = 8970
+
+	// Control message types, see linux/audit.h
+	AUDIT_GET        = 1000
+	AUDIT_SET        = 1001
+	AUDIT_ADD_RULE   = 1011
+	AUDIT_DEL_RULE   = 1012
+	AUDIT_LIST_RULES = 1013
+
+	AUDIT_NLGRP_READLOG = 1 // Multicast group that gets a read only copy of every audit event
+
+	// AuditStatusPayload.Mask bits for AUDIT_SET
+	AUDIT_STATUS_ENABLED           = 0x1
+	AUDIT_STATUS_FAILURE           = 0x2
+	AUDIT_STATUS_PID               = 0x4
+	AUDIT_STATUS_RATE_LIMIT        = 0x8
+	AUDIT_STATUS_BACKLOG_LIMIT     = 0x10
+	AUDIT_STATUS_BACKLOG_WAIT_TIME = 0x20
+
+	// How long to wait on the kernel to answer a control request
+	CONTROL_TIMEOUT = time.Second * 5
 )
 
 // TODO: this should live in a marshaller
@@ -36,33 +57,52 @@ type AuditStatusPayload struct {
 type NetlinkPacket syscall.NlMsghdr
 
 type NetlinkClient struct {
-	fd      int
-	address syscall.Sockaddr
-	seq     uint32
-	buf     []byte
+	fd       int
+	address  syscall.Sockaddr
+	seq      uint32
+	buf      []byte
+	mu       sync.Mutex                         // Only one control request can be in flight at a time
+	settings atomic.Pointer[AuditStatusPayload] // Kernel settings to reapply alongside KeepConnection
+	closed   atomic.Bool
+	capture  *CaptureWriter // Every frame Receive returns is recorded here, if set
 }
 
 // NewNetlinkClient creates a new NetLinkClient and optionally tries to modify the netlink recv buffer
 func NewNetlinkClient(recvSize int) (*NetlinkClient, error) {
-	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_AUDIT)
+	n, err := newNetlinkSocket(0)
 	if err != nil {
-		return nil, fmt.Errorf("Could not create a socket: %s", err)
+		return nil, err
 	}
 
-	n := &NetlinkClient{
-		fd:      fd,
-		address: &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 0, Pid: 0},
-		buf:     make([]byte, MAX_AUDIT_MESSAGE_LENGTH),
-	}
+	n.setReceiveBuffer(recvSize)
 
-	if err = syscall.Bind(fd, n.address); err != nil {
-		syscall.Close(fd)
-		return nil, fmt.Errorf("Could not bind to netlink socket: %s", err)
+	go func() {
+		for !n.Closed() {
+			n.KeepConnection()
+			time.Sleep(time.Second * 5)
+		}
+	}()
+
+	return n, nil
+}
+
+// NewNetlinkMulticastClient creates a NetlinkClient that passively reads a copy of every audit event from the
+// AUDIT_NLGRP_READLOG multicast group. It never claims the audit pid so it can run next to auditd.
+// Needs CAP_AUDIT_READ and a 3.16 or newer kernel
+func NewNetlinkMulticastClient(recvSize int) (*NetlinkClient, error) {
+	n, err := newNetlinkSocket(1 << (AUDIT_NLGRP_READLOG - 1))
+	if err != nil {
+		return nil, err
 	}
 
+	n.setReceiveBuffer(recvSize)
+	return n, nil
+}
+
+func (n *NetlinkClient) setReceiveBuffer(recvSize int) {
 	// Set the buffer size if we were asked
 	if recvSize > 0 {
-		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, recvSize); err != nil {
+		if err := syscall.SetsockoptInt(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, recvSize); err != nil {
 			el.Println("Failed to set receive buffer size")
 		}
 	}
@@ -71,19 +111,67 @@ func NewNetlinkClient(recvSize int) (*NetlinkClient, error) {
 	if v, err := syscall.GetsockoptInt(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err == nil {
 		l.Println("Socket receive buffer size:", v)
 	}
+}
 
-	go func() {
-		for {
-			n.KeepConnection()
-			time.Sleep(time.Second * 5)
-		}
-	}()
+// NewNetlinkControlClient creates a NetlinkClient for request/response style control messages, like managing rules.
+// It never claims the audit pid so audit events are not delivered to it.
+func NewNetlinkControlClient() (*NetlinkClient, error) {
+	n, err := newNetlinkSocket(0)
+	if err != nil {
+		return nil, err
+	}
+
+	tv := syscall.NsecToTimeval(CONTROL_TIMEOUT.Nanoseconds())
+	if err = syscall.SetsockoptTimeval(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(n.fd)
+		return nil, fmt.Errorf("Could not set the netlink socket timeout: %s", err)
+	}
+
+	return n, nil
+}
+
+func newNetlinkSocket(groups uint32) (*NetlinkClient, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_AUDIT)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create a socket: %s", err)
+	}
+
+	n := &NetlinkClient{
+		fd:      fd,
+		address: &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups, Pid: 0},
+		buf:     make([]byte, MAX_AUDIT_MESSAGE_LENGTH),
+	}
+
+	if err = syscall.Bind(fd, n.address); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Could not bind to netlink socket: %s", err)
+	}
 
 	return n, nil
 }
 
-// Send will send a packet and payload to the netlink socket without waiting for a response
-func (n *NetlinkClient) Send(np *NetlinkPacket, a *AuditStatusPayload) error {
+// Close closes the underlying netlink socket. If we were the audit daemon the kernel stops sending us events
+func (n *NetlinkClient) Close() error {
+	n.closed.Store(true)
+	err := syscall.Close(n.fd)
+
+	if n.capture != nil {
+		if cerr := n.capture.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// Closed reports if Close was called, receive errors after that are expected
+func (n *NetlinkClient) Closed() bool {
+	return n.closed.Load()
+}
+
+// Send will send a packet and payload to the netlink socket without waiting for a response.
+// The payload can be anything binary.Write understands, including a []byte
+func (n *NetlinkClient) Send(np *NetlinkPacket, a interface{}) error {
 	//We need to get the length first. This is a bit wasteful, but requests are rare so yolo..
 	buf := new(bytes.Buffer)
 	var length int
@@ -131,6 +219,12 @@ func (n *NetlinkClient) Receive() (*syscall.NetlinkMessage, error) {
 		Data: n.buf[syscall.SizeofNlMsghdr:nlen],
 	}
 
+	if n.capture != nil {
+		if err := n.capture.Write(msg, time.Now()); err != nil && !n.Closed() {
+			el.Printf("Failed to write to the capture file. Error: %s\n", err)
+		}
+	}
+
 	return msg, nil
 }
 
@@ -153,4 +247,154 @@ func (n *NetlinkClient) KeepConnection() {
 	if err != nil {
 		el.Println("Error occurred while trying to keep the connection:", err)
 	}
+
+	// Someone may have changed the kernel settings out from under us, put ours back
+	if settings := n.settings.Load(); settings != nil {
+		packet = &NetlinkPacket{
+			Type:  AUDIT_SET,
+			Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
+			Pid:   uint32(syscall.Getpid()),
+		}
+
+		if err := n.Send(packet, settings); err != nil {
+			el.Println("Error occurred while trying to reapply the kernel audit settings:", err)
+		}
+	}
+}
+
+// KeepSettings makes KeepConnection reapply the kernel audit settings every time it runs
+func (n *NetlinkClient) KeepSettings(settings *AuditStatusPayload) {
+	n.settings.Store(settings)
+}
+
+// Capture records every frame Receive returns to w, w is closed along with the client.
+// Must be called before anything is received
+func (n *NetlinkClient) Capture(w *CaptureWriter) {
+	n.capture = w
+}
+
+// request sends a control message and waits for the kernel to acknowledge it. If handler is not nil it is given every
+// reply to the request until it returns true or the kernel signals the end of a multipart reply.
+func (n *NetlinkClient) request(msgType uint16, payload interface{}, handler func(*syscall.NetlinkMessage) (bool, error)) error {
+	packet := &NetlinkPacket{
+		Type:  msgType,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
+		Pid:   uint32(syscall.Getpid()),
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.Send(packet, payload); err != nil {
+		return err
+	}
+
+	// The kernel may send the ack before or after the actual reply
+	acked, done := false, handler == nil
+	for !acked || !done {
+		msg, err := n.Receive()
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
+				return errors.New("Timed out waiting for a response from the kernel")
+			}
+			return err
+		}
+
+		// Ignore anything left over from an earlier request
+		if msg.Header.Seq != packet.Seq {
+			continue
+		}
+
+		switch msg.Header.Type {
+		case syscall.NLMSG_ERROR:
+			if len(msg.Data) < 4 {
+				return errors.New("Got a truncated netlink error message")
+			}
+
+			if errno := int32(Endianness.Uint32(msg.Data[0:4])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			acked = true
+
+		case syscall.NLMSG_DONE:
+			return nil
+
+		default:
+			if done {
+				continue
+			}
+
+			if done, err = handler(msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// AddRule adds an audit rule to the kernel
+func (n *NetlinkClient) AddRule(rule *AuditRule) error {
+	b, err := rule.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return n.request(AUDIT_ADD_RULE, b, nil)
+}
+
+// DeleteRule removes an audit rule from the kernel, the rule has to match an existing one exactly
+func (n *NetlinkClient) DeleteRule(rule *AuditRule) error {
+	b, err := rule.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return n.request(AUDIT_DEL_RULE, b, nil)
+}
+
+// ListRules returns every audit rule currently loaded in the kernel
+func (n *NetlinkClient) ListRules() ([]*AuditRule, error) {
+	var rules []*AuditRule
+	err := n.request(AUDIT_LIST_RULES, []byte{}, func(msg *syscall.NetlinkMessage) (bool, error) {
+		if msg.Header.Type != AUDIT_LIST_RULES {
+			return false, nil
+		}
+
+		rule, err := parseAuditRule(msg.Data)
+		if err != nil {
+			return false, err
+		}
+
+		rules = append(rules, rule)
+		return false, nil
+	})
+
+	return rules, err
+}
+
+// GetStatus asks the kernel for its current audit status
+func (n *NetlinkClient) GetStatus() (*AuditStatusPayload, error) {
+	status := &AuditStatusPayload{}
+	err := n.request(AUDIT_GET, []byte{}, func(msg *syscall.NetlinkMessage) (bool, error) {
+		if msg.Header.Type != AUDIT_GET {
+			return false, nil
+		}
+
+		// Older kernels send a shorter struct, newer ones a longer one. Missing fields are left as 0
+		data := make([]byte, binary.Size(status))
+		copy(data, msg.Data)
+		return true, binary.Read(bytes.NewReader(data), Endianness, status)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// SetStatus changes the kernel audit settings selected by status.Mask
+func (n *NetlinkClient) SetStatus(status *AuditStatusPayload) error {
+	return n.request(AUDIT_SET, status, nil)
 }
@@ -7,6 +7,7 @@ import (
 	"os"
 	"syscall"
 	"testing"
+	"time"
 )
 
 func TestNetlinkClient_KeepConnection(t *testing.T) {
@@ -28,6 +29,25 @@ func TestNetlinkClient_KeepConnection(t *testing.T) {
 	assert.Equal(t, uint32(56), msg.Header.Len, "Packet size is wrong - this test is brittle though")
 	assert.EqualValues(t, msg.Data[:40], expectedData, "data was wrong")
 
+	// Configured kernel settings are sent right after
+	n.KeepSettings(&AuditStatusPayload{Mask: AUDIT_STATUS_BACKLOG_LIMIT, BacklogLimit: 8192})
+	n.KeepConnection()
+	msg, err = n.Receive()
+	if err != nil {
+		t.Fatal("Did not expect an error", err)
+	}
+	assert.Equal(t, uint16(1001), msg.Header.Type, "Header.Type mismatch")
+	assert.Equal(t, uint32(AUDIT_STATUS_PID), binary.LittleEndian.Uint32(msg.Data[0:4]))
+
+	msg, err = n.Receive()
+	if err != nil {
+		t.Fatal("Did not expect an error", err)
+	}
+	assert.Equal(t, uint16(1001), msg.Header.Type, "Header.Type mismatch")
+	assert.Equal(t, uint32(AUDIT_STATUS_BACKLOG_LIMIT), binary.LittleEndian.Uint32(msg.Data[0:4]))
+	assert.Equal(t, uint32(8192), binary.LittleEndian.Uint32(msg.Data[20:24]))
+	n.KeepSettings(nil)
+
 	// Make sure we get errors printed
 	lb, elb := hookLogger()
 	defer resetLogger()
@@ -107,6 +127,105 @@ func TestNewNetlinkClient(t *testing.T) {
 	}
 }
 
+func TestNetlinkClient_Rules(t *testing.T) {
+	n, kernel := makeControlClient(t)
+	defer syscall.Close(n.fd)
+	defer syscall.Close(kernel)
+
+	cmd, _ := ParseAuditRule("-a exit,always -S execve -k exec")
+	rule, _ := cmd.rule.MarshalBinary()
+
+	// The ack can show up before the rules, anything with another sequence number is ignored
+	go fakeKernel(t, kernel, func(req *syscall.NetlinkMessage) [][]byte {
+		assert.Equal(t, uint16(AUDIT_LIST_RULES), req.Header.Type)
+		return [][]byte{
+			netlinkReply(syscall.NLMSG_ERROR, req.Header.Seq, make([]byte, 4)),
+			netlinkReply(AUDIT_LIST_RULES, req.Header.Seq+10, rule),
+			netlinkReply(AUDIT_LIST_RULES, req.Header.Seq, rule),
+			netlinkReply(AUDIT_LIST_RULES, req.Header.Seq, rule),
+			netlinkReply(syscall.NLMSG_DONE, req.Header.Seq, nil),
+		}
+	})
+
+	rules, err := n.ListRules()
+	assert.Nil(t, err)
+	assert.Equal(t, []*AuditRule{cmd.rule, cmd.rule}, rules)
+
+	// Errors from the kernel come back as errnos
+	go fakeKernel(t, kernel, func(req *syscall.NetlinkMessage) [][]byte {
+		assert.Equal(t, uint16(AUDIT_ADD_RULE), req.Header.Type)
+		assert.Equal(t, rule, req.Data)
+		errno := make([]byte, 4)
+		binary.LittleEndian.PutUint32(errno, uint32(0xffffffef)) // -EEXIST
+		return [][]byte{netlinkReply(syscall.NLMSG_ERROR, req.Header.Seq, errno)}
+	})
+
+	assert.Equal(t, syscall.EEXIST, n.AddRule(cmd.rule))
+
+	go fakeKernel(t, kernel, func(req *syscall.NetlinkMessage) [][]byte {
+		assert.Equal(t, uint16(AUDIT_SET), req.Header.Type)
+		assert.Equal(t, uint32(AUDIT_STATUS_BACKLOG_LIMIT), Endianness.Uint32(req.Data[0:4]))
+		return [][]byte{netlinkReply(syscall.NLMSG_ERROR, req.Header.Seq, make([]byte, 4))}
+	})
+
+	assert.Nil(t, n.SetStatus(&AuditStatusPayload{Mask: AUDIT_STATUS_BACKLOG_LIMIT, BacklogLimit: 10}))
+
+	// The status reply can be shorter than what we know about
+	go fakeKernel(t, kernel, func(req *syscall.NetlinkMessage) [][]byte {
+		assert.Equal(t, uint16(AUDIT_GET), req.Header.Type)
+		reply := make([]byte, 32)
+		binary.LittleEndian.PutUint32(reply[4:8], 1)
+		binary.LittleEndian.PutUint32(reply[20:24], 8192)
+		binary.LittleEndian.PutUint32(reply[24:28], 7)
+		return [][]byte{
+			netlinkReply(AUDIT_GET, req.Header.Seq, reply),
+			netlinkReply(syscall.NLMSG_ERROR, req.Header.Seq, make([]byte, 4)),
+		}
+	})
+
+	status, err := n.GetStatus()
+	assert.Nil(t, err)
+	assert.Equal(t, &AuditStatusPayload{Enabled: 1, BacklogLimit: 8192, Lost: 7}, status)
+
+	// No answer at all
+	tv := syscall.NsecToTimeval(int64(time.Millisecond * 10))
+	syscall.SetsockoptTimeval(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+	assert.EqualError(t, n.DeleteRule(cmd.rule), "Timed out waiting for a response from the kernel")
+}
+
+// Helper to make a control client connected to a fake kernel socket
+func makeControlClient(t *testing.T) (*NetlinkClient, int) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal("Could not create a socket pair:", err)
+	}
+
+	return &NetlinkClient{fd: fds[0], buf: make([]byte, MAX_AUDIT_MESSAGE_LENGTH)}, fds[1]
+}
+
+// Helper to answer a single request on the fake kernel socket
+func fakeKernel(t *testing.T, fd int, answer func(*syscall.NetlinkMessage) [][]byte) {
+	k := &NetlinkClient{fd: fd, buf: make([]byte, MAX_AUDIT_MESSAGE_LENGTH)}
+	req, err := k.Receive()
+	if err != nil {
+		t.Error("Fake kernel failed to receive:", err)
+		return
+	}
+
+	for _, b := range answer(req) {
+		syscall.Write(fd, b)
+	}
+}
+
+// Helper to build a raw netlink message
+func netlinkReply(msgType uint16, seq uint32, data []byte) []byte {
+	b := make([]byte, syscall.SizeofNlMsghdr, syscall.SizeofNlMsghdr+len(data))
+	Endianness.PutUint32(b[0:4], uint32(cap(b)))
+	Endianness.PutUint16(b[4:6], msgType)
+	Endianness.PutUint32(b[8:12], seq)
+	return append(b, data...)
+}
+
 // Helper to make a client listening on a unix socket
 func makeNelinkClient(t *testing.T) *NetlinkClient {
 	os.Remove("go-audit.test.sock")
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ECS_VERSION = "8.11.0" // Version of the Elastic Common Schema the documents follow
+
+// ecsDocument is a message group mapped to the Elastic Common Schema. The records are kept under auditd so nothing
+// is lost that did not map to a field
+type ecsDocument struct {
+	Timestamp    string           `json:"@timestamp"`
+	ECS          ecsVersion       `json:"ecs"`
+	Event        ecsEvent         `json:"event"`
+	Process      *ecsProcess      `json:"process,omitempty"`
+	User         *ecsUser         `json:"user,omitempty"`
+	File         *ecsFile         `json:"file,omitempty"`
+	Source       *ecsEndpoint     `json:"source,omitempty"`
+	Destination  *ecsEndpoint     `json:"destination,omitempty"`
+	Container    *ecsContainer    `json:"container,omitempty"`
+	Orchestrator *ecsOrchestrator `json:"orchestrator,omitempty"`
+	Auditd       ecsAuditd        `json:"auditd"`
+}
+
+type ecsVersion struct {
+	Version string `json:"version"`
+}
+
+type ecsEvent struct {
+	Kind     string   `json:"kind"`
+	Module   string   `json:"module"`
+	Category []string `json:"category,omitempty"`
+	Action   string   `json:"action"`
+	Outcome  string   `json:"outcome"`
+	Sequence int      `json:"sequence"`
+}
+
+type ecsProcess struct {
+	Pid              int         `json:"pid,omitempty"`
+	Parent           *ecsProcess `json:"parent,omitempty"`
+	Name             string      `json:"name,omitempty"`
+	Executable       string      `json:"executable,omitempty"`
+	Args             []string    `json:"args,omitempty"`
+	ArgsCount        int         `json:"args_count,omitempty"`
+	CommandLine      string      `json:"command_line,omitempty"`
+	WorkingDirectory string      `json:"working_directory,omitempty"`
+}
+
+type ecsUser struct {
+	ID        string    `json:"id,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Group     *ecsGroup `json:"group,omitempty"`
+	Effective *ecsUser  `json:"effective,omitempty"`
+	Audit     *ecsUser  `json:"audit,omitempty"` // The login uid, named the way auditbeat does
+}
+
+type ecsGroup struct {
+	ID string `json:"id"`
+}
+
+type ecsFile struct {
+	Path      string `json:"path"`
+	Name      string `json:"name,omitempty"`
+	Directory string `json:"directory,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Inode     string `json:"inode,omitempty"`
+	Device    string `json:"device,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+	UID       string `json:"uid,omitempty"`
+	GID       string `json:"gid,omitempty"`
+	Owner     string `json:"owner,omitempty"`
+}
+
+type ecsEndpoint struct {
+	Address string `json:"address"`
+	IP      string `json:"ip,omitempty"`
+	Port    uint16 `json:"port,omitempty"`
+}
+
+type ecsContainer struct {
+	ID    string    `json:"id"`
+	Name  string    `json:"name,omitempty"`
+	Image *ecsImage `json:"image,omitempty"`
+}
+
+type ecsImage struct {
+	Name string `json:"name"`
+}
+
+type ecsOrchestrator struct {
+	Type      string      `json:"type"`
+	Namespace string      `json:"namespace,omitempty"`
+	Resource  ecsResource `json:"resource"`
+}
+
+type ecsResource struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+	ID   string `json:"id,omitempty"`
+}
+
+type ecsAuditd struct {
+	Sequence          int             `json:"sequence"`
+	Arch              string          `json:"arch,omitempty"`
+	Syscall           string          `json:"syscall,omitempty"`
+	Messages          []*AuditMessage `json:"messages"`
+	EnrichmentTimeout bool            `json:"enrichment_timeout,omitempty"`
+}
+
+// Syscalls where the address in SOCKADDR is where the connection came from, for everything else it is where it goes
+var ecsSourceSyscalls = map[string]bool{
+	"bind": true, "listen": true, "accept": true, "accept4": true, "recvfrom": true, "recvmsg": true, "recvmmsg": true,
+}
+
+// recordNames maps audit record type numbers back to their names
+var recordNames = func() map[uint16]string {
+	names := make(map[uint16]string, len(recordTypes))
+	for name, t := range recordTypes {
+		names[t] = name
+	}
+	return names
+}()
+
+// newECSDocument maps a message group to the Elastic Common Schema
+func newECSDocument(msg *AuditMessageGroup) *ecsDocument {
+	g := newFilterGroup(msg)
+	doc := &ecsDocument{
+		Timestamp: time.Now().UTC().Format(SYSLOG_TIMESTAMP),
+		ECS:       ecsVersion{Version: ECS_VERSION},
+		Event: ecsEvent{
+			Kind:     "event",
+			Module:   "auditd",
+			Action:   ecsAction(msg),
+			Outcome:  ecsOutcome(g),
+			Sequence: msg.Seq,
+		},
+		Auditd: ecsAuditd{
+			Sequence:          msg.Seq,
+			Arch:              msg.Arch,
+			Syscall:           msg.Syscall,
+			Messages:          msg.Msgs,
+			EnrichmentTimeout: msg.EnrichmentTimeout,
+		},
+	}
+
+	if t, ok := parseAuditTime(msg.AuditTime); ok {
+		doc.Timestamp = t.UTC().Format(SYSLOG_TIMESTAMP)
+	}
+
+	doc.Process = ecsProcessOf(msg, g)
+	doc.User = ecsUserOf(msg, g)
+	doc.File = ecsFileOf(msg, g)
+
+	if s := ecsSockaddr(msg); s != nil {
+		if ecsSourceSyscalls[msg.SyscallName] {
+			doc.Source = s
+		} else {
+			doc.Destination = s
+		}
+	}
+
+	doc.Container, doc.Orchestrator = ecsContainerOf(msg)
+
+	if msg.SyscallName == "execve" || msg.SyscallName == "execveat" {
+		doc.Event.Category = append(doc.Event.Category, "process")
+	}
+
+	if doc.File != nil {
+		doc.Event.Category = append(doc.Event.Category, "file")
+	}
+
+	if doc.Source != nil || doc.Destination != nil {
+		doc.Event.Category = append(doc.Event.Category, "network")
+	}
+
+	return doc
+}
+
+// ecsField returns the first value of key in the records that describe the process, PATH records describe files
+func ecsField(g *filterGroup, key string) string {
+	for i, msg := range g.group.Msgs {
+		if msg.Type == 1302 {
+			continue
+		}
+
+		if v, ok := g.fields[i][key]; ok && v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// ecsRecordField returns the value of key in the first record of the type
+func ecsRecordField(g *filterGroup, msgType uint16, key string) string {
+	for i, msg := range g.group.Msgs {
+		if msg.Type == msgType {
+			return g.fields[i][key]
+		}
+	}
+
+	return ""
+}
+
+// ecsAction is the syscall name, or the name of the first record for events without a syscall
+func ecsAction(msg *AuditMessageGroup) string {
+	if msg.SyscallName != "" {
+		return msg.SyscallName
+	}
+
+	if msg.Syscall != "" {
+		return msg.Syscall
+	}
+
+	if len(msg.Msgs) == 0 {
+		return "unknown"
+	}
+
+	if name, ok := recordNames[msg.Msgs[0].Type]; ok {
+		return strings.Replace(strings.ToLower(name), "_", "-", -1)
+	}
+
+	return strconv.Itoa(int(msg.Msgs[0].Type))
+}
+
+// ecsOutcome uses `success` of syscalls and `res` of user space events
+func ecsOutcome(g *filterGroup) string {
+	switch ecsField(g, "success") {
+	case "yes":
+		return "success"
+	case "no":
+		return "failure"
+	}
+
+	switch ecsField(g, "res") {
+	case "success", "1":
+		return "success"
+	case "failed", "0":
+		return "failure"
+	}
+
+	return "unknown"
+}
+
+func ecsProcessOf(msg *AuditMessageGroup, g *filterGroup) *ecsProcess {
+	p := &ecsProcess{
+		Name:             ecsField(g, "comm"),
+		Executable:       ecsField(g, "exe"),
+		Args:             msg.Argv,
+		ArgsCount:        len(msg.Argv),
+		CommandLine:      msg.Proctitle,
+		WorkingDirectory: ecsRecordField(g, 1307, "cwd"),
+	}
+
+	p.Pid, _ = strconv.Atoi(ecsField(g, "pid"))
+	if ppid, _ := strconv.Atoi(ecsField(g, "ppid")); ppid > 0 {
+		p.Parent = &ecsProcess{Pid: ppid}
+	}
+
+	if p.CommandLine == "" {
+		p.CommandLine = strings.Join(msg.Argv, " ")
+	}
+
+	if p.Pid == 0 && p.Name == "" && p.Executable == "" {
+		return nil
+	}
+
+	return p
+}
+
+func ecsUserOf(msg *AuditMessageGroup, g *filterGroup) *ecsUser {
+	ref := func(uidKey, gidKey string) *ecsUser {
+		uid := ecsField(g, uidKey)
+		if uid == "" {
+			return nil
+		}
+
+		u := &ecsUser{ID: uid, Name: ecsUsername(msg, uid)}
+		if gid := ecsField(g, gidKey); gid != "" {
+			u.Group = &ecsGroup{ID: gid}
+		}
+
+		return u
+	}
+
+	u := ref("uid", "gid")
+	if u == nil {
+		return nil
+	}
+
+	if e := ref("euid", "egid"); e != nil && (e.ID != u.ID || (e.Group != nil && u.Group != nil && e.Group.ID != u.Group.ID)) {
+		u.Effective = e
+	}
+
+	// An unset login uid is -1
+	if a := ref("auid", ""); a != nil && a.ID != "4294967295" {
+		u.Audit = a
+	}
+
+	return u
+}
+
+func ecsUsername(msg *AuditMessageGroup, uid string) string {
+	if name := msg.UidMap[uid]; name != "UNKNOWN_USER" {
+		return name
+	}
+
+	return ""
+}
+
+// ecsFileOf describes the last file that is not the parent directory of another
+func ecsFileOf(msg *AuditMessageGroup, g *filterGroup) *ecsFile {
+	var fields map[string]string
+	for i, m := range msg.Msgs {
+		if m.Type == 1302 && g.fields[i]["name"] != "" && g.fields[i]["nametype"] != "PARENT" {
+			fields = g.fields[i]
+		}
+	}
+
+	if fields == nil {
+		return nil
+	}
+
+	name := fields["name"]
+	if cwd := ecsRecordField(g, 1307, "cwd"); !path.IsAbs(name) && cwd != "" {
+		name = path.Join(cwd, name)
+	}
+
+	f := &ecsFile{
+		Path:      name,
+		Name:      path.Base(name),
+		Directory: path.Dir(name),
+		Inode:     fields["inode"],
+		Device:    fields["dev"],
+		UID:       fields["ouid"],
+		GID:       fields["ogid"],
+	}
+
+	if f.UID != "" {
+		f.Owner = ecsUsername(msg, f.UID)
+	}
+
+	if mode, err := strconv.ParseUint(fields["mode"], 8, 32); err == nil {
+		f.Mode = fmt.Sprintf("%04o", mode&07777)
+
+		switch mode & 0170000 {
+		case 0100000:
+			f.Type = "file"
+		case 0040000:
+			f.Type = "dir"
+		case 0120000:
+			f.Type = "symlink"
+		}
+	}
+
+	return f
+}
+
+func ecsSockaddr(msg *AuditMessageGroup) *ecsEndpoint {
+	for _, m := range msg.Msgs {
+		s := m.Sockaddr
+		if s == nil {
+			continue
+		}
+
+		switch s.Family {
+		case "inet", "inet6":
+			return &ecsEndpoint{Address: s.Address, IP: s.Address, Port: s.Port}
+		case "unix":
+			return &ecsEndpoint{Address: s.Path}
+		}
+	}
+
+	return nil
+}
+
+// ecsContainerOf maps the containers found by the containers extra parser
+func ecsContainerOf(msg *AuditMessageGroup) (*ecsContainer, *ecsOrchestrator) {
+	for _, m := range msg.Msgs {
+		c := m.Containers
+		if c["id"] == "" {
+			continue
+		}
+
+		container := &ecsContainer{ID: c["id"], Name: c["name"]}
+		if c["image"] != "" {
+			container.Image = &ecsImage{Name: c["image"]}
+		}
+
+		if c["pod_name"] == "" && c["pod_uid"] == "" {
+			return container, nil
+		}
+
+		return container, &ecsOrchestrator{
+			Type:      "kubernetes",
+			Namespace: c["pod_namespace"],
+			Resource:  ecsResource{Type: "pod", Name: c["pod_name"], ID: c["pod_uid"]},
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewECSDocument_Execve(t *testing.T) {
+	g := makeGroup(t,
+		`type=SYSCALL msg=audit(1500000000.123:7): arch=c000003e syscall=59 success=yes exit=0 ppid=100 pid=200 auid=1000 uid=1000 gid=1000 euid=0 egid=0 tty=pts0 comm="sudo" exe="/usr/bin/sudo"`,
+		`type=EXECVE msg=audit(1500000000.123:7): argc=3 a0="sudo" a1="ls" a2="/root"`,
+		`type=CWD msg=audit(1500000000.123:7): cwd="/home/alice"`,
+		`type=PATH msg=audit(1500000000.123:7): item=0 name="/usr/bin/sudo" inode=42 dev=fd:01 mode=0104755 ouid=0 ogid=0 nametype=NORMAL`,
+		`type=PATH msg=audit(1500000000.123:7): item=1 name="/lib64/ld-linux-x86-64.so.2" inode=43 dev=fd:01 mode=0100755 ouid=0 ogid=0 nametype=NORMAL`,
+	)
+	g.UidMap = map[string]string{"0": "root", "1000": "alice"}
+	g.Msgs[0].Containers = map[string]string{
+		"id":            "abc123",
+		"image":         "busybox:latest",
+		"name":          "app",
+		"pod_uid":       "0d2f",
+		"pod_name":      "app-1",
+		"pod_namespace": "default",
+	}
+
+	doc := newECSDocument(g)
+	assert.Equal(t, "2017-07-14T02:40:00.123Z", doc.Timestamp)
+	assert.Equal(t, ECS_VERSION, doc.ECS.Version)
+	assert.Equal(t, ecsEvent{Kind: "event", Module: "auditd", Category: []string{"process", "file"}, Action: "execve", Outcome: "success", Sequence: 7}, doc.Event)
+
+	assert.Equal(t, &ecsProcess{
+		Pid:              200,
+		Parent:           &ecsProcess{Pid: 100},
+		Name:             "sudo",
+		Executable:       "/usr/bin/sudo",
+		Args:             []string{"sudo", "ls", "/root"},
+		ArgsCount:        3,
+		CommandLine:      "sudo ls /root",
+		WorkingDirectory: "/home/alice",
+	}, doc.Process)
+
+	assert.Equal(t, &ecsUser{
+		ID:        "1000",
+		Name:      "alice",
+		Group:     &ecsGroup{ID: "1000"},
+		Effective: &ecsUser{ID: "0", Name: "root", Group: &ecsGroup{ID: "0"}},
+		Audit:     &ecsUser{ID: "1000", Name: "alice"},
+	}, doc.User)
+
+	// The last file wins, it is what was actually loaded
+	assert.Equal(t, &ecsFile{
+		Path:      "/lib64/ld-linux-x86-64.so.2",
+		Name:      "ld-linux-x86-64.so.2",
+		Directory: "/lib64",
+		Type:      "file",
+		Inode:     "43",
+		Device:    "fd:01",
+		Mode:      "0755",
+		UID:       "0",
+		GID:       "0",
+		Owner:     "root",
+	}, doc.File)
+
+	assert.Nil(t, doc.Source)
+	assert.Nil(t, doc.Destination)
+
+	assert.Equal(t, &ecsContainer{ID: "abc123", Name: "app", Image: &ecsImage{Name: "busybox:latest"}}, doc.Container)
+	assert.Equal(t, &ecsOrchestrator{
+		Type:      "kubernetes",
+		Namespace: "default",
+		Resource:  ecsResource{Type: "pod", Name: "app-1", ID: "0d2f"},
+	}, doc.Orchestrator)
+
+	assert.Equal(t, 7, doc.Auditd.Sequence)
+	assert.Equal(t, g.Msgs, doc.Auditd.Messages)
+}
+
+func TestNewECSDocument_Network(t *testing.T) {
+	// connect goes somewhere
+	g := makeGroup(t,
+		`type=SYSCALL msg=audit(1500000000.000:1): arch=c000003e syscall=42 success=no exit=-115 pid=5 uid=0 auid=4294967295 comm="curl" exe="/usr/bin/curl"`,
+		`type=SOCKADDR msg=audit(1500000000.000:1): saddr=020001BB0A0102030000000000000000`,
+	)
+
+	doc := newECSDocument(g)
+	assert.Equal(t, "connect", doc.Event.Action)
+	assert.Equal(t, "failure", doc.Event.Outcome)
+	assert.Equal(t, []string{"network"}, doc.Event.Category)
+	assert.Nil(t, doc.Source)
+	assert.Equal(t, &ecsEndpoint{Address: "10.1.2.3", IP: "10.1.2.3", Port: 443}, doc.Destination)
+
+	// An unset login uid is left out
+	assert.Equal(t, "0", doc.User.ID)
+	assert.Nil(t, doc.User.Audit)
+	assert.Nil(t, doc.User.Effective)
+	assert.Nil(t, doc.File)
+	assert.Nil(t, doc.Container)
+	assert.Nil(t, doc.Orchestrator)
+
+	// bind is where connections come to
+	g = makeGroup(t,
+		`type=SYSCALL msg=audit(1500000000.000:2): arch=c000003e syscall=49 success=yes exit=0 pid=5 uid=0 comm="nc" exe="/usr/bin/nc"`,
+		`type=SOCKADDR msg=audit(1500000000.000:2): saddr=01002F746D702F736F636B00`,
+	)
+
+	doc = newECSDocument(g)
+	assert.Equal(t, "bind", doc.Event.Action)
+	assert.Equal(t, &ecsEndpoint{Address: "/tmp/sock"}, doc.Source)
+	assert.Nil(t, doc.Destination)
+}
+
+func TestNewECSDocument_UserSpace(t *testing.T) {
+	g := makeGroup(t,
+		`type=USER_LOGIN msg=audit(1500000000.000:3): pid=9 uid=0 auid=4294967295 msg='op=login acct="bob" exe="/usr/sbin/sshd" hostname=? addr=10.0.0.1 terminal=ssh res=failed'`,
+	)
+
+	doc := newECSDocument(g)
+	assert.Equal(t, "user-login", doc.Event.Action)
+	assert.Equal(t, "failure", doc.Event.Outcome)
+	assert.Empty(t, doc.Event.Category)
+	assert.Equal(t, 9, doc.Process.Pid)
+	assert.Equal(t, "/usr/sbin/sshd", doc.Process.Executable)
+
+	// Nothing to go on
+	doc = newECSDocument(NewAuditMessageGroup(&AuditMessage{Type: 1, Seq: 4, AuditTime: "nope", Data: "what"}))
+	assert.Equal(t, "1", doc.Event.Action)
+	assert.Equal(t, "unknown", doc.Event.Outcome)
+	assert.NotEmpty(t, doc.Timestamp)
+	assert.Nil(t, doc.Process)
+	assert.Nil(t, doc.User)
+}
+
+func Test_addOutput_Encoding(t *testing.T) {
+	writers := NewMultiAuditWriter()
+	defer writers.Close()
+
+	// json is the default
+	buf := &bytes.Buffer{}
+	w := NewAuditWriter(buf, 1)
+	assert.Nil(t, addOutput(viper.New(), writers, "test", w))
+	assert.Nil(t, w.encode)
+
+	c := viper.New()
+	c.Set("output.test.encoding", "ecs")
+	w = NewAuditWriter(buf, 1)
+	assert.Nil(t, addOutput(c, writers, "test", w))
+
+	msg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 1, AuditTime: "1500000000.000", Data: "syscall=59 success=yes"})
+	assert.Nil(t, w.Write(msg))
+
+	var doc map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &doc))
+	assert.Equal(t, "2017-07-14T02:40:00.000Z", doc["@timestamp"])
+	assert.Equal(t, map[string]interface{}{"version": ECS_VERSION}, doc["ecs"])
+
+	c.Set("output.test.encoding", "xml")
+	assert.EqualError(t, addOutput(c, writers, "test", NewAuditWriter(buf, 1)), "Unknown encoding `xml` for output test, must be `json` or `ecs`")
+}
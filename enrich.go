@@ -0,0 +1,176 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ENRICHMENT_WORKERS    = 4               // Default number of message groups enriched at the same time
+	ENRICHMENT_QUEUE_SIZE = 1024            // Default number of message groups that can wait on enrichment
+	ENRICHMENT_TIMEOUT    = time.Second * 1 // Default time a message group waits on enrichment before it goes out without it
+)
+
+// Enricher runs the extra parsers, which can be slow, on completed message groups in a pool of workers so they never
+// hold up reading from netlink. Message groups go out in the order they came in. A message group that is not enriched
+// before the timeout goes out without it and is marked with EnrichmentTimeout
+type Enricher struct {
+	writer  GroupWriter
+	timeout time.Duration
+	parsers atomic.Pointer[ExtraParsers]
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *enrichJob // Every message group, in order
+	jobs   chan *enrichJob // Message groups waiting on a worker
+	done   chan struct{}   // Closed once everything in queue went out
+}
+
+type enrichJob struct {
+	msg      *AuditMessageGroup
+	enriched []*AuditMessage // Copies of msg.Msgs the parsers work on, so a late worker can't race the writer
+	deadline time.Time
+	done     chan struct{}
+}
+
+func NewEnricher(w GroupWriter, parsers ExtraParsers, workers int, queueSize int, timeout time.Duration) *Enricher {
+	if workers < 1 {
+		workers = ENRICHMENT_WORKERS
+	}
+
+	if queueSize < 1 {
+		queueSize = ENRICHMENT_QUEUE_SIZE
+	}
+
+	if timeout <= 0 {
+		timeout = ENRICHMENT_TIMEOUT
+	}
+
+	e := &Enricher{
+		writer:  w,
+		timeout: timeout,
+		queue:   make(chan *enrichJob, queueSize),
+		jobs:    make(chan *enrichJob, queueSize),
+		done:    make(chan struct{}),
+	}
+	e.SetParsers(parsers)
+
+	for i := 0; i < workers; i++ {
+		go e.work()
+	}
+
+	go e.emit()
+	return e
+}
+
+// SetParsers swaps in new extra parsers, message groups that are already being enriched keep the old ones
+func (e *Enricher) SetParsers(parsers ExtraParsers) {
+	e.parsers.Store(&parsers)
+}
+
+// Write queues the message group for enrichment. It only blocks if the queue is full, which lasts no longer than the
+// timeout
+func (e *Enricher) Write(msg *AuditMessageGroup) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return e.writer.Write(msg)
+	}
+
+	job := &enrichJob{
+		msg:      msg,
+		deadline: time.Now().Add(e.timeout),
+		done:     make(chan struct{}),
+	}
+
+	parsers := *e.parsers.Load()
+	if len(parsers) == 0 {
+		// Nothing to do, it still has to wait its turn
+		close(job.done)
+	} else {
+		select {
+		case e.jobs <- job:
+		default:
+			// The workers are this far behind, it would time out anyway
+			job.deadline = time.Now()
+		}
+	}
+
+	e.queue <- job
+	return nil
+}
+
+// Close waits for every queued message group to go out, anything written afterwards goes straight to the writer
+func (e *Enricher) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+
+	e.closed = true
+	close(e.queue)
+	close(e.jobs)
+	e.mu.Unlock()
+
+	<-e.done
+}
+
+func (e *Enricher) work() {
+	for job := range e.jobs {
+		if time.Now().After(job.deadline) {
+			// Already went out without us
+			continue
+		}
+
+		parsers := *e.parsers.Load()
+		enriched := make([]*AuditMessage, len(job.msg.Msgs))
+		for i, am := range job.msg.Msgs {
+			cp := *am
+			parsers.Parse(&cp)
+			enriched[i] = &cp
+		}
+
+		job.enriched = enriched
+		close(job.done)
+	}
+}
+
+func (e *Enricher) emit() {
+	defer close(e.done)
+
+	timer := time.NewTimer(e.timeout)
+	defer timer.Stop()
+
+	for job := range e.queue {
+		timer.Reset(time.Until(job.deadline))
+
+		enriched := false
+		select {
+		case <-job.done:
+			enriched = true
+		case <-timer.C:
+			// Waiting on an earlier group can use up this one's time too, don't throw away finished work
+			select {
+			case <-job.done:
+				enriched = true
+			default:
+			}
+		}
+
+		if enriched {
+			for i, am := range job.enriched {
+				*job.msg.Msgs[i] = *am
+			}
+		} else {
+			job.msg.EnrichmentTimeout = true
+			metricEnrichmentTimeouts.Inc()
+		}
+
+		if err := e.writer.Write(job.msg); err != nil {
+			el.Printf("Failed to write message group %d. Error: %s\n", job.msg.Seq, err)
+		}
+	}
+}
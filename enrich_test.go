@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnricher_Write(t *testing.T) {
+	w := &lockedRecorder{}
+	p := &slowParser{delays: map[string]time.Duration{"2": time.Millisecond * 100}}
+	e := NewEnricher(w, ExtraParsers{p}, 4, 10, time.Second)
+
+	for i := 1; i <= 5; i++ {
+		assert.Nil(t, e.Write(NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: i, Data: strconv.Itoa(i)})))
+	}
+	e.Close()
+
+	// A slow group holds the ones behind it back so the order is kept
+	if assert.Len(t, w.groups, 5) {
+		for i, g := range w.groups {
+			assert.Equal(t, i+1, g.Seq)
+			assert.False(t, g.EnrichmentTimeout)
+			assert.Equal(t, map[string]string{"id": g.Msgs[0].Data}, g.Msgs[0].Containers)
+		}
+	}
+
+	// Written after close goes straight through
+	assert.Nil(t, e.Write(NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 6, Data: "6"})))
+	assert.Len(t, w.groups, 6)
+}
+
+func TestEnricher_Timeout(t *testing.T) {
+	w := &lockedRecorder{}
+	p := &slowParser{delays: map[string]time.Duration{"1": time.Millisecond * 200}}
+	e := NewEnricher(w, ExtraParsers{p}, 2, 10, time.Millisecond*50)
+
+	start := time.Now()
+	for i := 1; i <= 2; i++ {
+		assert.Nil(t, e.Write(NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: i, Data: strconv.Itoa(i)})))
+	}
+	e.Close()
+
+	// The slow group goes out on time with the marker and without half finished enrichment
+	assert.True(t, time.Since(start) < time.Millisecond*200, "Should not have waited on the slow parser")
+	if assert.Len(t, w.groups, 2) {
+		assert.True(t, w.groups[0].EnrichmentTimeout)
+		assert.Nil(t, w.groups[0].Msgs[0].Containers)
+		assert.False(t, w.groups[1].EnrichmentTimeout)
+		assert.Equal(t, map[string]string{"id": "2"}, w.groups[1].Msgs[0].Containers)
+	}
+}
+
+func TestEnricher_SetParsers(t *testing.T) {
+	w := &lockedRecorder{}
+	e := NewEnricher(w, nil, 1, 10, time.Second)
+
+	assert.Nil(t, e.Write(NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 1, Data: "1"})))
+	e.SetParsers(ExtraParsers{&slowParser{}})
+	assert.Nil(t, e.Write(NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 2, Data: "2"})))
+	e.Close()
+
+	if assert.Len(t, w.groups, 2) {
+		assert.Nil(t, w.groups[0].Msgs[0].Containers)
+		assert.Equal(t, map[string]string{"id": "2"}, w.groups[1].Msgs[0].Containers)
+	}
+}
+
+// slowParser sets the container id to the message data, after a delay for some messages
+type slowParser struct {
+	delays map[string]time.Duration
+}
+
+func (p *slowParser) Parse(am *AuditMessage) {
+	time.Sleep(p.delays[am.Data])
+	am.Containers = map[string]string{"id": am.Data}
+}
+
+// lockedRecorder is a groupRecorder that can be written to from another goroutine
+type lockedRecorder struct {
+	mu     sync.Mutex
+	groups []*AuditMessageGroup
+}
+
+func (r *lockedRecorder) Write(msg *AuditMessageGroup) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.groups = append(r.groups, msg)
+	return nil
+}
@@ -1,6 +1,10 @@
 package main
 
-import "github.com/spf13/viper"
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
 
 var extraParserConstructors = []func(config *viper.Viper) (ExtraParser, error){}
 
@@ -14,18 +18,18 @@ func RegisterExtraParser(constructor func(config *viper.Viper) (ExtraParser, err
 	extraParserConstructors = append(extraParserConstructors, constructor)
 }
 
-func createExtraParsers(config *viper.Viper) ExtraParsers {
+func createExtraParsers(config *viper.Viper) (ExtraParsers, error) {
 	var extraParsers ExtraParsers
 	for _, constructor := range extraParserConstructors {
 		cp, err := constructor(config)
 		if err != nil {
-			el.Fatalf("Failed to create ExtraParser: %v", err)
+			return nil, fmt.Errorf("Failed to create ExtraParser: %v", err)
 		}
 		if cp != nil {
 			extraParsers = append(extraParsers, cp)
 		}
 	}
-	return extraParsers
+	return extraParsers, nil
 }
 
 func (ps ExtraParsers) Parse(am *AuditMessage) {
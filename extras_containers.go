@@ -5,6 +5,8 @@ package main
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	containerdclient "github.com/containerd/containerd/v2/client"
 	"github.com/containerd/containerd/v2/core/containers"
@@ -33,9 +35,13 @@ func init() {
 	})
 }
 
+// CONTAINER_LOOKUP_TIMEOUT is the default for how long a single docker or containerd API call can take
+const CONTAINER_LOOKUP_TIMEOUT = time.Millisecond * 500
+
 type ContainerParser struct {
 	docker     *dockerclient.Client
 	containerd *containerdclient.Client
+	timeout    time.Duration
 
 	// map[int]string
 	//	(pid -> containerID)
@@ -58,18 +64,36 @@ type NoCache struct{}
 func (NoCache) Add(lru.Key, interface{})        {}
 func (NoCache) Get(lru.Key) (interface{}, bool) { return nil, false }
 
-// NewCache returns an lru.Cache if size is >0, NoCache otherwise
+// lockedCache makes an lru.Cache safe to use from the enrichment workers
+type lockedCache struct {
+	mu sync.Mutex
+	c  *lru.Cache
+}
+
+func (lc *lockedCache) Add(key lru.Key, value interface{}) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.c.Add(key, value)
+}
+
+func (lc *lockedCache) Get(key lru.Key) (interface{}, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.c.Get(key)
+}
+
+// NewCache returns a locked lru.Cache if size is >0, NoCache otherwise
 func NewCache(size int) Cache {
 	if size > 0 {
-		return lru.New(size)
+		return &lockedCache{c: lru.New(size)}
 	}
 	return NoCache{}
 }
 
 func cacheSize(c Cache) int {
 	switch x := c.(type) {
-	case *lru.Cache:
-		return x.MaxEntries
+	case *lockedCache:
+		return x.c.MaxEntries
 	}
 	return 0
 }
@@ -106,9 +130,15 @@ func NewContainerParser(config *viper.Viper) (*ContainerParser, error) {
 		}
 	}
 
+	timeout := config.GetDuration("timeout")
+	if timeout <= 0 {
+		timeout = CONTAINER_LOOKUP_TIMEOUT
+	}
+
 	return &ContainerParser{
 		docker:          docker,
 		containerd:      containerdClient,
+		timeout:         timeout,
 		pidCache:        NewCache(config.GetInt("pid_cache")),
 		dockerCache:     NewCache(config.GetInt("docker_cache")),
 		containerdCache: NewCache(config.GetInt("containerd_cache")),
@@ -199,7 +229,10 @@ func (c ContainerParser) getDockerContainer(containerID string) (*dockercontaine
 		return v.(*dockercontainer.InspectResponse), nil
 	}
 
-	containerInspectResult, err := c.docker.ContainerInspect(context.TODO(), containerID, dockerclient.ContainerInspectOptions{})
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	containerInspectResult, err := c.docker.ContainerInspect(ctx, containerID, dockerclient.ContainerInspectOptions{})
 	container := containerInspectResult.Container
 	if err == nil {
 		c.dockerCache.Add(containerID, &container)
@@ -212,12 +245,15 @@ func (c ContainerParser) getContainerdContainer(containerID string) (*containers
 		return v.(*containers.Container), nil
 	}
 
-	container, err := c.containerd.LoadContainer(context.TODO(), containerID)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	container, err := c.containerd.LoadContainer(ctx, containerID)
 	if err != nil {
 		return nil, err
 	}
 
-	info, err := container.Info(context.TODO())
+	info, err := container.Info(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// Fields the kernel hex encodes when their value contains spaces, quotes or control characters
+var encodedFields = map[string]bool{
+	"acct":      true,
+	"cmd":       true,
+	"comm":      true,
+	"cwd":       true,
+	"data":      true,
+	"dir":       true,
+	"exe":       true,
+	"file":      true,
+	"key":       true,
+	"name":      true,
+	"new":       true,
+	"ocomm":     true,
+	"old":       true,
+	"path":      true,
+	"proctitle": true,
+	"root_dir":  true,
+	"watch":     true,
+}
+
+// eachField walks the key=value pairs in audit record data in order. Values are unquoted but not decoded, quoted is
+// true if the value was wrapped in double or single quotes. Anything that isn't a key=value pair is skipped
+func eachField(data string, fn func(key, value string, quoted bool)) {
+	for i := 0; i < len(data); {
+		if data[i] == spaceChar {
+			i++
+			continue
+		}
+
+		// Find the end of the key, a space first means this token isn't a key=value pair
+		eq := i
+		for eq < len(data) && data[eq] != '=' && data[eq] != spaceChar {
+			eq++
+		}
+
+		if eq == len(data) || data[eq] == spaceChar {
+			i = eq
+			continue
+		}
+
+		key := data[i:eq]
+		i = eq + 1
+
+		if i < len(data) && (data[i] == '"' || data[i] == '\'') {
+			quote := data[i]
+			end := strings.IndexByte(data[i+1:], quote)
+			if end < 0 {
+				// Unterminated, take the rest of the line
+				end = len(data) - i - 1
+			}
+
+			fn(key, data[i+1:i+1+end], true)
+			i += end + 2
+			continue
+		}
+
+		end := strings.IndexByte(data[i:], spaceChar)
+		if end < 0 {
+			end = len(data) - i
+		}
+
+		fn(key, data[i:i+end], false)
+		i += end
+	}
+}
+
+// parseFields turns audit record data into a map of field names to decoded values.
+// Hex encoded values are decoded, `(null)` becomes an empty string and the key=value pairs inside a quoted `msg`,
+// as found in USER_* records, are added alongside the outer fields without replacing them
+func parseFields(msgType uint16, data string) map[string]string {
+	fields := make(map[string]string, 16)
+	var nested string
+
+	eachField(data, func(key, value string, quoted bool) {
+		if key == "msg" && quoted && strings.IndexByte(value, '=') > 0 {
+			nested = value
+			return
+		}
+
+		fields[key] = decodeFieldValue(msgType, key, value, quoted)
+	})
+
+	if nested != "" {
+		eachField(nested, func(key, value string, quoted bool) {
+			if _, ok := fields[key]; !ok {
+				fields[key] = decodeFieldValue(msgType, key, value, quoted)
+			}
+		})
+	}
+
+	return fields
+}
+
+func decodeFieldValue(msgType uint16, key, value string, quoted bool) string {
+	if quoted {
+		return value
+	}
+
+	if value == "(null)" {
+		return ""
+	}
+
+	if !encodedFields[key] && !(msgType == 1309 && isExecveArg(key)) {
+		return value
+	}
+
+	if !isHexEncoded(value) {
+		return value
+	}
+
+	b, err := hex.DecodeString(value)
+	if err != nil {
+		return value
+	}
+
+	// The process title uses NUL to separate arguments, like ausearch -i we show them as spaces
+	if key == "proctitle" {
+		return strings.TrimRight(strings.Replace(string(b), "\x00", " ", -1), " ")
+	}
+
+	return string(b)
+}
+
+// isExecveArg matches the argument fields of EXECVE records, `a0` and the `a0[0]` chunks of long arguments
+func isExecveArg(key string) bool {
+	_, _, ok := parseExecveArgKey(key)
+	return ok
+}
+
+// parseExecveArgKey splits an EXECVE argument field name into the argument index and chunk index.
+// The chunk is -1 for whole arguments like `a1`, chunks of long arguments look like `a1[0]`
+func parseExecveArgKey(key string) (arg int, chunk int, ok bool) {
+	if len(key) < 2 || key[0] != 'a' {
+		return 0, 0, false
+	}
+
+	i := strings.IndexByte(key, '[')
+	if i < 0 {
+		arg, err := strconv.ParseUint(key[1:], 10, 31)
+		return int(arg), -1, err == nil
+	}
+
+	if key[len(key)-1] != ']' {
+		return 0, 0, false
+	}
+
+	a, err := strconv.ParseUint(key[1:i], 10, 31)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	c, err := strconv.ParseUint(key[i+1:len(key)-1], 10, 31)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return int(a), int(c), true
+}
+
+// isHexEncoded checks for the upper case hex the kernel uses when encoding a value
+func isHexEncoded(value string) bool {
+	if len(value) == 0 || len(value)%2 != 0 {
+		return false
+	}
+
+	for _, c := range value {
+		if (c < '0' || c > '9') && (c < 'A' || c > 'F') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseFields(t *testing.T) {
+	// quoted, hex encoded and (null) values
+	fields := parseFields(1300, `arch=c000003e syscall=59 success=yes a0=55d3 comm="ls" exe=2F746D702F6D7920657865 key=(null)`)
+	assert.Equal(t, map[string]string{
+		"arch":    "c000003e",
+		"syscall": "59",
+		"success": "yes",
+		"a0":      "55d3",
+		"comm":    "ls",
+		"exe":     "/tmp/my exe",
+		"key":     "",
+	}, fields)
+
+	// EXECVE arguments are only decoded for EXECVE records
+	fields = parseFields(1309, `argc=3 a0="ls" a1=2D6C2061 a2[0]=4142 a2_len=4`)
+	assert.Equal(t, map[string]string{"argc": "3", "a0": "ls", "a1": "-l a", "a2[0]": "AB", "a2_len": "4"}, fields)
+
+	fields = parseFields(1300, `a1=2D6C`)
+	assert.Equal(t, "2D6C", fields["a1"])
+
+	// process titles separate arguments with NUL
+	fields = parseFields(1327, `proctitle=2F62696E2F7368002D63006C73`)
+	assert.Equal(t, "/bin/sh -c ls", fields["proctitle"])
+
+	// values that look like hex but aren't valid stay as they are
+	fields = parseFields(1302, `name=ABC`)
+	assert.Equal(t, "ABC", fields["name"])
+
+	// nested msg payload of USER_* records
+	fields = parseFields(1112, `pid=1 uid=0 auid=1000 ses=2 msg='op=PAM:session_open acct="root" exe="/usr/bin/sudo" pid=5 hostname=? res=success'`)
+	assert.Equal(t, map[string]string{
+		"pid":      "1",
+		"uid":      "0",
+		"auid":     "1000",
+		"ses":      "2",
+		"op":       "PAM:session_open",
+		"acct":     "root",
+		"exe":      "/usr/bin/sudo",
+		"hostname": "?",
+		"res":      "success",
+	}, fields)
+
+	// msg without any fields is kept as is
+	fields = parseFields(1107, `pid=1 msg='just some text'`)
+	assert.Equal(t, map[string]string{"pid": "1", "msg": "just some text"}, fields)
+
+	// things that aren't key=value pairs are skipped, unterminated quotes take the rest of the line
+	fields = parseFields(1400, `avc:  denied  { read } for  pid=5 comm="a b`)
+	assert.Equal(t, map[string]string{"pid": "5", "comm": "a b"}, fields)
+
+	assert.Empty(t, parseFields(1300, ""))
+}
+
+func Test_eachField(t *testing.T) {
+	var got []string
+	eachField(`a=1  b="2 3" c='4' d= e`, func(key, value string, quoted bool) {
+		if quoted {
+			value = "q:" + value
+		}
+		got = append(got, key+"="+value)
+	})
+
+	assert.Equal(t, []string{"a=1", "b=q:2 3", "c=q:4", "d="}, got)
+}
+
+func TestNewAuditMessage_Fields(t *testing.T) {
+	defer func() { parseMessageFields = false }()
+
+	msg := &syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte(`audit(10000001:99): syscall=59 comm="ls"`),
+	}
+
+	am := NewAuditMessage(msg)
+	assert.Nil(t, am.Fields, "Fields should not be parsed unless enabled")
+
+	parseMessageFields = true
+	msg.Data = []byte(`audit(10000001:99): syscall=59 comm="ls"`)
+	am = NewAuditMessage(msg)
+	assert.Equal(t, `syscall=59 comm="ls"`, am.Data)
+	assert.Equal(t, map[string]string{"syscall": "59", "comm": "ls"}, am.Fields)
+
+	// Messages made elsewhere get parsed when they join a group
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=2"})
+	assert.Equal(t, map[string]string{"syscall": "2"}, amg.Msgs[0].Fields)
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Fields of the whole message group, anything else is looked up in the records
+var groupFields = map[string]func(g *AuditMessageGroup) string{
+	"syscall":      func(g *AuditMessageGroup) string { return g.Syscall },
+	"syscall_name": func(g *AuditMessageGroup) string { return g.SyscallName },
+	"arch":         func(g *AuditMessageGroup) string { return g.Arch },
+	"argv":         func(g *AuditMessageGroup) string { return strings.Join(g.Argv, " ") },
+	"proctitle":    func(g *AuditMessageGroup) string { return g.Proctitle },
+}
+
+// FilterExpression is a boolean expression over the fields of a message group, for example
+//
+//	syscall_name == "execve" && uid == 0 && exe == "/usr/bin/ps" && !tty
+//
+// A field is one of the group fields above, a record field like `uid` that matches in any record, a record field of
+// one record type like `PATH.name` or `1302.name`, or a part of the decoded address like `sockaddr.address`.
+// Comparisons match if any value of the field does, `!=` and `!~` match if none do.
+// A field on its own is true if it has a value other than empty or `(none)`
+type FilterExpression struct {
+	source string
+	root   exprNode
+}
+
+// String returns the expression as it was written
+func (e *FilterExpression) String() string {
+	return e.source
+}
+
+// Match evaluates the expression against a message group
+func (e *FilterExpression) Match(g *filterGroup) bool {
+	return e.root.eval(g)
+}
+
+// filterGroup is a message group with the record fields parsed once for all expressions
+type filterGroup struct {
+	group  *AuditMessageGroup
+	fields []map[string]string
+}
+
+func newFilterGroup(g *AuditMessageGroup) *filterGroup {
+	fg := &filterGroup{group: g, fields: make([]map[string]string, len(g.Msgs))}
+	for i, msg := range g.Msgs {
+		// Don't store what we parse, the fields only show up in the output if message_fields is enabled
+		if msg.Fields != nil {
+			fg.fields[i] = msg.Fields
+		} else {
+			fg.fields[i] = parseFields(msg.Type, msg.Data)
+		}
+	}
+
+	return fg
+}
+
+type fieldRef struct {
+	text     string // As it was written
+	name     string
+	group    func(g *AuditMessageGroup) string
+	sockaddr bool
+	msgType  uint16 // Only look in records of this type, 0 is any
+}
+
+func (f fieldRef) values(g *filterGroup) []string {
+	if f.group != nil {
+		if v := f.group(g.group); v != "" {
+			return []string{v}
+		}
+		return nil
+	}
+
+	var values []string
+	for i, msg := range g.group.Msgs {
+		if f.msgType != 0 && msg.Type != f.msgType {
+			continue
+		}
+
+		if !f.sockaddr {
+			if v, ok := g.fields[i][f.name]; ok {
+				values = append(values, v)
+			}
+			continue
+		}
+
+		if s := msg.Sockaddr; s != nil {
+			switch f.name {
+			case "family":
+				values = append(values, s.Family)
+			case "address":
+				values = append(values, s.Address)
+			case "port":
+				values = append(values, strconv.Itoa(int(s.Port)))
+			case "path":
+				values = append(values, s.Path)
+			}
+		}
+	}
+
+	return values
+}
+
+type exprNode interface {
+	eval(g *filterGroup) bool
+}
+
+type andNode struct{ left, right exprNode }
+type orNode struct{ left, right exprNode }
+type notNode struct{ node exprNode }
+type truthyNode struct{ field fieldRef }
+
+type compareNode struct {
+	field fieldRef
+	op    string
+	value string
+	num   float64
+	isNum bool
+	regex *regexp.Regexp
+}
+
+type inNode struct {
+	field  fieldRef
+	values []*compareNode
+}
+
+type cidrNode struct {
+	field fieldRef
+	nets  []*net.IPNet
+}
+
+func (n *andNode) eval(g *filterGroup) bool { return n.left.eval(g) && n.right.eval(g) }
+func (n *orNode) eval(g *filterGroup) bool  { return n.left.eval(g) || n.right.eval(g) }
+func (n *notNode) eval(g *filterGroup) bool { return !n.node.eval(g) }
+
+func (n *truthyNode) eval(g *filterGroup) bool {
+	for _, v := range n.field.values(g) {
+		if v != "" && v != "(none)" {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *compareNode) eval(g *filterGroup) bool {
+	// The negative operators match when none of the values match the positive one
+	switch n.op {
+	case "!=":
+		return !n.any(g, "==")
+	case "!~":
+		return !n.any(g, "=~")
+	}
+
+	return n.any(g, n.op)
+}
+
+func (n *compareNode) any(g *filterGroup, op string) bool {
+	for _, v := range n.field.values(g) {
+		if n.match(op, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *compareNode) match(op string, v string) bool {
+	if op == "=~" {
+		return n.regex.MatchString(v)
+	}
+
+	if n.isNum {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			switch op {
+			case "==":
+				return f == n.num
+			case "<":
+				return f < n.num
+			case "<=":
+				return f <= n.num
+			case ">":
+				return f > n.num
+			case ">=":
+				return f >= n.num
+			}
+		}
+	}
+
+	if op == "==" {
+		return v == n.value
+	}
+
+	// Ordering only makes sense for numbers
+	return false
+}
+
+func (n *inNode) eval(g *filterGroup) bool {
+	for _, v := range n.field.values(g) {
+		for _, c := range n.values {
+			if c.match("==", v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (n *cidrNode) eval(g *filterGroup) bool {
+	for _, v := range n.field.values(g) {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			continue
+		}
+
+		for _, n := range n.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseFilterExpression compiles an expression, regexes and cidrs included, so it is ready to match
+func parseFilterExpression(source string) (*FilterExpression, error) {
+	tokens, err := lexExpression(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, p.unexpected(t)
+	}
+
+	return &FilterExpression{source: source, root: root}, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value string // Unquoted string literals
+	pos   int
+}
+
+var exprOperators = []string{"&&", "||", "==", "!=", "=~", "!~", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func lexExpression(s string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '"' || c == '\'':
+			end := i + 1
+			var b strings.Builder
+			for end < len(s) && s[end] != c {
+				if s[end] == '\\' && end+1 < len(s) {
+					end++
+				}
+				b.WriteByte(s[end])
+				end++
+			}
+
+			if end == len(s) {
+				return nil, fmt.Errorf("Unterminated string at position %d", i+1)
+			}
+
+			tokens = append(tokens, token{kind: tokenString, text: s[i : end+1], value: b.String(), pos: i + 1})
+			i = end + 1
+
+		case c == '-' || isIdentChar(c):
+			end := i + 1
+			for end < len(s) && (isIdentChar(s[end]) || s[end] == '.' || s[end] == '-') {
+				end++
+			}
+
+			word := s[i:end]
+			if _, err := strconv.ParseFloat(word, 64); err == nil && (c == '-' || c >= '0' && c <= '9') {
+				tokens = append(tokens, token{kind: tokenNumber, text: word, value: word, pos: i + 1})
+			} else if c == '-' {
+				return nil, fmt.Errorf("Invalid number `%s` at position %d", word, i+1)
+			} else {
+				// Field names can start with a digit, like `1302.name`
+				tokens = append(tokens, token{kind: tokenIdent, text: word, pos: i + 1})
+			}
+			i = end
+
+		default:
+			op := ""
+			for _, o := range exprOperators {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+
+			if op == "" {
+				return nil, fmt.Errorf("Unexpected `%c` at position %d", c, i+1)
+			}
+
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: i + 1})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEnd, pos: len(s) + 1}), nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokenOp && t.text == op
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.isOp(op) {
+		return p.unexpected(p.peek())
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) unexpected(t token) error {
+	if t.kind == tokenEnd {
+		return fmt.Errorf("Unexpected end of expression")
+	}
+	return fmt.Errorf("Unexpected `%s` at position %d", t.text, t.pos)
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.isOp("!") {
+		p.next()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.isOp("(") {
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+
+	t := p.next()
+	if t.kind != tokenIdent {
+		return nil, p.unexpected(t)
+	}
+
+	if t.text == "cidr" && p.isOp("(") {
+		return p.parseCidr()
+	}
+
+	field, err := parseFieldToken(t)
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.peek()
+	switch {
+	case op.kind == tokenIdent && op.text == "in":
+		p.next()
+		return p.parseIn(field)
+
+	case op.kind == tokenOp && (op.text == "==" || op.text == "!=" || op.text == "=~" || op.text == "!~" ||
+		op.text == "<" || op.text == "<=" || op.text == ">" || op.text == ">="):
+		p.next()
+		return p.parseCompare(field, op.text)
+	}
+
+	return &truthyNode{field}, nil
+}
+
+func (p *exprParser) parseCompare(field fieldRef, op string) (exprNode, error) {
+	t := p.next()
+	if t.kind != tokenString && t.kind != tokenNumber {
+		return nil, p.unexpected(t)
+	}
+
+	n := newCompareNode(field, op, t)
+
+	switch op {
+	case "=~", "!~":
+		if t.kind != tokenString {
+			return nil, fmt.Errorf("`%s` at position %d needs a string regex", op, t.pos)
+		}
+
+		re, err := regexp.Compile(t.value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regex at position %d. Error: %s", t.pos, err)
+		}
+		n.regex = re
+
+	case "<", "<=", ">", ">=":
+		if !n.isNum {
+			return nil, fmt.Errorf("`%s` at position %d needs a number", op, t.pos)
+		}
+	}
+
+	return n, nil
+}
+
+func newCompareNode(field fieldRef, op string, t token) *compareNode {
+	n := &compareNode{field: field, op: op, value: t.value}
+	if t.kind == tokenNumber {
+		n.num, _ = strconv.ParseFloat(t.value, 64)
+		n.isNum = true
+	}
+	return n
+}
+
+func (p *exprParser) parseIn(field fieldRef) (exprNode, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+
+	n := &inNode{field: field}
+	for {
+		t := p.next()
+		if t.kind != tokenString && t.kind != tokenNumber {
+			return nil, p.unexpected(t)
+		}
+		n.values = append(n.values, newCompareNode(field, "==", t))
+
+		if p.isOp(",") {
+			p.next()
+			continue
+		}
+
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+}
+
+// cidr(field, "10.0.0.0/8", ...) is true if any value of the field is an address in any of the networks
+func (p *exprParser) parseCidr() (exprNode, error) {
+	p.next()
+
+	t := p.next()
+	if t.kind != tokenIdent {
+		return nil, p.unexpected(t)
+	}
+
+	field, err := parseFieldToken(t)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &cidrNode{field: field}
+	for p.isOp(",") {
+		p.next()
+
+		t := p.next()
+		if t.kind != tokenString {
+			return nil, p.unexpected(t)
+		}
+
+		_, ipNet, err := net.ParseCIDR(t.value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cidr at position %d. Error: %s", t.pos, err)
+		}
+		n.nets = append(n.nets, ipNet)
+	}
+
+	if len(n.nets) == 0 {
+		return nil, fmt.Errorf("cidr at position %d needs at least one network", t.pos)
+	}
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func parseFieldToken(t token) (fieldRef, error) {
+	f, err := parseFieldRef(t.text)
+	if err != nil {
+		return fieldRef{}, fmt.Errorf("%s at position %d", err, t.pos)
+	}
+
+	return f, nil
+}
+
+// parseFieldRef turns a field name like `uid`, `PATH.name` or `sockaddr.address` into a reference to its values
+func parseFieldRef(text string) (fieldRef, error) {
+	for i := 0; i < len(text); i++ {
+		if !isIdentChar(text[i]) && text[i] != '.' && text[i] != '-' {
+			return fieldRef{}, fmt.Errorf("Invalid field name `%s`", text)
+		}
+	}
+
+	dot := strings.IndexByte(text, '.')
+	if dot < 0 {
+		return fieldRef{text: text, name: text, group: groupFields[text]}, nil
+	}
+
+	prefix, name := text[:dot], text[dot+1:]
+	if name == "" {
+		return fieldRef{}, fmt.Errorf("Missing field name after `%s.`", prefix)
+	}
+
+	if prefix == "sockaddr" {
+		switch name {
+		case "family", "address", "port", "path":
+			return fieldRef{text: text, name: name, sockaddr: true}, nil
+		}
+		return fieldRef{}, fmt.Errorf("Unknown sockaddr field `%s`", name)
+	}
+
+	msgType, err := parseRecordType(prefix)
+	if err != nil {
+		return fieldRef{}, err
+	}
+
+	return fieldRef{text: text, name: name, msgType: msgType}, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterExpression_Match(t *testing.T) {
+	g := newFilterGroup(makeGroup(t,
+		`type=SYSCALL msg=audit(1500000000.000:1): arch=c000003e syscall=42 success=no exit=-115 uid=0 auid=4294967295 tty=(none) comm="curl" exe="/usr/bin/curl"`,
+		`type=SOCKADDR msg=audit(1500000000.000:1): saddr=020001BB0A0102030000000000000000`,
+		`type=PATH msg=audit(1500000000.000:1): item=0 name="/etc/hosts"`,
+		`type=PATH msg=audit(1500000000.000:1): item=1 name=2F746D702F6120622063`,
+	))
+
+	tests := []struct {
+		expression string
+		match      bool
+	}{
+		// Group fields
+		{`syscall_name == "connect"`, true},
+		{`syscall == 42`, true},
+		{`arch == "x86_64"`, true},
+		{`SYSCALL.arch == "c000003e"`, true},
+
+		// Numbers and strings
+		{`uid == 0`, true},
+		{`uid == "0"`, true},
+		{`uid != 0`, false},
+		{`auid >= 1000`, true},
+		{`exit < 0`, true},
+		{`exit <= -115`, true},
+		{`exit > -115`, false},
+		{`comm > 1`, false},
+		{`exe == "/usr/bin/curl"`, true},
+		{`exe == '/usr/bin/curl'`, true},
+		{`exe == "/usr/bin/wget"`, false},
+		{`missing == ""`, false},
+		{`missing != ""`, true},
+
+		// Truthiness
+		{`tty`, false},
+		{`!tty`, true},
+		{`comm`, true},
+		{`missing`, false},
+
+		// Every record is searched, != and !~ match when no value does
+		{`name == "/etc/hosts"`, true},
+		{`name == "/tmp/a b c"`, true},
+		{`PATH.name == "/etc/hosts"`, true},
+		{`1302.name == "/etc/hosts"`, true},
+		{`CWD.name == "/etc/hosts"`, false},
+		{`name != "/etc/hosts"`, false},
+		{`name =~ "^/tmp/"`, true},
+		{`name !~ "^/tmp/"`, false},
+		{`name !~ "^/var/"`, true},
+		{`name in ["/etc/passwd", "/etc/hosts"]`, true},
+		{`uid in [0, 1000]`, true},
+		{`uid in [1000]`, false},
+
+		// Addresses
+		{`sockaddr.family == "inet"`, true},
+		{`sockaddr.port == 443`, true},
+		{`sockaddr.address == "10.1.2.3"`, true},
+		{`cidr(sockaddr.address, "10.0.0.0/8")`, true},
+		{`cidr(sockaddr.address, "172.16.0.0/12", "192.168.0.0/16")`, false},
+		{`cidr(exe, "10.0.0.0/8")`, false},
+
+		// Boolean logic
+		{`syscall_name == "connect" && !cidr(sockaddr.address, "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16")`, false},
+		{`syscall_name == "execve" || uid == 0`, true},
+		{`syscall_name == "execve" || uid == 0 && tty`, false},
+		{`(syscall_name == "execve" || uid == 0) && !tty`, true},
+		{`!(uid == 0)`, false},
+		{`!!comm`, true},
+	}
+
+	for _, test := range tests {
+		e, err := parseFilterExpression(test.expression)
+		if !assert.Nil(t, err, test.expression) {
+			continue
+		}
+
+		assert.Equal(t, test.match, e.Match(g), test.expression)
+		assert.Equal(t, test.expression, e.String())
+	}
+}
+
+func Test_parseFilterExpression_Errors(t *testing.T) {
+	tests := []struct {
+		expression string
+		err        string
+	}{
+		{``, "Unexpected end of expression"},
+		{`uid ==`, "Unexpected end of expression"},
+		{`uid == 0 &&`, "Unexpected end of expression"},
+		{`uid 0`, "Unexpected `0` at position 5"},
+		{`(uid == 0`, "Unexpected end of expression"},
+		{`uid == 0)`, "Unexpected `)` at position 9"},
+		{`uid == exe`, "Unexpected `exe` at position 8"},
+		{`uid = 0`, "Unexpected `=` at position 5"},
+		{`uid == -abc`, "Invalid number `-abc` at position 8"},
+		{`exe == "/bin`, "Unterminated string at position 8"},
+		{`exe =~ "["`, "Invalid regex at position 8. Error: error parsing regexp: missing closing ]: `[`"},
+		{`exe =~ 1`, "`=~` at position 8 needs a string regex"},
+		{`uid > "a"`, "`>` at position 7 needs a number"},
+		{`uid in 0`, "Unexpected `0` at position 8"},
+		{`uid in [0,`, "Unexpected end of expression"},
+		{`cidr(sockaddr.address)`, "cidr at position 6 needs at least one network"},
+		{`cidr(sockaddr.address, "10.0.0.0")`, "Invalid cidr at position 24. Error: invalid CIDR address: 10.0.0.0"},
+		{`cidr("10.0.0.0/8")`, "Unexpected `\"10.0.0.0/8\"` at position 6"},
+		{`sockaddr.nope == 1`, "Unknown sockaddr field `nope` at position 1"},
+		{`NOPE.uid == 1`, "Unknown record type `NOPE` at position 1"},
+		{`PATH. == 1`, "Missing field name after `PATH.` at position 1"},
+	}
+
+	for _, test := range tests {
+		_, err := parseFilterExpression(test.expression)
+		assert.EqualError(t, err, test.err, test.expression)
+	}
+}
+
+func makeGroup(t *testing.T, records ...string) *AuditMessageGroup {
+	var g *AuditMessageGroup
+	for _, r := range records {
+		msg, err := parseReplayRecord(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		am := NewAuditMessage(msg)
+		if g == nil {
+			g = NewAuditMessageGroup(am)
+		} else {
+			g.AddMessage(am)
+		}
+	}
+
+	return g
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	HTTP_BATCH_SIZE     = 100              // Default number of message groups sent in one request
+	HTTP_FLUSH_INTERVAL = time.Second      // Default longest time a message group waits for its batch to fill up
+	HTTP_TIMEOUT        = time.Second * 10 // Default time a request can take
+	HTTP_BACKOFF        = time.Second      // Wait before the first retry of a batch, doubled for every retry after that
+	HTTP_MAX_BACKOFF    = time.Second * 30 // Longest wait between retries of a batch
+)
+
+// httpWriter POSTs every batch it is given as newline delimited JSON or a JSON array
+type httpWriter struct {
+	client   *http.Client
+	url      string
+	header   http.Header
+	array    bool // Send a JSON array instead of newline delimited JSON
+	gzip     bool
+	attempts int
+	backoff  time.Duration
+	done     chan struct{} // Closed by Close so a batch that is being retried does not wait out the backoff
+	once     sync.Once
+}
+
+// httpStatusError is returned for a response outside of 2xx
+type httpStatusError struct {
+	status int
+	body   string
+}
+
+func (e *httpStatusError) Error() string {
+	if e.body == "" {
+		return fmt.Sprintf("Unexpected response %d %s", e.status, http.StatusText(e.status))
+	}
+
+	return fmt.Sprintf("Unexpected response %d %s: %s", e.status, http.StatusText(e.status), e.body)
+}
+
+// retry reports if sending the batch again could work, anything other than a timeout, rate limit or server
+// error means the batch itself was refused
+func (e *httpStatusError) retry() bool {
+	return e.status == http.StatusRequestTimeout || e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+func createHTTPOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.http.attempts")
+	if attempts < 1 {
+		return nil, fmt.Errorf("Output attempts for http must be at least 1, %v provided", attempts)
+	}
+
+	u, err := url.Parse(config.GetString("output.http.url"))
+	if err != nil {
+		return nil, fmt.Errorf("Output url for http could not be parsed. Error: %s", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Output url for http must be an http or https url, got `%s`", u)
+	}
+
+	var array bool
+	switch format := config.GetString("output.http.format"); format {
+	case "ndjson":
+	case "json":
+		array = true
+	default:
+		return nil, fmt.Errorf("Output format for http must be `ndjson` or `json`, got `%s`", format)
+	}
+
+	var gz bool
+	switch c := config.GetString("output.http.compression"); c {
+	case "none":
+	case "gzip":
+		gz = true
+	default:
+		return nil, fmt.Errorf("Output compression for http must be `none` or `gzip`, got `%s`", c)
+	}
+
+	batchSize := config.GetInt("output.http.batch_size")
+	if batchSize < 1 {
+		return nil, fmt.Errorf("Output batch_size for http must be at least 1, %v provided", batchSize)
+	}
+
+	flushInterval := config.GetDuration("output.http.flush_interval")
+	if flushInterval <= 0 {
+		return nil, fmt.Errorf("Output flush_interval for http must be greater than 0, got `%s`", config.GetString("output.http.flush_interval"))
+	}
+
+	tlsConfig, err := createTLSConfig(config, "output.http.tls")
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	for k, v := range config.GetStringMapString("output.http.headers") {
+		header.Set(k, v)
+	}
+
+	if token := config.GetString("output.http.bearer_token"); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	header.Set("Content-Type", "application/x-ndjson")
+	if array {
+		header.Set("Content-Type", "application/json")
+	}
+
+	if gz {
+		header.Set("Content-Encoding", "gzip")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	h := &httpWriter{
+		client:   &http.Client{Transport: transport, Timeout: config.GetDuration("output.http.timeout")},
+		url:      u.String(),
+		header:   header,
+		array:    array,
+		gzip:     gz,
+		attempts: attempts,
+		backoff:  HTTP_BACKOFF,
+		done:     make(chan struct{}),
+	}
+
+	return NewBatchWriter(h, batchSize, flushInterval), nil
+}
+
+// Send POSTs the batch, retrying up to attempts times with a growing backoff until it gets a 2xx
+func (h *httpWriter) Send(batch []*batchEntry) error {
+	body, err := h.body(batch)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	backoff := h.backoff
+	for i := 0; i < h.attempts; i++ {
+		err = h.post(body)
+		if err == nil {
+			return nil
+		}
+
+		if se, ok := err.(*httpStatusError); ok && !se.retry() {
+			return &permanentError{err}
+		}
+
+		if i != h.attempts-1 {
+			metricOutputRetries.WithLabelValues("http").Inc()
+			el.Printf("Failed to write to %s, retrying in %s. Error: %s\n", h.url, backoff, err)
+
+			select {
+			case <-h.done:
+				// Shutting down, don't hold it up with the backoff
+			case <-time.After(backoff):
+			}
+
+			backoff = min(backoff*2, HTTP_MAX_BACKOFF)
+		}
+	}
+
+	return err
+}
+
+// Close stops waiting between retries and drops the idle connections
+func (h *httpWriter) Close() error {
+	h.once.Do(func() { close(h.done) })
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+// body encodes a batch the way the receiving end wants it
+func (h *httpWriter) body(batch []*batchEntry) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	var w io.Writer = buf
+
+	var z *gzip.Writer
+	if h.gzip {
+		z = gzip.NewWriter(buf)
+		w = z
+	}
+
+	if h.array {
+		w.Write([]byte("["))
+	}
+
+	for i, e := range batch {
+		line := e.line
+		if h.array {
+			line = bytes.TrimSuffix(line, []byte("\n"))
+			if i > 0 {
+				w.Write([]byte(","))
+			}
+		}
+
+		if _, err := w.Write(line); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.array {
+		w.Write([]byte("]"))
+	}
+
+	if z != nil {
+		if err := z.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (h *httpWriter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = h.header.Clone()
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Only a little of the body is kept for the error, the rest is read so the connection can be reused
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &httpStatusError{status: res.StatusCode, body: string(bytes.TrimSpace(msg))}
+	}
+
+	return nil
+}
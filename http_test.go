@@ -0,0 +1,319 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// httpRecorder keeps every request made to it and answers with the next status in statuses, 200 once they run out
+type httpRecorder struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (r *httpRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body io.Reader = req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		z, err := gzip.NewReader(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = z
+	}
+	b, _ := io.ReadAll(body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, string(b))
+
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		w.WriteHeader(status)
+		io.WriteString(w, "nope\n")
+	}
+}
+
+func (r *httpRecorder) Bodies() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.bodies...)
+}
+
+func newHTTPConfig(url string) *viper.Viper {
+	c := viper.New()
+	c.Set("output.http.attempts", 3)
+	c.Set("output.http.url", url)
+	c.Set("output.http.format", "ndjson")
+	c.Set("output.http.compression", "none")
+	c.Set("output.http.batch_size", HTTP_BATCH_SIZE)
+	c.Set("output.http.flush_interval", "1h")
+	c.Set("output.http.timeout", "5s")
+	return c
+}
+
+func newHTTPTestGroups() []*AuditMessageGroup {
+	return []*AuditMessageGroup{
+		NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 1, AuditTime: "1", Data: "one"}),
+		NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 2, AuditTime: "2", Data: "two"}),
+		NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 3, AuditTime: "3", Data: "three"}),
+	}
+}
+
+func TestHTTPOutput(t *testing.T) {
+	t.Run("ndjson batches with headers", func(t *testing.T) {
+		r := &httpRecorder{}
+		s := httptest.NewServer(r)
+		defer s.Close()
+
+		c := newHTTPConfig(s.URL + "/ingest")
+		c.Set("output.http.batch_size", 2)
+		c.Set("output.http.bearer_token", "secret")
+		c.Set("output.http.headers", map[string]string{"x-scope-orgid": "audit"})
+
+		w, err := createHTTPOutput(c)
+		assert.Nil(t, err)
+
+		m := NewMultiAuditWriter()
+		m.Add("http", w, 0)
+		for _, g := range newHTTPTestGroups() {
+			assert.Nil(t, m.Write(g))
+		}
+
+		// The full batch went out right away, the rest on close
+		assert.Eventually(t, func() bool { return len(r.Bodies()) == 1 }, time.Second*5, time.Millisecond*10)
+		assert.Nil(t, m.Close())
+
+		bodies := r.Bodies()
+		if assert.Len(t, bodies, 2) {
+			assert.Equal(t, 2, strings.Count(bodies[0], "\n"))
+			assert.Contains(t, bodies[0], `"sequence":1`)
+			assert.Contains(t, bodies[0], `"sequence":2`)
+			assert.Equal(t, 1, strings.Count(bodies[1], "\n"))
+			assert.Contains(t, bodies[1], `"sequence":3`)
+		}
+
+		req := r.requests[0]
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, "/ingest", req.URL.Path)
+		assert.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+		assert.Equal(t, "audit", req.Header.Get("X-Scope-Orgid"))
+		assert.Equal(t, "application/x-ndjson", req.Header.Get("Content-Type"))
+		assert.Empty(t, req.Header.Get("Content-Encoding"))
+	})
+
+	t.Run("gzipped json array on the flush interval", func(t *testing.T) {
+		r := &httpRecorder{}
+		s := httptest.NewServer(r)
+		defer s.Close()
+
+		c := newHTTPConfig(s.URL)
+		c.Set("output.http.format", "json")
+		c.Set("output.http.compression", "gzip")
+		c.Set("output.http.flush_interval", "10ms")
+
+		w, err := createHTTPOutput(c)
+		assert.Nil(t, err)
+
+		m := NewMultiAuditWriter()
+		m.Add("http", w, 0)
+		for _, g := range newHTTPTestGroups() {
+			assert.Nil(t, m.Write(g))
+		}
+		assert.Eventually(t, func() bool { return len(r.Bodies()) == 1 }, time.Second*5, time.Millisecond*10)
+		assert.Nil(t, m.Close())
+
+		var groups []AuditMessageGroup
+		assert.Nil(t, json.Unmarshal([]byte(r.Bodies()[0]), &groups))
+		assert.Len(t, groups, 3)
+		assert.Equal(t, "application/json", r.requests[0].Header.Get("Content-Type"))
+		assert.Equal(t, "gzip", r.requests[0].Header.Get("Content-Encoding"))
+	})
+
+	t.Run("retries server errors", func(t *testing.T) {
+		_, elb := hookLogger()
+		defer resetLogger()
+
+		r := &httpRecorder{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+		s := httptest.NewServer(r)
+		defer s.Close()
+
+		c := newHTTPConfig(s.URL)
+		c.Set("output.http.batch_size", 1)
+		w, err := createHTTPOutput(c)
+		assert.Nil(t, err)
+		w.sender.(*httpWriter).backoff = time.Millisecond
+
+		assert.Nil(t, w.Write(newHTTPTestGroups()[0]))
+		assert.Len(t, r.Bodies(), 3)
+		assert.Equal(t, r.Bodies()[0], r.Bodies()[2])
+		assert.Contains(t, elb.String(), "Failed to write to "+s.URL+", retrying in 1ms. Error: Unexpected response 503 Service Unavailable: nope\n")
+		assert.Contains(t, elb.String(), "retrying in 2ms. Error: Unexpected response 429 Too Many Requests: nope\n")
+		assert.Nil(t, w.Close())
+	})
+
+	t.Run("close does not wait out the backoff", func(t *testing.T) {
+		hookLogger()
+		defer resetLogger()
+
+		r := &httpRecorder{statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}}
+		s := httptest.NewServer(r)
+		defer s.Close()
+
+		w, err := createHTTPOutput(newHTTPConfig(s.URL))
+		assert.Nil(t, err)
+		w.sender.(*httpWriter).backoff = time.Hour
+
+		written := make(chan error)
+		go func() { written <- w.Write(newHTTPTestGroups()[0]) }()
+		assert.Eventually(t, func() bool { return len(r.Bodies()) == 1 }, time.Second*5, time.Millisecond*10)
+
+		// The rest of the attempts are made right away
+		assert.Nil(t, w.Close())
+		select {
+		case err := <-written:
+			assert.EqualError(t, err, "Unexpected response 503 Service Unavailable: nope")
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close should have cut the backoff short")
+		}
+		assert.Len(t, r.Bodies(), 3)
+	})
+
+	t.Run("does not retry refused batches", func(t *testing.T) {
+		hookLogger()
+		defer resetLogger()
+
+		r := &httpRecorder{statuses: []int{http.StatusBadRequest}}
+		s := httptest.NewServer(r)
+		defer s.Close()
+
+		c := newHTTPConfig(s.URL)
+		c.Set("output.http.attempts", 1)
+		c.Set("output.http.batch_size", 2)
+		w, err := createHTTPOutput(c)
+		assert.Nil(t, err)
+
+		groups := newHTTPTestGroups()
+		err = w.WriteBatch(groups[:2])
+		assert.EqualError(t, err, "Unexpected response 400 Bad Request: nope")
+		assert.True(t, isPermanent(err))
+		assert.Len(t, r.Bodies(), 1)
+		assert.Nil(t, w.Close())
+	})
+
+	t.Run("spooled batches are only acked once accepted", func(t *testing.T) {
+		_, elb := hookLogger()
+		defer resetLogger()
+
+		r := &httpRecorder{statuses: []int{http.StatusServiceUnavailable}}
+		s := httptest.NewServer(r)
+		defer s.Close()
+
+		sp, err := OpenSpool(t.TempDir(), 1024*1024, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := newHTTPConfig(s.URL)
+		c.Set("output.http.attempts", 1)
+		c.Set("output.http.batch_size", 3)
+		w, err := createHTTPOutput(c)
+		assert.Nil(t, err)
+
+		m := NewMultiAuditWriter()
+		m.AddSpooled("http", w, sp, 0)
+		for _, g := range newHTTPTestGroups() {
+			assert.Nil(t, m.Write(g))
+		}
+
+		// The refused batch is sent again as a whole from the spool
+		assert.Eventually(t, func() bool { return len(r.Bodies()) == 2 }, time.Second*5, time.Millisecond*10)
+		assert.Nil(t, m.Close())
+
+		bodies := r.Bodies()
+		assert.Equal(t, bodies[0], bodies[1])
+		assert.Equal(t, 3, strings.Count(bodies[1], "\n"))
+		assert.Equal(t, "Failed to write 3 message groups 1 to 3 to output http, retrying in 1s. Error: Unexpected response 503 Service Unavailable: nope\n", elb.String())
+	})
+
+	t.Run("mutual tls", func(t *testing.T) {
+		cert, key := newTestCert(t)
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pem, _ := os.ReadFile(cert)
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+
+		r := &httpRecorder{}
+		s := httptest.NewUnstartedServer(r)
+		s.TLS = &tls.Config{Certificates: []tls.Certificate{pair}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+		s.StartTLS()
+		defer s.Close()
+
+		c := newHTTPConfig(s.URL)
+		c.Set("output.http.tls.enabled", true)
+		c.Set("output.http.tls.ca", cert)
+		c.Set("output.http.tls.cert", cert)
+		c.Set("output.http.tls.key", key)
+
+		w, err := createHTTPOutput(c)
+		assert.Nil(t, err)
+		assert.Nil(t, w.Write(newHTTPTestGroups()[0]))
+		assert.Nil(t, w.Close())
+		assert.Len(t, r.Bodies(), 1)
+		assert.Len(t, r.requests[0].TLS.PeerCertificates, 1)
+	})
+}
+
+func Test_createHTTPOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		set  map[string]interface{}
+		err  string
+	}{
+		{"attempts", map[string]interface{}{"attempts": 0}, "Output attempts for http must be at least 1, 0 provided"},
+		{"url missing", map[string]interface{}{"url": ""}, "Output url for http must be an http or https url, got ``"},
+		{"url scheme", map[string]interface{}{"url": "ftp://example.com"}, "Output url for http must be an http or https url, got `ftp://example.com`"},
+		{"url", map[string]interface{}{"url": "http://[::1"}, "Output url for http could not be parsed. Error: parse \"http://[::1\": missing ']' in host"},
+		{"format", map[string]interface{}{"format": "xml"}, "Output format for http must be `ndjson` or `json`, got `xml`"},
+		{"compression", map[string]interface{}{"compression": "zstd"}, "Output compression for http must be `none` or `gzip`, got `zstd`"},
+		{"batch size", map[string]interface{}{"batch_size": 0}, "Output batch_size for http must be at least 1, 0 provided"},
+		{"flush interval", map[string]interface{}{"flush_interval": "0s"}, "Output flush_interval for http must be greater than 0, got `0s`"},
+		{"tls", map[string]interface{}{"tls.enabled": true, "tls.key": "/key"}, "output.http.tls.cert and output.http.tls.key must be set together"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newHTTPConfig("http://127.0.0.1/")
+			for k, v := range test.set {
+				c.Set("output.http."+k, v)
+			}
+
+			w, err := createHTTPOutput(c)
+			assert.EqualError(t, err, test.err)
+			assert.Nil(t, w)
+		})
+	}
+}
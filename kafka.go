@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/gzip"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"github.com/segmentio/kafka-go/snappy"
+	"github.com/spf13/viper"
+)
+
+const (
+	KAFKA_BATCH_SIZE      = 100                   // Default number of message groups sent to kafka at once
+	KAFKA_BATCH_TIMEOUT   = time.Second           // Default longest time a message group waits for its batch to fill up
+	KAFKA_TIMEOUT         = time.Second * 10      // Default time to connect to a broker or for it to answer
+	KAFKA_PARTITION_FLUSH = time.Millisecond * 10 // A batch is handed over all at once, don't wait on it once it is split up by partition
+)
+
+// kafkaWriter sends every message group in a batch to a kafka topic as its own message
+type kafkaWriter struct {
+	w        *kafka.Writer
+	timeout  time.Duration
+	attempts int
+	key      func(msg *AuditMessageGroup) []byte // Partition key of a message group, nil to spread them out evenly
+}
+
+func createKafkaOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.kafka.attempts")
+	if attempts < 1 {
+		return nil, fmt.Errorf("Output attempts for kafka must be at least 1, %v provided", attempts)
+	}
+
+	brokers := config.GetStringSlice("output.kafka.brokers")
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("Output brokers for kafka must be set")
+	}
+
+	topic := config.GetString("output.kafka.topic")
+	if topic == "" {
+		return nil, fmt.Errorf("Output topic for kafka must be set")
+	}
+
+	batchSize := config.GetInt("output.kafka.batch_size")
+	if batchSize < 1 {
+		return nil, fmt.Errorf("Output batch_size for kafka must be at least 1, %v provided", batchSize)
+	}
+
+	batchTimeout := config.GetDuration("output.kafka.batch_timeout")
+	if batchTimeout <= 0 {
+		return nil, fmt.Errorf("Output batch_timeout for kafka must be greater than 0, got `%s`", config.GetString("output.kafka.batch_timeout"))
+	}
+
+	var acks int
+	switch a := config.GetString("output.kafka.acks"); a {
+	case "all":
+		acks = -1
+	case "leader":
+		acks = 1
+	case "none":
+		// The kafka client waits for an answer to every produce request, brokers don't send one without acks
+		return nil, fmt.Errorf("Output acks for kafka `none` is not supported, use `all` or `leader`")
+	default:
+		return nil, fmt.Errorf("Output acks for kafka must be `all` or `leader`, got `%s`", a)
+	}
+
+	var codec kafka.CompressionCodec
+	switch c := config.GetString("output.kafka.compression"); c {
+	case "none":
+	case "gzip":
+		codec = gzip.NewCompressionCodec()
+	case "snappy":
+		codec = snappy.NewCompressionCodec()
+	case "lz4", "zstd":
+		return nil, fmt.Errorf("Output compression for kafka `%s` is not supported, use `none`, `gzip` or `snappy`", c)
+	default:
+		return nil, fmt.Errorf("Output compression for kafka must be `none`, `gzip` or `snappy`, got `%s`", c)
+	}
+
+	tlsConfig, err := createTLSConfig(config, "output.kafka.tls")
+	if err != nil {
+		return nil, err
+	}
+
+	mechanism, err := createKafkaSASL(config)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := createKafkaKey(config.GetString("output.kafka.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	var balancer kafka.Balancer = &kafka.RoundRobin{}
+	if key != nil {
+		balancer = &kafka.Hash{}
+	}
+
+	timeout := config.GetDuration("output.kafka.timeout")
+	kw := &kafkaWriter{
+		timeout:  timeout,
+		attempts: attempts,
+		key:      key,
+	}
+
+	kw.w = kafka.NewWriter(kafka.WriterConfig{
+		Brokers: brokers,
+		Topic:   topic,
+		Dialer: &kafka.Dialer{
+			ClientID:      "go-audit",
+			Timeout:       timeout,
+			DualStack:     true,
+			TLS:           tlsConfig,
+			SASLMechanism: mechanism,
+		},
+		Balancer:         balancer,
+		MaxAttempts:      attempts,
+		BatchSize:        batchSize,
+		BatchTimeout:     KAFKA_PARTITION_FLUSH,
+		ReadTimeout:      timeout,
+		WriteTimeout:     timeout,
+		RequiredAcks:     acks,
+		CompressionCodec: codec,
+		ErrorLogger: kafka.LoggerFunc(func(format string, args ...interface{}) {
+			el.Printf("Kafka output: "+format+"\n", args...)
+		}),
+	})
+
+	return NewBatchWriter(kw, batchSize, batchTimeout), nil
+}
+
+func createKafkaSASL(config *viper.Viper) (sasl.Mechanism, error) {
+	user, pass := config.GetString("output.kafka.sasl.username"), config.GetString("output.kafka.sasl.password")
+
+	switch m := config.GetString("output.kafka.sasl.mechanism"); m {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: user, Password: pass}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, user, pass)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, user, pass)
+	default:
+		return nil, fmt.Errorf("Output sasl.mechanism for kafka must be `plain`, `scram-sha-256` or `scram-sha-512`, got `%s`", m)
+	}
+}
+
+// createKafkaKey returns what to use as the partition key, `hostname` is the name of this host and anything else is
+// a field in the same syntax as filter expressions. Returns nil if key is empty
+func createKafkaKey(key string) (func(msg *AuditMessageGroup) []byte, error) {
+	switch key {
+	case "":
+		return nil, nil
+
+	case "hostname":
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get the hostname for the kafka partition key. Error: %s", err)
+		}
+
+		return func(*AuditMessageGroup) []byte { return []byte(hostname) }, nil
+	}
+
+	field, err := parseFieldRef(key)
+	if err != nil {
+		return nil, fmt.Errorf("Output key for kafka could not be parsed; Value: `%s`; Error: %s", key, err)
+	}
+
+	return func(msg *AuditMessageGroup) []byte {
+		return []byte(strings.Join(field.values(newFilterGroup(msg)), ","))
+	}, nil
+}
+
+// Send writes the batch and waits for the brokers to accept all of it, kafka-go retries it MaxAttempts times before
+// giving up
+func (k *kafkaWriter) Send(batch []*batchEntry) error {
+	msgs := make([]kafka.Message, len(batch))
+	for i, e := range batch {
+		// Every line ends with a newline kafka consumers don't expect
+		msgs[i].Value = bytes.TrimSuffix(e.line, []byte("\n"))
+		if k.key != nil {
+			msgs[i].Key = k.key(e.msg)
+		}
+	}
+
+	// Every attempt can take the timeout to connect and again to write
+	ctx, cancel := context.WithTimeout(context.Background(), 2*k.timeout*time.Duration(k.attempts))
+	defer cancel()
+
+	err := k.w.WriteMessages(ctx, msgs...)
+	switch err {
+	case kafka.MessageSizeTooLarge, kafka.RecordListTooLarge:
+		// The brokers will never take it no matter how often it is sent
+		return &permanentError{err}
+	}
+
+	if _, ok := err.(kafka.MessageTooLargeError); ok {
+		return &permanentError{err}
+	}
+
+	return err
+}
+
+// Close closes the connections to the brokers
+func (k *kafkaWriter) Close() error {
+	return k.w.Close()
+}
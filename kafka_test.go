@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKafkaBroker speaks just enough of the kafka protocol for kafka-go to produce to it. It is the only broker in the
+// cluster and leads every partition of every topic
+type fakeKafkaBroker struct {
+	t          *testing.T
+	l          net.Listener
+	partitions int32
+
+	mu       sync.Mutex
+	messages []fakeKafkaMessage
+}
+
+type fakeKafkaMessage struct {
+	topic      string
+	partition  int32
+	acks       int16
+	compressed bool
+	key        string
+	value      string
+}
+
+func newFakeKafkaBroker(t *testing.T, partitions int32) *fakeKafkaBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeKafkaBroker{t: t, l: l, partitions: partitions}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+
+	return b
+}
+
+func (b *fakeKafkaBroker) Addr() string {
+	return b.l.Addr().String()
+}
+
+func (b *fakeKafkaBroker) Close() {
+	b.l.Close()
+}
+
+func (b *fakeKafkaBroker) Messages() []fakeKafkaMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]fakeKafkaMessage(nil), b.messages...)
+}
+
+func (b *fakeKafkaBroker) serve(c net.Conn) {
+	defer c.Close()
+
+	for {
+		var size int32
+		if err := binary.Read(c, binary.BigEndian, &size); err != nil {
+			return
+		}
+
+		req := make([]byte, size)
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+
+		r := &kafkaReader{b: req}
+		apiKey, _, corrID := r.int16(), r.int16(), r.int32()
+		r.string() // client id
+
+		res := &bytes.Buffer{}
+		kafkaWrite(res, corrID)
+
+		switch apiKey {
+		case 18: // ApiVersions v0
+			kafkaWrite(res, int16(0), int32(3))
+			kafkaWrite(res, int16(0), int16(0), int16(2)) // Produce
+			kafkaWrite(res, int16(3), int16(0), int16(1)) // Metadata
+			kafkaWrite(res, int16(18), int16(0), int16(0))
+
+		case 3: // Metadata v1
+			host, port, _ := net.SplitHostPort(b.Addr())
+			p, _ := strconv.Atoi(port)
+
+			kafkaWrite(res, int32(1), int32(1))
+			kafkaWriteString(res, host)
+			kafkaWrite(res, int32(p))
+			kafkaWriteString(res, "")
+			kafkaWrite(res, int32(1)) // Controller
+
+			topics := r.strings()
+			kafkaWrite(res, int32(len(topics)))
+			for _, topic := range topics {
+				kafkaWrite(res, int16(0))
+				kafkaWriteString(res, topic)
+				kafkaWrite(res, false, b.partitions)
+				for i := int32(0); i < b.partitions; i++ {
+					kafkaWrite(res, int16(0), i, int32(1), int32(1), int32(1), int32(1), int32(1))
+				}
+			}
+
+		case 0: // Produce v2
+			acks := r.int16()
+			r.int32() // timeout
+
+			topics := r.int32()
+			kafkaWrite(res, topics)
+			for i := int32(0); i < topics; i++ {
+				topic := r.string()
+				kafkaWriteString(res, topic)
+
+				partitions := r.int32()
+				kafkaWrite(res, partitions)
+				for j := int32(0); j < partitions; j++ {
+					partition := r.int32()
+					b.record(topic, partition, acks, r.bytes(), false)
+					kafkaWrite(res, partition, int16(0), int64(0), int64(-1))
+				}
+			}
+			kafkaWrite(res, int32(0)) // Throttle time
+
+		default:
+			b.t.Errorf("Unexpected kafka request %d", apiKey)
+			return
+		}
+
+		if r.err != nil {
+			b.t.Errorf("Failed to parse kafka request %d. Error: %s", apiKey, r.err)
+			return
+		}
+
+		kafkaWrite(c, int32(res.Len()))
+		if _, err := c.Write(res.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// record stores every message in a v1 message set, unpacking gzipped message sets
+func (b *fakeKafkaBroker) record(topic string, partition int32, acks int16, set []byte, compressed bool) {
+	r := &kafkaReader{b: set}
+	for len(r.b) > 0 && r.err == nil {
+		r.int64() // offset
+		m := &kafkaReader{b: r.bytes()}
+		m.int32() // crc
+		m.int8()  // magic
+		attributes := m.int8()
+		m.int64() // timestamp
+		key, value := m.bytes(), m.bytes()
+
+		if attributes&7 == 1 {
+			z, err := gzip.NewReader(bytes.NewReader(value))
+			if err != nil {
+				b.t.Errorf("Failed to read gzipped message set. Error: %s", err)
+				return
+			}
+
+			inner, err := io.ReadAll(z)
+			if err != nil {
+				b.t.Errorf("Failed to read gzipped message set. Error: %s", err)
+				return
+			}
+
+			b.record(topic, partition, acks, inner, true)
+			continue
+		}
+
+		b.mu.Lock()
+		b.messages = append(b.messages, fakeKafkaMessage{
+			topic:      topic,
+			partition:  partition,
+			acks:       acks,
+			compressed: compressed,
+			key:        string(key),
+			value:      string(value),
+		})
+		b.mu.Unlock()
+	}
+}
+
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *kafkaReader) int8() int8   { return int8(r.next(1)[0]) }
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func (r *kafkaReader) strings() []string {
+	n := r.int32()
+	s := make([]string, 0, max(n, 0))
+	for i := int32(0); i < n; i++ {
+		s = append(s, r.string())
+	}
+	return s
+}
+
+func (r *kafkaReader) bytes() []byte {
+	n := r.int32()
+	if n < 0 {
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func kafkaWrite(w io.Writer, values ...interface{}) {
+	for _, v := range values {
+		binary.Write(w, binary.BigEndian, v)
+	}
+}
+
+func kafkaWriteString(w io.Writer, s string) {
+	kafkaWrite(w, int16(len(s)))
+	io.WriteString(w, s)
+}
+
+func newKafkaConfig(broker string) *viper.Viper {
+	c := viper.New()
+	c.Set("output.kafka.attempts", 3)
+	c.Set("output.kafka.brokers", []string{broker})
+	c.Set("output.kafka.topic", "go-audit")
+	c.Set("output.kafka.key", "hostname")
+	c.Set("output.kafka.acks", "all")
+	c.Set("output.kafka.batch_size", KAFKA_BATCH_SIZE)
+	c.Set("output.kafka.batch_timeout", "1s")
+	c.Set("output.kafka.timeout", "5s")
+	c.Set("output.kafka.compression", "none")
+	return c
+}
+
+func TestKafkaOutput(t *testing.T) {
+	b := newFakeKafkaBroker(t, 4)
+	defer b.Close()
+
+	groups := []*AuditMessageGroup{
+		makeGroup(t, `type=SYSCALL msg=audit(1:1): arch=c000003e syscall=59 uid=1000`),
+		makeGroup(t, `type=SYSCALL msg=audit(1:2): arch=c000003e syscall=59 uid=1001`),
+		makeGroup(t, `type=SYSCALL msg=audit(1:3): arch=c000003e syscall=59 uid=1000`),
+	}
+
+	// Keyed by a field, gzipped, a full batch goes out right away and the rest on close
+	c := newKafkaConfig(b.Addr())
+	c.Set("output.kafka.key", "uid")
+	c.Set("output.kafka.acks", "leader")
+	c.Set("output.kafka.batch_size", 2)
+	c.Set("output.kafka.batch_timeout", "1h")
+	c.Set("output.kafka.compression", "gzip")
+
+	w, err := createKafkaOutput(c)
+	assert.Nil(t, err)
+
+	m := NewMultiAuditWriter()
+	m.Add("kafka", w, 0)
+	for _, g := range groups {
+		assert.Nil(t, m.Write(g))
+	}
+	assert.Eventually(t, func() bool { return len(b.Messages()) == 2 }, time.Second*5, time.Millisecond*10)
+	assert.Nil(t, m.Close())
+
+	msgs := b.Messages()
+	if assert.Len(t, msgs, 3) {
+		byKey := map[string][]fakeKafkaMessage{}
+		for _, m := range msgs {
+			assert.Equal(t, "go-audit", m.topic)
+			assert.Equal(t, int16(1), m.acks)
+			assert.True(t, m.compressed)
+			assert.Contains(t, m.value, `"sequence":`)
+			assert.NotContains(t, m.value, "\n")
+			byKey[m.key] = append(byKey[m.key], m)
+		}
+
+		assert.Len(t, byKey["1000"], 2)
+		assert.Len(t, byKey["1001"], 1)
+		assert.Equal(t, byKey["1000"][0].partition, byKey["1000"][1].partition)
+	}
+
+	// Defaults, a partial batch goes out once the batch timeout is up
+	b.mu.Lock()
+	b.messages = nil
+	b.mu.Unlock()
+
+	c = newKafkaConfig(b.Addr())
+	c.Set("output.kafka.batch_timeout", "10ms")
+	w, err = createKafkaOutput(c)
+	assert.Nil(t, err)
+
+	m = NewMultiAuditWriter()
+	m.Add("kafka", w, 0)
+	assert.Nil(t, m.Write(groups[0]))
+	assert.Eventually(t, func() bool { return len(b.Messages()) == 1 }, time.Second*5, time.Millisecond*10)
+
+	msg := b.Messages()[0]
+	hostname, _ := os.Hostname()
+	assert.Equal(t, hostname, msg.key)
+	assert.Equal(t, int16(-1), msg.acks)
+	assert.False(t, msg.compressed)
+	assert.Nil(t, m.Close())
+}
+
+func TestKafkaOutput_Unavailable(t *testing.T) {
+	hookLogger()
+	defer resetLogger()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c := newKafkaConfig(addr)
+	c.Set("output.kafka.attempts", 1)
+	c.Set("output.kafka.batch_size", 1)
+	c.Set("output.kafka.timeout", "100ms")
+	w, err := createKafkaOutput(c)
+	assert.Nil(t, err)
+
+	// Nothing is reported as written until a broker has it
+	assert.Error(t, w.Write(makeGroup(t, `type=SYSCALL msg=audit(1:1): arch=c000003e syscall=59 uid=1000`)))
+	assert.Nil(t, w.Close())
+}
+
+func Test_createKafkaOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		set  map[string]interface{}
+		err  string
+	}{
+		{"attempts", map[string]interface{}{"attempts": 0}, "Output attempts for kafka must be at least 1, 0 provided"},
+		{"brokers", map[string]interface{}{"brokers": []string{}}, "Output brokers for kafka must be set"},
+		{"topic", map[string]interface{}{"topic": ""}, "Output topic for kafka must be set"},
+		{"batch size", map[string]interface{}{"batch_size": 0}, "Output batch_size for kafka must be at least 1, 0 provided"},
+		{"batch timeout", map[string]interface{}{"batch_timeout": "0s"}, "Output batch_timeout for kafka must be greater than 0, got `0s`"},
+		{"acks", map[string]interface{}{"acks": "some"}, "Output acks for kafka must be `all` or `leader`, got `some`"},
+		{"acks none", map[string]interface{}{"acks": "none"}, "Output acks for kafka `none` is not supported, use `all` or `leader`"},
+		{"compression", map[string]interface{}{"compression": "brotli"}, "Output compression for kafka must be `none`, `gzip` or `snappy`, got `brotli`"},
+		{"compression lz4", map[string]interface{}{"compression": "lz4"}, "Output compression for kafka `lz4` is not supported, use `none`, `gzip` or `snappy`"},
+		{"compression zstd", map[string]interface{}{"compression": "zstd"}, "Output compression for kafka `zstd` is not supported, use `none`, `gzip` or `snappy`"},
+		{"sasl", map[string]interface{}{"sasl.mechanism": "gssapi"}, "Output sasl.mechanism for kafka must be `plain`, `scram-sha-256` or `scram-sha-512`, got `gssapi`"},
+		{"key", map[string]interface{}{"key": "sockaddr.nope"}, "Output key for kafka could not be parsed; Value: `sockaddr.nope`; Error: Unknown sockaddr field `nope`"},
+		{"tls", map[string]interface{}{"tls.enabled": true, "tls.cert": "/cert"}, "output.kafka.tls.cert and output.kafka.tls.key must be set together"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newKafkaConfig("127.0.0.1:9092")
+			for k, v := range test.set {
+				c.Set("output.kafka."+k, v)
+			}
+
+			w, err := createKafkaOutput(c)
+			assert.EqualError(t, err, test.err)
+			assert.Nil(t, w)
+		})
+	}
+
+	for _, mechanism := range []string{"plain", "scram-sha-256", "scram-sha-512"} {
+		c := newKafkaConfig("127.0.0.1:9092")
+		c.Set("output.kafka.sasl.mechanism", mechanism)
+		c.Set("output.kafka.sasl.username", "go-audit")
+		c.Set("output.kafka.sasl.password", "secret")
+
+		w, err := createKafkaOutput(c)
+		assert.Nil(t, err, mechanism)
+		assert.IsType(t, &kafkaWriter{}, w.sender)
+		assert.Nil(t, w.Close())
+	}
+}
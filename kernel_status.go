@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// kernelSettings maps the `kernel` config keys to their AUDIT_SET mask bit and status field
+var kernelSettings = []struct {
+	key   string
+	mask  uint32
+	field func(*AuditStatusPayload) *uint32
+	max   int64
+}{
+	{"backlog_limit", AUDIT_STATUS_BACKLOG_LIMIT, func(s *AuditStatusPayload) *uint32 { return &s.BacklogLimit }, math.MaxUint32},
+	{"rate_limit", AUDIT_STATUS_RATE_LIMIT, func(s *AuditStatusPayload) *uint32 { return &s.RateLimit }, math.MaxUint32},
+	{"failure", AUDIT_STATUS_FAILURE, func(s *AuditStatusPayload) *uint32 { return &s.Failure }, 2},
+	{"backlog_wait_time", AUDIT_STATUS_BACKLOG_WAIT_TIME, func(s *AuditStatusPayload) *uint32 { return &s.BacklogWaitTime }, math.MaxUint32},
+}
+
+// kernelSettingsClient is the part of the netlink client used to change and verify kernel audit settings
+type kernelSettingsClient interface {
+	AuditStatusClient
+	SetStatus(status *AuditStatusPayload) error
+}
+
+// StatusMonitor periodically asks the kernel for its audit status, writes it to the outputs and warns when the kernel
+// starts losing events
+type StatusMonitor struct {
+	client   AuditStatusClient
+	writer   GroupWriter
+	lastLost uint32
+	checked  bool
+}
+
+func NewStatusMonitor(client AuditStatusClient, writer GroupWriter) *StatusMonitor {
+	return &StatusMonitor{
+		client: client,
+		writer: writer,
+	}
+}
+
+// Run checks the status every interval, it never returns
+func (sm *StatusMonitor) Run(interval time.Duration) {
+	sm.Check()
+	for range time.Tick(interval) {
+		sm.Check()
+	}
+}
+
+// Check gets the current status, logs it and emits it as an event
+func (sm *StatusMonitor) Check() {
+	status, err := sm.client.GetStatus()
+	if err != nil {
+		el.Printf("Failed to get the kernel audit status. Error: %s\n", err)
+		return
+	}
+
+	data := fmt.Sprintf(
+		"op=kernel_status enabled=%d failure=%d pid=%d rate_limit=%d backlog_limit=%d lost=%d backlog=%d backlog_wait_time=%d",
+		status.Enabled, status.Failure, status.Pid, status.RateLimit, status.BacklogLimit, status.Lost, status.Backlog,
+		status.BacklogWaitTime,
+	)
+
+	l.Println("Kernel audit status:", data[len("op=kernel_status "):])
+
+	// The lost counter only goes up until reboot, the first value we see may be from long before we started
+	if sm.checked && status.Lost > sm.lastLost {
+		el.Printf(
+			"The kernel lost %d audit events since the last check, %d in total. Backlog is %d of %d\n",
+			status.Lost-sm.lastLost, status.Lost, status.Backlog, status.BacklogLimit,
+		)
+	}
+
+	sm.lastLost = status.Lost
+	sm.checked = true
+
+	if err := sm.writer.Write(NewSyntheticMessageGroup(EVENT_KERNEL_STATUS, data)); err != nil {
+		el.Printf("Failed to write the kernel audit status event. Error: %s\n", err)
+	}
+}
+
+// createKernelSettings builds an AUDIT_SET payload from the `kernel` config, only the keys that are set are changed.
+// Returns nil if there is nothing to change. Kernel settings belong to the audit daemon so they are refused in multicast mode
+func createKernelSettings(config *viper.Viper) (*AuditStatusPayload, error) {
+	settings := &AuditStatusPayload{}
+	for _, s := range kernelSettings {
+		key := "kernel." + s.key
+		if !config.IsSet(key) {
+			continue
+		}
+
+		v := config.GetInt64(key)
+		if v < 0 || v > s.max {
+			return nil, fmt.Errorf("%s must be between 0 and %d, got %d", key, s.max, v)
+		}
+
+		settings.Mask |= s.mask
+		*s.field(settings) = uint32(v)
+	}
+
+	if settings.Mask == 0 {
+		return nil, nil
+	}
+
+	if config.GetBool("multicast.enabled") {
+		return nil, errors.New("kernel settings can not be used in multicast mode")
+	}
+
+	return settings, nil
+}
+
+// applyKernelSettings changes the kernel audit settings and reads them back to make sure they took
+func applyKernelSettings(c kernelSettingsClient, settings *AuditStatusPayload) error {
+	if err := c.SetStatus(settings); err != nil {
+		return fmt.Errorf("Failed to apply kernel audit settings. Error: %s", err)
+	}
+
+	status, err := c.GetStatus()
+	if err != nil {
+		return fmt.Errorf("Failed to verify kernel audit settings. Error: %s", err)
+	}
+
+	for _, s := range kernelSettings {
+		if settings.Mask&s.mask == 0 {
+			continue
+		}
+
+		if want, got := *s.field(settings), *s.field(status); want != got {
+			return fmt.Errorf("Kernel %s is %d after setting it to %d", s.key, got, want)
+		}
+
+		l.Printf("Kernel %s set to %d\n", s.key, *s.field(settings))
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusMonitor_Check(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	c := &fakeStatusClient{status: &AuditStatusPayload{Enabled: 1, Pid: 10, BacklogLimit: 8192, Lost: 100, Backlog: 3}}
+	w := &groupRecorder{}
+	sm := NewStatusMonitor(c, w)
+
+	// Lost events from before we started are not warned about
+	sm.Check()
+	assert.Equal(t, "Kernel audit status: enabled=1 failure=0 pid=10 rate_limit=0 backlog_limit=8192 lost=100 backlog=3 backlog_wait_time=0\n", lb.String())
+	assert.Empty(t, elb.String())
+	if assert.Len(t, w.groups, 1) {
+		assert.Equal(t, uint16(EVENT_KERNEL_STATUS), w.groups[0].Msgs[0].Type)
+		assert.Regexp(t, `^audit\([0-9.]+:0\): op=kernel_status enabled=1 failure=0 pid=10 rate_limit=0 backlog_limit=8192 lost=100 backlog=3 backlog_wait_time=0$`, w.groups[0].Msgs[0].Data)
+	}
+
+	sm.Check()
+	assert.Empty(t, elb.String())
+
+	c.status.Lost = 150
+	c.status.Backlog = 8192
+	sm.Check()
+	assert.Equal(t, "The kernel lost 50 audit events since the last check, 150 in total. Backlog is 8192 of 8192\n", elb.String())
+	assert.Len(t, w.groups, 3)
+
+	// Errors are logged and nothing is emitted
+	elb.Reset()
+	c.err = errors.New("testing")
+	sm.Check()
+	assert.Equal(t, "Failed to get the kernel audit status. Error: testing\n", elb.String())
+	assert.Len(t, w.groups, 3)
+}
+
+func Test_createKernelSettings(t *testing.T) {
+	newConfig := func(c string) *viper.Viper {
+		config := viper.New()
+		config.SetConfigType("yaml")
+		assert.Nil(t, config.ReadConfig(strings.NewReader(c)))
+		return config
+	}
+
+	// Nothing set, nothing to change
+	s, err := createKernelSettings(newConfig("kernel_status:\n  enabled: true\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, s)
+
+	// Only what is set is changed
+	s, err = createKernelSettings(newConfig("kernel:\n  backlog_limit: 8192\n  failure: 0\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, &AuditStatusPayload{Mask: AUDIT_STATUS_BACKLOG_LIMIT | AUDIT_STATUS_FAILURE, BacklogLimit: 8192}, s)
+
+	s, err = createKernelSettings(newConfig("kernel:\n  rate_limit: 100\n  backlog_wait_time: 60000\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, &AuditStatusPayload{Mask: AUDIT_STATUS_RATE_LIMIT | AUDIT_STATUS_BACKLOG_WAIT_TIME, RateLimit: 100, BacklogWaitTime: 60000}, s)
+
+	// Out of range values are rejected
+	s, err = createKernelSettings(newConfig("kernel:\n  failure: 3\n"))
+	assert.EqualError(t, err, "kernel.failure must be between 0 and 2, got 3")
+	assert.Nil(t, s)
+
+	s, err = createKernelSettings(newConfig("kernel:\n  backlog_limit: -1\n"))
+	assert.EqualError(t, err, "kernel.backlog_limit must be between 0 and 4294967295, got -1")
+	assert.Nil(t, s)
+
+	s, err = createKernelSettings(newConfig("kernel:\n  rate_limit: 4294967296\n"))
+	assert.EqualError(t, err, "kernel.rate_limit must be between 0 and 4294967295, got 4294967296")
+	assert.Nil(t, s)
+
+	s, err = createKernelSettings(newConfig("kernel:\n  backlog_wait_time: 4294967295\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, &AuditStatusPayload{Mask: AUDIT_STATUS_BACKLOG_WAIT_TIME, BacklogWaitTime: 4294967295}, s)
+
+	// auditd owns the kernel settings in multicast mode
+	s, err = createKernelSettings(newConfig("multicast:\n  enabled: true\nkernel:\n  backlog_limit: 8192\n"))
+	assert.EqualError(t, err, "kernel settings can not be used in multicast mode")
+	assert.Nil(t, s)
+
+	s, err = createKernelSettings(newConfig("multicast:\n  enabled: true\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, s)
+}
+
+func Test_applyKernelSettings(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	c := &fakeSettingsClient{fakeStatusClient: fakeStatusClient{status: &AuditStatusPayload{Enabled: 1, BacklogLimit: 64, Failure: 1}}}
+	settings := &AuditStatusPayload{Mask: AUDIT_STATUS_BACKLOG_LIMIT | AUDIT_STATUS_FAILURE, BacklogLimit: 8192, Failure: 2}
+
+	assert.Nil(t, applyKernelSettings(c, settings))
+	assert.Equal(t, []*AuditStatusPayload{settings}, c.set)
+	assert.Equal(t, "Kernel backlog_limit set to 8192\nKernel failure set to 2\n", lb.String())
+	assert.Empty(t, elb.String())
+
+	// The kernel not taking the value is an error
+	c.ignore = true
+	c.status.BacklogLimit = 64
+	assert.EqualError(t, applyKernelSettings(c, settings), "Kernel backlog_limit is 64 after setting it to 8192")
+
+	c.setErr = errors.New("operation not permitted")
+	assert.EqualError(t, applyKernelSettings(c, settings), "Failed to apply kernel audit settings. Error: operation not permitted")
+
+	c.setErr = nil
+	c.err = errors.New("testing")
+	assert.EqualError(t, applyKernelSettings(c, settings), "Failed to verify kernel audit settings. Error: testing")
+}
+
+// fakeSettingsClient copies the masked fields of AUDIT_SET into the status, like the kernel does
+type fakeSettingsClient struct {
+	fakeStatusClient
+	set    []*AuditStatusPayload
+	setErr error
+	ignore bool
+}
+
+func (c *fakeSettingsClient) SetStatus(status *AuditStatusPayload) error {
+	c.set = append(c.set, status)
+	if c.setErr != nil || c.ignore {
+		return c.setErr
+	}
+
+	for _, s := range kernelSettings {
+		if status.Mask&s.mask != 0 {
+			*s.field(c.status) = *s.field(status)
+		}
+	}
+
+	return nil
+}
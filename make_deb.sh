@@ -20,7 +20,6 @@ fakeroot fpm -C "$PWD/rootfs" \
     --url "https://github.com/slackhq/go-audit" \
     --vendor "" \
     --description "go-audit is an alternative to the auditd daemon that ships with many distros." \
-    -d "auditd" \
     -m "${CONTACT}" \
     -n "${PACKAGE_NAME}" -v "$VERSION-$BUILD" \
     -p "$OLDESTPWD/${PACKAGE_NAME}_${VERSION}-${BUILD}_amd64.deb" \
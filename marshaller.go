@@ -1,19 +1,29 @@
 package main
 
 import (
-	"os"
+	"net"
 	"regexp"
+	"sort"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 )
 
 const (
 	EVENT_EOE = 1320 // End of multi packet event
+
+	// Events generated by go-audit itself, these live in the range the kernel reserves for audit daemons
+	EVENT_RULES_DRIFT        = 1290 // The kernel audit rules no longer match the config
+	EVENT_KERNEL_STATUS      = 1291 // Periodic report of the kernel audit status
+	EVENT_DEDUP_SUMMARY      = 1292 // Repeats of an event that were held back
+	EVENT_RATE_LIMIT_SUMMARY = 1293 // Message groups dropped by the rate limit
 )
 
 type AuditMarshaller struct {
+	mu            sync.Mutex // Consume, the flusher, reloads and Close all run from different goroutines
 	msgs          map[int]*AuditMessageGroup
-	writer        *AuditWriter
+	writer        GroupWriter
 	lastSeq       int
 	missed        map[int]bool
 	worstLag      int
@@ -23,18 +33,39 @@ type AuditMarshaller struct {
 	logOutOfOrder bool
 	maxOutOfOrder int
 	attempts      int
-	filters       map[string]map[uint16][]*regexp.Regexp // { syscall: { mtype: [regexp, ...] } }
-	extraParsers  ExtraParsers
+	filters       map[string]map[uint16][]AuditFilter // { syscall number or name: { mtype: [filter, ...] } }
+	dropFilters   []*FilterExpression                 // Groups matching any of these are dropped
+	keepFilters   []*FilterExpression                 // If set, groups matching none of these are dropped
+	closed        bool
 }
 
 type AuditFilter struct {
 	messageType uint16
 	regex       *regexp.Regexp
+	cidr        *net.IPNet
 	syscall     string
+	expression  *FilterExpression // Replaces everything above when set
+	keep        bool              // Only keep groups matching expression instead of dropping them
+}
+
+// Checks if a message matches everything the filter was configured with
+func (f AuditFilter) match(msg *AuditMessage) bool {
+	if f.regex != nil && !f.regex.MatchString(msg.Data) {
+		return false
+	}
+
+	if f.cidr != nil {
+		ip := msg.Sockaddr.IP()
+		if ip == nil || !f.cidr.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
 }
 
 // Create a new marshaller
-func NewAuditMarshaller(w *AuditWriter, eventMin uint16, eventMax uint16, trackMessages, logOOO bool, maxOOO int, filters []AuditFilter, extraParsers ExtraParsers) *AuditMarshaller {
+func NewAuditMarshaller(w GroupWriter, eventMin uint16, eventMax uint16, trackMessages, logOOO bool, maxOOO int, filters []AuditFilter) *AuditMarshaller {
 	am := AuditMarshaller{
 		writer:        w,
 		msgs:          make(map[int]*AuditMessageGroup, 5), // It is not typical to have more than 2 message groups at any given time
@@ -44,27 +75,79 @@ func NewAuditMarshaller(w *AuditWriter, eventMin uint16, eventMax uint16, trackM
 		trackMessages: trackMessages,
 		logOutOfOrder: logOOO,
 		maxOutOfOrder: maxOOO,
-		filters:       make(map[string]map[uint16][]*regexp.Regexp),
-		extraParsers:  extraParsers,
+		filters:       groupFilters(filters),
 	}
 
+	am.dropFilters, am.keepFilters = splitExpressions(filters)
+
+	return &am
+}
+
+// groupFilters indexes filters by syscall and message type
+func groupFilters(filters []AuditFilter) map[string]map[uint16][]AuditFilter {
+	grouped := make(map[string]map[uint16][]AuditFilter)
 	for _, filter := range filters {
-		if _, ok := am.filters[filter.syscall]; !ok {
-			am.filters[filter.syscall] = make(map[uint16][]*regexp.Regexp)
+		if filter.expression != nil {
+			continue
 		}
 
-		if _, ok := am.filters[filter.syscall][filter.messageType]; !ok {
-			am.filters[filter.syscall][filter.messageType] = []*regexp.Regexp{}
+		if _, ok := grouped[filter.syscall]; !ok {
+			grouped[filter.syscall] = make(map[uint16][]AuditFilter)
 		}
 
-		am.filters[filter.syscall][filter.messageType] = append(am.filters[filter.syscall][filter.messageType], filter.regex)
+		grouped[filter.syscall][filter.messageType] = append(grouped[filter.syscall][filter.messageType], filter)
 	}
 
-	return &am
+	return grouped
+}
+
+// splitExpressions returns the expressions of the drop and keep filters
+func splitExpressions(filters []AuditFilter) (drop []*FilterExpression, keep []*FilterExpression) {
+	for _, filter := range filters {
+		if filter.expression == nil {
+			continue
+		}
+
+		if filter.keep {
+			keep = append(keep, filter.expression)
+		} else {
+			drop = append(drop, filter.expression)
+		}
+	}
+
+	return drop, keep
+}
+
+// Reload swaps in new filters, pending message groups are kept. swap is called first, while nothing is being
+// consumed, so anything else that has to change at the same time can be swapped in with them.
+// Nothing is changed if swap returns an error
+func (a *AuditMarshaller) Reload(filters []AuditFilter, swap func() error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if swap != nil {
+		if err := swap(); err != nil {
+			return err
+		}
+	}
+
+	a.filters = groupFilters(filters)
+	a.dropFilters, a.keepFilters = splitExpressions(filters)
+	return nil
 }
 
 // Ingests a netlink message and likely prepares it to be logged
 func (a *AuditMarshaller) Consume(nlMsg *syscall.NetlinkMessage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return
+	}
+
+	metricMessagesReceived.WithLabelValues(strconv.Itoa(int(nlMsg.Header.Type))).Inc()
+	defer func() { metricPendingGroups.Set(float64(len(a.msgs))) }()
+
 	aMsg := NewAuditMessage(nlMsg)
 
 	if aMsg.Seq == 0 {
@@ -94,11 +177,79 @@ func (a *AuditMarshaller) Consume(nlMsg *syscall.NetlinkMessage) {
 		// Create a new AuditMessageGroup
 		a.msgs[aMsg.Seq] = NewAuditMessageGroup(aMsg)
 	}
-	a.extraParsers.Parse(aMsg)
 
 	a.flushOld()
 }
 
+// Close completes every pending message group, no matter how recent, in sequence order.
+// Anything consumed afterwards is ignored
+func (a *AuditMarshaller) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return
+	}
+
+	a.closed = true
+
+	seqs := make([]int, 0, len(a.msgs))
+	for seq := range a.msgs {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	for _, seq := range seqs {
+		a.completeMessage(seq)
+	}
+
+	metricPendingGroups.Set(0)
+}
+
+// CompleteDistant completes, in sequence order, every pending message group whose sequence is more than window away
+// from seq. Records read back from a log have no timing to go by and sequences start over after a reboot
+func (a *AuditMarshaller) CompleteDistant(seq int, window int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return
+	}
+
+	var seqs []int
+	for s := range a.msgs {
+		if s < seq-window || s > seq+window {
+			seqs = append(seqs, s)
+		}
+	}
+	sort.Ints(seqs)
+
+	for _, s := range seqs {
+		a.completeMessage(s)
+	}
+
+	metricPendingGroups.Set(float64(len(a.msgs)))
+}
+
+// RunFlusher completes message groups that are old enough every interval, even when no messages arrive to trigger it.
+// Returns once the marshaller is closed
+func (a *AuditMarshaller) RunFlusher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.mu.Lock()
+		if a.closed {
+			a.mu.Unlock()
+			return
+		}
+
+		a.flushOld()
+		metricPendingGroups.Set(float64(len(a.msgs)))
+		a.mu.Unlock()
+	}
+}
+
 // Outputs any messages that are old enough
 // This is because there is no indication of multi message events coming from kaudit
 func (a *AuditMarshaller) flushOld() {
@@ -121,35 +272,55 @@ func (a *AuditMarshaller) completeMessage(seq int) {
 	}
 
 	if a.dropMessage(msg) {
+		metricGroupsFiltered.Inc()
 		delete(a.msgs, seq)
 		return
 	}
 
 	if err := a.writer.Write(msg); err != nil {
 		el.Println("Failed to write message. Error:", err)
-		os.Exit(1)
 	}
 
 	delete(a.msgs, seq)
 }
 
 func (a *AuditMarshaller) dropMessage(msg *AuditMessageGroup) bool {
-	filters, ok := a.filters[msg.Syscall]
-	if !ok {
-		return false
-	}
+	// Filters can use the syscall number or name
+	for _, syscall := range []string{msg.Syscall, msg.SyscallName} {
+		filters, ok := a.filters[syscall]
+		if !ok || syscall == "" {
+			continue
+		}
 
-	for _, msg := range msg.Msgs {
-		if fg, ok := filters[msg.Type]; ok {
-			for _, filter := range fg {
-				if filter.MatchString(msg.Data) {
-					return true
+		for _, msg := range msg.Msgs {
+			if fg, ok := filters[msg.Type]; ok {
+				for _, filter := range fg {
+					if filter.match(msg) {
+						return true
+					}
 				}
 			}
 		}
 	}
 
-	return false
+	if len(a.dropFilters) == 0 && len(a.keepFilters) == 0 {
+		return false
+	}
+
+	g := newFilterGroup(msg)
+	for _, e := range a.dropFilters {
+		if e.Match(g) {
+			return true
+		}
+	}
+
+	for _, e := range a.keepFilters {
+		if e.Match(g) {
+			return false
+		}
+	}
+
+	return len(a.keepFilters) > 0
 }
 
 // Track sequence numbers and log if we suspect we missed a message
@@ -166,14 +337,18 @@ func (a *AuditMarshaller) detectMissing(seq int) {
 			lag := a.lastSeq - missedSeq
 			if lag > a.worstLag {
 				a.worstLag = lag
+				metricWorstLag.Set(float64(lag))
 			}
 
+			metricOutOfOrderSequences.Inc()
+
 			if a.logOutOfOrder {
 				el.Println("Got sequence", missedSeq, "after", lag, "messages. Worst lag so far", a.worstLag, "messages")
 			}
 			delete(a.missed, missedSeq)
 		} else if seq-missedSeq > a.maxOutOfOrder {
 			el.Printf("Likely missed sequence %d, current %d, worst message delay %d\n", missedSeq, seq, a.worstLag)
+			metricMissedSequences.Inc()
 			delete(a.missed, missedSeq)
 		}
 	}
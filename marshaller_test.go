@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"errors"
+	"net"
+	"regexp"
 	"syscall"
 	"testing"
 	"time"
@@ -16,7 +18,7 @@ func TestMarshallerConstants(t *testing.T) {
 
 func TestAuditMarshaller_Consume(t *testing.T) {
 	w := &bytes.Buffer{}
-	m := NewAuditMarshaller(NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, []AuditFilter{}, nil)
+	m := NewAuditMarshaller(NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, []AuditFilter{})
 
 	// Flush group on 1320
 	m.Consume(&syscall.NetlinkMessage{
@@ -142,6 +144,54 @@ func TestAuditMarshaller_completeMessage(t *testing.T) {
 	// assert.Equal(t, "!", elb.String())
 }
 
+func TestAuditMarshaller_dropMessage(t *testing.T) {
+	filters := []AuditFilter{
+		{messageType: 1306, regex: regexp.MustCompile("saddr=0A"), syscall: "bind"},
+		{messageType: 1306, regex: regexp.MustCompile("saddr=02"), syscall: "42"},
+	}
+	m := NewAuditMarshaller(&groupRecorder{}, uint16(1100), uint16(1399), false, false, 0, filters)
+
+	newGroup := func(syscall string, saddr string) *AuditMessageGroup {
+		amg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: syscall})
+		amg.AddMessage(&AuditMessage{Type: 1306, Data: "saddr=" + saddr})
+		return amg
+	}
+
+	// bind is 49 on x86_64 and 200 on aarch64, names match either
+	assert.True(t, m.dropMessage(newGroup("arch=c000003e syscall=49", "0A00")))
+	assert.True(t, m.dropMessage(newGroup("arch=c00000b7 syscall=200", "0A00")))
+	assert.False(t, m.dropMessage(newGroup("arch=c000003e syscall=49", "0200")))
+
+	// numbers still work
+	assert.True(t, m.dropMessage(newGroup("arch=c000003e syscall=42", "0200")))
+	assert.False(t, m.dropMessage(newGroup("arch=c000003e syscall=43", "0200")))
+
+	// cidr filters match the decoded address
+	_, cidr, _ := net.ParseCIDR("10.1.0.0/16")
+	m = NewAuditMarshaller(&groupRecorder{}, uint16(1100), uint16(1399), false, false, 0, []AuditFilter{{messageType: 1306, cidr: cidr, syscall: "connect"}})
+	assert.True(t, m.dropMessage(newGroup("arch=c000003e syscall=42", "020001BB0A0102030000000000000000")))
+	assert.False(t, m.dropMessage(newGroup("arch=c000003e syscall=42", "020001BB0A0202030000000000000000")))
+	assert.False(t, m.dropMessage(newGroup("arch=c000003e syscall=42", "0100")))
+
+	// both have to match when a filter has a regex and a cidr
+	m = NewAuditMarshaller(&groupRecorder{}, uint16(1100), uint16(1399), false, false, 0, []AuditFilter{{messageType: 1306, cidr: cidr, regex: regexp.MustCompile("01BB"), syscall: "connect"}})
+	assert.True(t, m.dropMessage(newGroup("arch=c000003e syscall=42", "020001BB0A0102030000000000000000")))
+	assert.False(t, m.dropMessage(newGroup("arch=c000003e syscall=42", "020001BC0A0102030000000000000000")))
+}
+
+func new1300(seq string) *syscall.NetlinkMessage {
+	return &syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{
+			Len:   uint32(44),
+			Type:  uint16(1300),
+			Flags: uint16(0),
+			Seq:   uint32(0),
+			Pid:   uint32(0),
+		},
+		Data: []byte("audit(10000001:" + seq + "): arch=c000003e syscall=59"),
+	}
+}
+
 func new1320(seq string) *syscall.NetlinkMessage {
 	return &syscall.NetlinkMessage{
 		Header: syscall.NlMsghdr{
@@ -160,3 +210,85 @@ type FailWriter struct{}
 func (f *FailWriter) Write(p []byte) (n int, err error) {
 	return 0, errors.New("derp")
 }
+
+func TestAuditMarshaller_RunFlusher(t *testing.T) {
+	completeAfter = time.Millisecond * 50
+	defer func() { completeAfter = COMPLETE_AFTER }()
+
+	w := &bytes.Buffer{}
+	writer := NewMultiAuditWriter()
+	writer.Add("test", NewAuditWriter(w, 1), 10)
+	m := NewAuditMarshaller(writer, uint16(1100), uint16(1399), false, false, 0, []AuditFilter{})
+
+	done := make(chan struct{})
+	go func() {
+		m.RunFlusher(time.Millisecond * 10)
+		close(done)
+	}()
+
+	// No EOE and nothing else arrives, the group still goes out
+	m.Consume(new1300("1"))
+	assert.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.msgs) == 0
+	}, time.Second, time.Millisecond*10)
+
+	m.Close()
+	<-done
+	writer.Close()
+	assert.Contains(t, w.String(), `"sequence":1`)
+}
+
+func TestAuditMarshaller_dropMessage_Expressions(t *testing.T) {
+	expr := func(s string) *FilterExpression {
+		e, err := parseFilterExpression(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	ps := makeGroup(t, `type=SYSCALL msg=audit(1:1): arch=c000003e syscall=59 uid=0 tty=(none) exe="/usr/bin/ps"`)
+	psTty := makeGroup(t, `type=SYSCALL msg=audit(1:2): arch=c000003e syscall=59 uid=0 tty=pts0 exe="/usr/bin/ps"`)
+	connect := makeGroup(t,
+		`type=SYSCALL msg=audit(1:3): arch=c000003e syscall=42 uid=0`,
+		`type=SOCKADDR msg=audit(1:3): saddr=020001BB0A0102030000000000000000`,
+	)
+
+	// Drop
+	m := NewAuditMarshaller(nil, uint16(1100), uint16(1399), false, false, 0, []AuditFilter{
+		{expression: expr(`syscall_name == "execve" && uid == 0 && exe == "/usr/bin/ps" && !tty`)},
+	})
+	assert.True(t, m.dropMessage(ps))
+	assert.False(t, m.dropMessage(psTty))
+	assert.False(t, m.dropMessage(connect))
+
+	// Fields are parsed for the filter only
+	assert.Nil(t, ps.Msgs[0].Fields)
+
+	// Keep only
+	m = NewAuditMarshaller(nil, uint16(1100), uint16(1399), false, false, 0, []AuditFilter{
+		{expression: expr(`syscall_name == "connect" && !cidr(sockaddr.address, "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16")`), keep: true},
+		{expression: expr(`syscall_name == "execve"`), keep: true},
+	})
+	assert.False(t, m.dropMessage(ps))
+	assert.True(t, m.dropMessage(connect))
+
+	// Drop wins over keep, the classic filters keep working next to expressions
+	m = NewAuditMarshaller(nil, uint16(1100), uint16(1399), false, false, 0, []AuditFilter{
+		{expression: expr(`syscall_name == "execve"`), keep: true},
+		{expression: expr(`tty == "pts0"`)},
+		{syscall: "connect", messageType: 1306, cidr: &net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+	})
+	assert.False(t, m.dropMessage(ps))
+	assert.True(t, m.dropMessage(psTty))
+	assert.True(t, m.dropMessage(connect))
+	assert.Contains(t, m.filters, "connect")
+
+	// Reload swaps them
+	m.Reload([]AuditFilter{{expression: expr(`uid == 0`)}}, nil)
+	assert.True(t, m.dropMessage(ps))
+	assert.Empty(t, m.keepFilters)
+	assert.Empty(t, m.filters)
+}
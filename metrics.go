@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
+)
+
+const METRICS_NAMESPACE = "go_audit"
+
+// metricsRegistry holds every metric go-audit updates while it runs, it is only served if `metrics.enabled` is set
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricMessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "messages_received_total",
+		Help:      "Messages received from the kernel by message type",
+	}, []string{"type"})
+
+	metricReceiveErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "receive_errors_total",
+		Help:      "Errors while receiving messages from the kernel",
+	})
+
+	metricGroupsWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "groups_written_total",
+		Help:      "Message groups handed to the outputs, after filtering, deduplication and rate limiting",
+	})
+
+	metricGroupsFiltered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "groups_filtered_total",
+		Help:      "Completed message groups dropped by a filter",
+	})
+
+	metricPendingGroups = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "pending_groups",
+		Help:      "Message groups waiting to be completed",
+	})
+
+	metricMissedSequences = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "missed_sequences_total",
+		Help:      "Sequence numbers that never showed up and are presumed lost",
+	})
+
+	metricOutOfOrderSequences = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "out_of_order_sequences_total",
+		Help:      "Sequence numbers that showed up after a later one",
+	})
+
+	metricWorstLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "worst_lag_messages",
+		Help:      "Largest number of messages an out of order sequence showed up behind",
+	})
+
+	metricOutputRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "output_retries_total",
+		Help:      "Failed writes to an output that were retried",
+	}, []string{"output"})
+
+	metricOutputFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "output_failures_total",
+		Help:      "Message groups an output failed to write after every attempt",
+	}, []string{"output"})
+
+	metricOutputDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "output_dropped_total",
+		Help:      "Message groups dropped because an output was not keeping up",
+	}, []string{"output"})
+
+	metricEnrichmentTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "enrichment_timeouts_total",
+		Help:      "Message groups that went out without enrichment because the extra parsers took too long",
+	})
+
+	metricGroupsDeduplicated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "groups_deduplicated_total",
+		Help:      "Completed message groups held back because they repeated an earlier one",
+	})
+
+	metricGroupsRateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "groups_rate_limited_total",
+		Help:      "Completed message groups dropped by the rate limit",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		metricMessagesReceived,
+		metricReceiveErrors,
+		metricGroupsWritten,
+		metricGroupsFiltered,
+		metricPendingGroups,
+		metricMissedSequences,
+		metricOutOfOrderSequences,
+		metricWorstLag,
+		metricOutputRetries,
+		metricOutputFailures,
+		metricOutputDropped,
+		metricEnrichmentTimeouts,
+		metricGroupsDeduplicated,
+		metricGroupsRateLimited,
+	)
+}
+
+// AuditStatusClient is the part of the netlink client used to read the kernel audit status
+type AuditStatusClient interface {
+	GetStatus() (*AuditStatusPayload, error)
+}
+
+// kernelCollector asks the kernel for its audit status on every scrape
+type kernelCollector struct {
+	client          AuditStatusClient
+	enabled         *prometheus.Desc
+	failure         *prometheus.Desc
+	lost            *prometheus.Desc
+	backlog         *prometheus.Desc
+	backlogLimit    *prometheus.Desc
+	rateLimit       *prometheus.Desc
+	backlogWaitTime *prometheus.Desc
+}
+
+func newKernelCollector(c AuditStatusClient) *kernelCollector {
+	return &kernelCollector{
+		client: c,
+		enabled: prometheus.NewDesc(
+			prometheus.BuildFQName(METRICS_NAMESPACE, "kernel", "enabled"),
+			"Kernel auditing state, 0 is off, 1 is on and 2 is on and locked", nil, nil,
+		),
+		failure: prometheus.NewDesc(
+			prometheus.BuildFQName(METRICS_NAMESPACE, "kernel", "failure_mode"),
+			"What the kernel does on critical errors, 0 is silent, 1 is printk and 2 is panic", nil, nil,
+		),
+		lost: prometheus.NewDesc(
+			prometheus.BuildFQName(METRICS_NAMESPACE, "kernel", "lost_total"),
+			"Audit messages the kernel dropped since boot", nil, nil,
+		),
+		backlog: prometheus.NewDesc(
+			prometheus.BuildFQName(METRICS_NAMESPACE, "kernel", "backlog"),
+			"Audit messages waiting in the kernel to be delivered", nil, nil,
+		),
+		backlogLimit: prometheus.NewDesc(
+			prometheus.BuildFQName(METRICS_NAMESPACE, "kernel", "backlog_limit"),
+			"Most audit messages the kernel will hold before dropping them", nil, nil,
+		),
+		rateLimit: prometheus.NewDesc(
+			prometheus.BuildFQName(METRICS_NAMESPACE, "kernel", "rate_limit"),
+			"Most audit messages per second the kernel will send, 0 is unlimited", nil, nil,
+		),
+		backlogWaitTime: prometheus.NewDesc(
+			prometheus.BuildFQName(METRICS_NAMESPACE, "kernel", "backlog_wait_time"),
+			"Time in jiffies the kernel waits for the backlog to drain before dropping", nil, nil,
+		),
+	}
+}
+
+func (k *kernelCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- k.enabled
+	ch <- k.failure
+	ch <- k.lost
+	ch <- k.backlog
+	ch <- k.backlogLimit
+	ch <- k.rateLimit
+	ch <- k.backlogWaitTime
+}
+
+func (k *kernelCollector) Collect(ch chan<- prometheus.Metric) {
+	status, err := k.client.GetStatus()
+	if err != nil {
+		el.Printf("Failed to get the kernel audit status. Error: %s\n", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(k.enabled, prometheus.GaugeValue, float64(status.Enabled))
+	ch <- prometheus.MustNewConstMetric(k.failure, prometheus.GaugeValue, float64(status.Failure))
+	ch <- prometheus.MustNewConstMetric(k.lost, prometheus.CounterValue, float64(status.Lost))
+	ch <- prometheus.MustNewConstMetric(k.backlog, prometheus.GaugeValue, float64(status.Backlog))
+	ch <- prometheus.MustNewConstMetric(k.backlogLimit, prometheus.GaugeValue, float64(status.BacklogLimit))
+	ch <- prometheus.MustNewConstMetric(k.rateLimit, prometheus.GaugeValue, float64(status.RateLimit))
+	ch <- prometheus.MustNewConstMetric(k.backlogWaitTime, prometheus.GaugeValue, float64(status.BacklogWaitTime))
+}
+
+// createMetricsServer starts listening for prometheus scrapes, the caller has to call Serve on the returned server
+func createMetricsServer(config *viper.Viper, c AuditStatusClient) (*http.Server, net.Listener, error) {
+	address := config.GetString("metrics.address")
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to listen for metrics on %s. Error: %s", address, err)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		newKernelCollector(c),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle(config.GetString("metrics.path"), promhttp.HandlerFor(
+		prometheus.Gatherers{metricsRegistry, reg},
+		promhttp.HandlerOpts{ErrorLog: el},
+	))
+
+	l.Printf("Serving metrics on %s%s\n", listener.Addr(), config.GetString("metrics.path"))
+	return &http.Server{Handler: mux, ReadHeaderTimeout: time.Second * 10}, listener, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_createMetricsServer(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	// bad address
+	c := viper.New()
+	c.Set("metrics.address", "nope:nope")
+	c.Set("metrics.path", "/metrics")
+	s, ln, err := createMetricsServer(c, &fakeStatusClient{})
+	assert.Regexp(t, "^Failed to listen for metrics on nope:nope. Error: ", err.Error())
+	assert.Nil(t, s)
+	assert.Nil(t, ln)
+
+	c.Set("metrics.address", "127.0.0.1:0")
+	status := &fakeStatusClient{status: &AuditStatusPayload{Lost: 5, Backlog: 2, BacklogLimit: 8192}}
+	s, ln, err = createMetricsServer(c, status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve(ln)
+
+	assert.Equal(t, "Serving metrics on "+ln.Addr().String()+"/metrics\n", lb.String())
+
+	metricGroupsWritten.Inc()
+	body := scrape(t, "http://"+ln.Addr().String()+"/metrics")
+	assert.Contains(t, body, "go_audit_kernel_lost_total 5\n")
+	assert.Contains(t, body, "go_audit_kernel_backlog 2\n")
+	assert.Contains(t, body, "go_audit_kernel_backlog_limit 8192\n")
+	assert.Contains(t, body, "go_audit_groups_written_total ")
+	assert.Contains(t, body, "go_goroutines ")
+	assert.Empty(t, elb.String())
+
+	// kernel errors are logged and the rest is still served
+	status.err = errors.New("testing")
+	body = scrape(t, "http://"+ln.Addr().String()+"/metrics")
+	assert.NotContains(t, body, "go_audit_kernel_lost_total")
+	assert.Contains(t, body, "go_audit_groups_written_total ")
+	assert.Equal(t, "Failed to get the kernel audit status. Error: testing\n", elb.String())
+}
+
+func TestMetrics_Marshaller(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	received := testutil.ToFloat64(metricMessagesReceived.WithLabelValues("1300"))
+	missed := testutil.ToFloat64(metricMissedSequences)
+
+	m := NewAuditMarshaller(&groupRecorder{}, uint16(1300), uint16(1399), true, false, 1, []AuditFilter{})
+	m.Consume(new1300("1"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricPendingGroups))
+
+	m.Consume(new1320("1"))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metricPendingGroups))
+
+	// skip a few sequences so one is presumed missed
+	m.Consume(new1300("4"))
+	m.Consume(new1320("4"))
+
+	assert.Equal(t, received+2, testutil.ToFloat64(metricMessagesReceived.WithLabelValues("1300")))
+	assert.Equal(t, missed+1, testutil.ToFloat64(metricMissedSequences))
+	assert.Empty(t, lb.String())
+	assert.Equal(t, "Likely missed sequence 2, current 4, worst message delay 0\n", elb.String())
+}
+
+func TestMetrics_Outputs(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	failures := testutil.ToFloat64(metricOutputFailures.WithLabelValues("metrics"))
+	retries := testutil.ToFloat64(metricOutputRetries.WithLabelValues("metrics"))
+	written := testutil.ToFloat64(metricGroupsWritten)
+
+	w := NewMultiAuditWriter()
+	w.Add("metrics", NewAuditWriter(&FailWriter{}, 2), 1)
+	w.Write(newSpoolGroup(1))
+	w.Close()
+
+	assert.Equal(t, failures+1, testutil.ToFloat64(metricOutputFailures.WithLabelValues("metrics")))
+	assert.Equal(t, retries+1, testutil.ToFloat64(metricOutputRetries.WithLabelValues("metrics")))
+	assert.Equal(t, written+1, testutil.ToFloat64(metricGroupsWritten))
+	assert.Contains(t, elb.String(), "Failed to write message group 1 to output metrics. Error: derp\n")
+}
+
+func scrape(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+// fakeStatusClient hands out a fixed kernel audit status
+type fakeStatusClient struct {
+	status *AuditStatusPayload
+	err    error
+}
+
+func (c *fakeStatusClient) GetStatus() (*AuditStatusPayload, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return c.status, nil
+}
@@ -0,0 +1,126 @@
+//go:build ignore
+// +build ignore
+
+// mksyscalls generates zsyscalls.go, the syscall and errno name tables for every architecture go-audit knows about.
+// The tables are pulled from the golang.org/x/sys/unix sources in the module cache.
+//
+//	go run mksyscalls.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/format"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Maps the x/sys file suffix to the name of the audit arch constant in syscalls.go
+var arches = []struct {
+	goarch string
+	audit  string
+}{
+	{"amd64", "AUDIT_ARCH_X86_64"},
+	{"386", "AUDIT_ARCH_I386"},
+	{"arm64", "AUDIT_ARCH_AARCH64"},
+	{"arm", "AUDIT_ARCH_ARM"},
+	{"ppc64", "AUDIT_ARCH_PPC64"},
+	{"ppc64le", "AUDIT_ARCH_PPC64LE"},
+	{"s390x", "AUDIT_ARCH_S390X"},
+	{"riscv64", "AUDIT_ARCH_RISCV64"},
+	{"loong64", "AUDIT_ARCH_LOONGARCH64"},
+}
+
+var sysnumRe = regexp.MustCompile(`^\s+SYS_([A-Z0-9_]+)\s+= (\d+)$`)
+var errnoRe = regexp.MustCompile(`^\s+\{(\d+), "(E[A-Z0-9]+)", "[^"]*"\},$`)
+
+func main() {
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "golang.org/x/sys").Output()
+	if err != nil {
+		fatal("Failed to find golang.org/x/sys, is it in go.mod? Error: %s", err)
+	}
+	dir := filepath.Join(strings.TrimSpace(string(out)), "unix")
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "// Code generated by mksyscalls.go; DO NOT EDIT.")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "package main")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "// syscallNames maps an audit arch to its syscall names, indexed by syscall number")
+	fmt.Fprintln(buf, "var syscallNames = map[uint32][]string{")
+
+	for _, arch := range arches {
+		names := map[int]string{}
+		max := 0
+		scan(filepath.Join(dir, "zsysnum_linux_"+arch.goarch+".go"), sysnumRe, func(m []string) {
+			num, _ := strconv.Atoi(m[2])
+			names[num] = strings.ToLower(m[1])
+			if num > max {
+				max = num
+			}
+		})
+
+		fmt.Fprintf(buf, "%s: {\n", arch.audit)
+		for i := 0; i <= max; i++ {
+			fmt.Fprintf(buf, "%q,\n", names[i])
+		}
+		fmt.Fprintln(buf, "},")
+	}
+	fmt.Fprintln(buf, "}")
+	fmt.Fprintln(buf)
+
+	// Error numbers are the same on every arch we support
+	errnos := map[string]int{}
+	scan(filepath.Join(dir, "zerrors_linux_amd64.go"), errnoRe, func(m []string) {
+		num, _ := strconv.Atoi(m[1])
+		errnos[m[2]] = num
+	})
+
+	keys := make([]string, 0, len(errnos))
+	for k := range errnos {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(buf, "// errnoNumbers maps an errno name to its number")
+	fmt.Fprintln(buf, "var errnoNumbers = map[string]int{")
+	for _, k := range keys {
+		fmt.Fprintf(buf, "%q: %d,\n", k, errnos[k])
+	}
+	fmt.Fprintln(buf, "}")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		fatal("Failed to format the generated source. Error: %s", err)
+	}
+
+	if err := os.WriteFile("zsyscalls.go", src, 0644); err != nil {
+		fatal("Failed to write zsyscalls.go. Error: %s", err)
+	}
+}
+
+func scan(file string, re *regexp.Regexp, fn func([]string)) {
+	f, err := os.Open(file)
+	if err != nil {
+		fatal("Failed to open %s. Error: %s", file, err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if m := re.FindStringSubmatch(s.Text()); m != nil {
+			fn(m)
+		}
+	}
+}
+
+func fatal(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"os/user"
 	"strconv"
 	"strings"
@@ -10,6 +11,13 @@ import (
 )
 
 var uidMap = map[string]string{}
+
+// parseMessageFields turns on filling in AuditMessage.Fields, it is set once at startup from `message_fields.enabled`
+var parseMessageFields = false
+
+// completeAfter is how long a message group waits for more messages before it is logged without an EOE, it is set
+// once at startup from `events.complete_after`
+var completeAfter = COMPLETE_AFTER
 var headerEndChar = []byte{")"[0]}
 var headerSepChar = byte(':')
 var spaceChar = byte(' ')
@@ -17,7 +25,8 @@ var spaceChar = byte(' ')
 const (
 	HEADER_MIN_LENGTH = 7               // Minimum length of an audit header
 	HEADER_START_POS  = 6               // Position in the audit header that the data starts
-	COMPLETE_AFTER    = time.Second * 2 // Log a message after this time or EOE
+	COMPLETE_AFTER    = time.Second * 2 // Default time to log a message after if there is no EOE
+	MAX_EXECVE_ARGS   = 1 << 16         // Sanity limit on the size of argv, the kernel doesn't log more than this
 )
 
 type AuditMessage struct {
@@ -26,6 +35,8 @@ type AuditMessage struct {
 	Seq       int    `json:"-"`
 	AuditTime string `json:"-"`
 
+	Fields     map[string]string `json:"fields,omitempty"`
+	Sockaddr   *Sockaddr         `json:"sockaddr,omitempty"`
 	Containers map[string]string `json:"containers,omitempty"`
 	Extras     *AuditExtras      `json:"extras,omitempty"`
 }
@@ -35,12 +46,17 @@ type AuditExtras struct {
 }
 
 type AuditMessageGroup struct {
-	Seq           int               `json:"sequence"`
-	AuditTime     string            `json:"timestamp"`
-	CompleteAfter time.Time         `json:"-"`
-	Msgs          []*AuditMessage   `json:"messages"`
-	UidMap        map[string]string `json:"uid_map"`
-	Syscall       string            `json:"-"`
+	Seq               int               `json:"sequence"`
+	AuditTime         string            `json:"timestamp"`
+	CompleteAfter     time.Time         `json:"-"`
+	Msgs              []*AuditMessage   `json:"messages"`
+	UidMap            map[string]string `json:"uid_map"`
+	Arch              string            `json:"arch,omitempty"`
+	SyscallName       string            `json:"syscall_name,omitempty"`
+	Argv              []string          `json:"argv,omitempty"`
+	Proctitle         string            `json:"proctitle,omitempty"`
+	EnrichmentTimeout bool              `json:"enrichment_timeout,omitempty"` // The extra parsers did not finish in time
+	Syscall           string            `json:"-"`
 }
 
 // Creates a new message group from the details parsed from the message
@@ -49,7 +65,7 @@ func NewAuditMessageGroup(am *AuditMessage) *AuditMessageGroup {
 	amg := &AuditMessageGroup{
 		Seq:           am.Seq,
 		AuditTime:     am.AuditTime,
-		CompleteAfter: time.Now().Add(COMPLETE_AFTER),
+		CompleteAfter: time.Now().Add(completeAfter),
 		UidMap:        make(map[string]string, 2), // Usually only 2 individual uids per execve
 		Msgs:          make([]*AuditMessage, 0, 6),
 	}
@@ -58,15 +74,33 @@ func NewAuditMessageGroup(am *AuditMessage) *AuditMessageGroup {
 	return amg
 }
 
+// Creates a message group for an event generated by go-audit, data should be in the usual key=value format
+func NewSyntheticMessageGroup(msgType uint16, data string) *AuditMessageGroup {
+	now := time.Now()
+	aTime := fmt.Sprintf("%d.%03d", now.Unix(), now.Nanosecond()/int(time.Millisecond))
+
+	return NewAuditMessageGroup(&AuditMessage{
+		Type:      msgType,
+		Data:      fmt.Sprintf("audit(%s:0): %s", aTime, data),
+		AuditTime: aTime,
+	})
+}
+
 // Creates a new go-audit message from a netlink message
 func NewAuditMessage(nlm *syscall.NetlinkMessage) *AuditMessage {
 	aTime, seq := parseAuditHeader(nlm)
-	return &AuditMessage{
+	am := &AuditMessage{
 		Type:      nlm.Header.Type,
 		Data:      string(nlm.Data),
 		Seq:       seq,
 		AuditTime: aTime,
 	}
+
+	if parseMessageFields {
+		am.Fields = parseFields(am.Type, am.Data)
+	}
+
+	return am
 }
 
 // Gets the timestamp and audit sequence id from a netlink message
@@ -93,10 +127,22 @@ func parseAuditHeader(msg *syscall.NetlinkMessage) (time string, seq int) {
 
 // Add a new message to the current message group
 func (amg *AuditMessageGroup) AddMessage(am *AuditMessage) {
+	// Messages that didn't come from NewAuditMessage may not have been parsed yet
+	if parseMessageFields && am.Fields == nil {
+		am.Fields = parseFields(am.Type, am.Data)
+	}
+
 	amg.Msgs = append(amg.Msgs, am)
 	//TODO: need to find more message types that won't contain uids, also make these constants
 	switch am.Type {
-	case 1309, 1307, 1306:
+	case 1309:
+		amg.parseExecve(am)
+	case 1327:
+		amg.parseProctitle(am)
+	case 1306:
+		// Don't map uids here
+		am.Sockaddr = parseSockaddr(findValue(am.Data, "saddr="))
+	case 1307:
 		// Don't map uids here
 	case 1300:
 		amg.findSyscall(am)
@@ -169,6 +215,85 @@ func (amg *AuditMessageGroup) findSyscall(am *AuditMessage) {
 	}
 
 	amg.Syscall = data[start : start+end]
+
+	// Syscall numbers differ between architectures, the record tells us which table to use
+	arch, err := strconv.ParseUint(findValue(data, "arch="), 16, 32)
+	if err != nil {
+		return
+	}
+
+	if name, ok := archNames[uint32(arch)]; ok {
+		amg.Arch = name
+	} else {
+		amg.Arch = strconv.FormatUint(arch, 16)
+	}
+
+	if num, err := strconv.Atoi(amg.Syscall); err == nil {
+		amg.SyscallName = syscallName(uint32(arch), num)
+	}
+}
+
+// Returns the unquoted value following key, key must include the = sign and start the field
+func findValue(data string, key string) string {
+	start := 0
+	for {
+		i := strings.Index(data[start:], key)
+		if i < 0 {
+			return ""
+		}
+
+		start += i
+		if start == 0 || data[start-1] == spaceChar {
+			break
+		}
+		start += len(key)
+	}
+
+	start += len(key)
+	end := strings.IndexByte(data[start:], spaceChar)
+	if end < 0 {
+		end = len(data) - start
+	}
+
+	return data[start : start+end]
+}
+
+// Reassembles the decoded arguments from an EXECVE record. Long argument lists can span multiple records and long
+// arguments are split into chunks, both arrive in order
+func (amg *AuditMessageGroup) parseExecve(am *AuditMessage) {
+	eachField(am.Data, func(key, value string, quoted bool) {
+		if key == "argc" {
+			if argc, err := strconv.Atoi(value); err == nil && argc > len(amg.Argv) && argc <= MAX_EXECVE_ARGS {
+				amg.Argv = append(amg.Argv, make([]string, argc-len(amg.Argv))...)
+			}
+			return
+		}
+
+		arg, chunk, ok := parseExecveArgKey(key)
+		if !ok || arg >= MAX_EXECVE_ARGS {
+			return
+		}
+
+		if arg >= len(amg.Argv) {
+			amg.Argv = append(amg.Argv, make([]string, arg+1-len(amg.Argv))...)
+		}
+
+		value = decodeFieldValue(am.Type, key, value, quoted)
+		if chunk < 0 {
+			amg.Argv[arg] = value
+		} else {
+			amg.Argv[arg] += value
+		}
+	})
+}
+
+// Decodes the process title from a PROCTITLE record
+func (amg *AuditMessageGroup) parseProctitle(am *AuditMessage) {
+	eachField(am.Data, func(key, value string, quoted bool) {
+		if key == "proctitle" {
+			amg.Proctitle = decodeFieldValue(am.Type, key, value, quoted)
+		}
+	})
 }
 
 // Gets a username for a user id
@@ -75,6 +75,66 @@ func TestAuditMessageGroup_AddMessage(t *testing.T) {
 	assert.Equal(t, 1, len(amg.UidMap), "Incorrect uid mapping count")
 }
 
+func TestAuditMessageGroup_findSyscall(t *testing.T) {
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "arch=c000003e syscall=59 success=yes"})
+	assert.Equal(t, "59", amg.Syscall)
+	assert.Equal(t, "x86_64", amg.Arch)
+	assert.Equal(t, "execve", amg.SyscallName)
+
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "arch=40000003 syscall=11 success=yes"})
+	assert.Equal(t, "i386", amg.Arch)
+	assert.Equal(t, "execve", amg.SyscallName)
+
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "arch=c00000b7 syscall=221"})
+	assert.Equal(t, "aarch64", amg.Arch)
+	assert.Equal(t, "execve", amg.SyscallName)
+
+	// Unknown arches are kept as is
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "arch=1234 syscall=59"})
+	assert.Equal(t, "1234", amg.Arch)
+	assert.Equal(t, "", amg.SyscallName)
+
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=59"})
+	assert.Equal(t, "59", amg.Syscall)
+	assert.Equal(t, "", amg.Arch)
+}
+
+func Test_findValue(t *testing.T) {
+	assert.Equal(t, "c000003e", findValue("arch=c000003e syscall=59", "arch="))
+	assert.Equal(t, "59", findValue("arch=c000003e syscall=59", "syscall="))
+	assert.Equal(t, "1", findValue("subarch=2 arch=1", "arch="))
+	assert.Equal(t, "", findValue("subarch=2", "arch="))
+}
+
+func TestAuditMessageGroup_parseExecve(t *testing.T) {
+	amg := &AuditMessageGroup{UidMap: map[string]string{}}
+
+	// Hex encoded and chunked arguments, split across records
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `argc=4 a0="ls" a1=2D6C2061 a2_len=10 a2[0]="hello" a2[1]=20776F726C`})
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `a2[2]="d" a3=(null)`})
+	assert.Equal(t, []string{"ls", "-l a", "hello world", ""}, amg.Argv)
+
+	// argc reserves room for arguments that never showed up
+	amg = &AuditMessageGroup{UidMap: map[string]string{}}
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `argc=2 a0="id"`})
+	assert.Equal(t, []string{"id", ""}, amg.Argv)
+
+	// Garbage is ignored
+	amg = &AuditMessageGroup{UidMap: map[string]string{}}
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `argc=nope a[0]="x" ab="y" a1[x]="z" a99999999="big"`})
+	assert.Nil(t, amg.Argv)
+}
+
+func TestAuditMessageGroup_parseProctitle(t *testing.T) {
+	amg := &AuditMessageGroup{UidMap: map[string]string{}}
+	amg.AddMessage(&AuditMessage{Type: 1327, Data: `proctitle=2F62696E2F7368002D63006563686F2075696400`})
+	assert.Equal(t, "/bin/sh -c echo uid", amg.Proctitle)
+	assert.Empty(t, amg.UidMap, "uids should not be mapped for PROCTITLE")
+
+	amg.AddMessage(&AuditMessage{Type: 1327, Data: `proctitle="bash"`})
+	assert.Equal(t, "bash", amg.Proctitle)
+}
+
 func TestNewAuditMessageGroup(t *testing.T) {
 	uidMap = make(map[string]string, 0)
 	m := &AuditMessage{
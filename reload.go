@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/viper"
+)
+
+// Reloader swaps in a new config on SIGHUP. Filters, outputs, extra parsers and rules are replaced, the netlink socket
+// stays open and pending message groups are kept. Everything else needs a restart to change
+type Reloader struct {
+	configFile string
+	config     *viper.Viper
+	client     AuditRuleClient
+	writer     *MultiAuditWriter
+	marshaller *AuditMarshaller
+	enricher   *Enricher
+	checker    *RuleChecker // nil if rules_check is disabled
+}
+
+func NewReloader(configFile string, config *viper.Viper, client AuditRuleClient, writer *MultiAuditWriter, marshaller *AuditMarshaller, enricher *Enricher, checker *RuleChecker) *Reloader {
+	return &Reloader{
+		configFile: configFile,
+		config:     config,
+		client:     client,
+		writer:     writer,
+		marshaller: marshaller,
+		enricher:   enricher,
+		checker:    checker,
+	}
+}
+
+// Run reloads the config every time we get a SIGHUP, it never returns
+func (r *Reloader) Run() {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+
+	for range sigc {
+		l.Println("Reloading the config")
+		if err := r.Reload(); err != nil {
+			el.Printf("Failed to reload the config, keeping the old one. Error: %s\n", err)
+			continue
+		}
+
+		l.Println("Reloaded the config")
+	}
+}
+
+// Reload reads the config file again and swaps in the new config. If anything in it is invalid an error is returned
+// and the old config stays in place
+func (r *Reloader) Reload() error {
+	config, err := loadConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+
+	// Check everything we can before touching the kernel or the outputs
+	if config.GetBool("multicast.enabled") != r.config.GetBool("multicast.enabled") {
+		return fmt.Errorf("multicast.enabled can not be changed without a restart")
+	}
+
+	filters, err := createFilters(config)
+	if err != nil {
+		return err
+	}
+
+	extraParsers, err := createExtraParsers(config)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := parseRules(config); err != nil {
+		return err
+	}
+
+	spooled := r.config.GetBool("spool.enabled")
+
+	var outputs *MultiAuditWriter
+	if !spooled {
+		if outputs, err = createOutput(config); err != nil {
+			return err
+		}
+	}
+
+	if err := r.setRules(config); err != nil {
+		if outputs != nil {
+			outputs.Close()
+		}
+
+		r.restoreRules()
+		return err
+	}
+
+	// The outputs are swapped without the marshaller lock, an output blocked on a full spool holds it until the old
+	// outputs are closed
+	if spooled {
+		// Two spools can not share a directory, the old outputs have to let go of theirs before the new ones are
+		// created. Unsent message groups stay on disk and are picked up by the new outputs
+		r.writer.Swap(func(old *MultiAuditWriter) *MultiAuditWriter {
+			old.Close()
+
+			if outputs, err = createOutput(config); err != nil {
+				return r.restoreOutputs()
+			}
+
+			return outputs
+		})
+
+		if err != nil {
+			r.restoreRules()
+			return err
+		}
+	} else {
+		// Let the old outputs drain after the new ones took over
+		r.writer.Replace(outputs).Close()
+	}
+
+	r.marshaller.Reload(filters, func() error {
+		r.enricher.SetParsers(extraParsers)
+		return nil
+	})
+
+	r.config = config
+	return nil
+}
+
+func (r *Reloader) setRules(config *viper.Viper) error {
+	if r.checker == nil {
+		return setRules(config, r.client)
+	}
+
+	expected, err := createExpectedRules(config)
+	if err != nil {
+		return err
+	}
+
+	return r.checker.Reload(func() error {
+		return setRules(config, r.client)
+	}, expected, createRuleReapply(config, r.client))
+}
+
+// restoreRules puts back the rules from the old config after the new ones failed to load
+func (r *Reloader) restoreRules() {
+	if err := r.setRules(r.config); err != nil {
+		el.Printf("Failed to restore the previous audit rules. Error: %s\n", err)
+	}
+}
+
+// restoreOutputs opens the outputs from the old config again after they were closed to make way for new ones.
+// They worked a moment ago, if they don't now nothing is written until the next reload rather than exiting
+func (r *Reloader) restoreOutputs() *MultiAuditWriter {
+	outputs, err := createOutput(r.config)
+	if err != nil {
+		el.Printf("Failed to restore the previous outputs, nothing is written until the config is reloaded. Error: %s\n", err)
+		return NewMultiAuditWriter()
+	}
+
+	return outputs
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloader_Reload(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	dir := t.TempDir()
+	configFile := path.Join(dir, "go-audit.yaml")
+	writeConfig := func(rule, syscall, output string, extra string) {
+		u, _ := user.LookupId(strconv.Itoa(os.Getuid()))
+		g, _ := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+		config := fmt.Sprintf(`
+rules:
+  - %s
+filters:
+  - syscall: %s
+    message_type: 1306
+    regex: saddr=01
+output:
+  file:
+    enabled: true
+    attempts: 1
+    path: %s
+    mode: 0600
+    user: %s
+    group: %s
+%s`, rule, syscall, path.Join(dir, output), u.Username, g.Name, extra)
+		assert.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	}
+
+	writeConfig("-a exit,always -S execve", "connect", "a.log", "")
+	config, err := loadConfig(configFile)
+	assert.Nil(t, err)
+
+	writer, err := createOutput(config)
+	assert.Nil(t, err)
+
+	filters, err := createFilters(config)
+	assert.Nil(t, err)
+
+	c := &fakeRuleClient{}
+	m := NewAuditMarshaller(writer, uint16(1100), uint16(1399), false, false, 0, filters)
+	e := NewEnricher(writer, nil, 1, 1, time.Second)
+	r := NewReloader(configFile, config, c, writer, m, e, nil)
+
+	// Leave a message group pending across the reload
+	m.Consume(new1300("5"))
+
+	writeConfig("-w /etc/passwd -p wa", "bind", "b.log", "")
+	assert.Nil(t, r.Reload())
+	assert.Equal(t, []string{"list", "add"}, c.calls)
+	assert.Contains(t, m.filters, "bind")
+	assert.NotContains(t, m.filters, "connect")
+	assert.Len(t, m.msgs, 1)
+
+	// An invalid config is rejected before anything is touched
+	writeConfig("-a -3 -4", "connect", "c.log", "")
+	assert.EqualError(t, r.Reload(), "Failed to parse rule #1. Error: Unknown list or action `-3` in -a -3")
+
+	writeConfig("-a exit,always -S execve", "nope", "c.log", "")
+	assert.EqualError(t, r.Reload(), "`syscall` in filter 1 is not a known syscall name; Value: `nope`")
+
+	writeConfig("-a exit,always -S execve", "connect", "c.log", "multicast:\n  enabled: true\n")
+	assert.EqualError(t, r.Reload(), "multicast.enabled can not be changed without a restart")
+
+	assert.Equal(t, []string{"list", "add"}, c.calls)
+	assert.Contains(t, m.filters, "bind")
+
+	// Rules the kernel refuses leave the old config in place and the old rules are put back
+	c.addErr = errors.New("testing rule")
+	writeConfig("-a exit,always -S execve", "connect", "c.log", "")
+	assert.EqualError(t, r.Reload(), "Failed to add rule #1. Error: testing rule")
+	assert.Equal(t, []string{"list", "add", "list", "add", "list", "add"}, c.calls)
+	assert.Contains(t, m.filters, "bind")
+	assert.Contains(t, elb.String(), "Failed to restore the previous audit rules. Error: Failed to add rule #1. Error: testing rule\n")
+
+	// The pending message group goes out to the new output
+	m.Consume(new1320("5"))
+	writer.Close()
+
+	a, _ := os.ReadFile(path.Join(dir, "a.log"))
+	b, _ := os.ReadFile(path.Join(dir, "b.log"))
+	cl, _ := os.ReadFile(path.Join(dir, "c.log"))
+	assert.Empty(t, string(a))
+	assert.Contains(t, string(b), `"sequence":5`)
+	assert.Empty(t, string(cl))
+	assert.Contains(t, lb.String(), "Added audit rule #1\n")
+}
+
+func TestReloader_ReloadSpooled(t *testing.T) {
+	_, _ = hookLogger()
+	defer resetLogger()
+
+	dir := t.TempDir()
+	configFile := path.Join(dir, "go-audit.yaml")
+	writeConfig := func(output string) {
+		u, _ := user.LookupId(strconv.Itoa(os.Getuid()))
+		g, _ := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+		config := fmt.Sprintf(`
+rules:
+  - -a exit,always -S execve
+spool:
+  enabled: true
+  directory: %s
+output:
+  file:
+    enabled: true
+    attempts: 1
+    path: %s
+    mode: 0600
+    user: %s
+    group: %s
+`, path.Join(dir, "spool"), path.Join(dir, output), u.Username, g.Name)
+		assert.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	}
+
+	writeConfig("a.log")
+	config, err := loadConfig(configFile)
+	assert.Nil(t, err)
+
+	writer, err := createOutput(config)
+	assert.Nil(t, err)
+
+	m := NewAuditMarshaller(writer, uint16(1100), uint16(1399), false, false, 0, nil)
+	r := NewReloader(configFile, config, &fakeRuleClient{}, writer, m, NewEnricher(writer, nil, 1, 1, time.Second), nil)
+
+	// The spool directory is handed over to the new output
+	writeConfig("b.log")
+	assert.Nil(t, r.Reload())
+	assert.Equal(t, 1, writer.Len())
+
+	m.Consume(new1300("7"))
+	m.Consume(new1320("7"))
+	assert.Eventually(t, func() bool {
+		b, _ := os.ReadFile(path.Join(dir, "b.log"))
+		return strings.Contains(string(b), `"sequence":7`)
+	}, time.Second*5, time.Millisecond*10)
+	writer.Close()
+}
+
+func TestReloader_ReloadSpoolBlocked(t *testing.T) {
+	hookLogger()
+	defer resetLogger()
+
+	dir := t.TempDir()
+	configFile := path.Join(dir, "go-audit.yaml")
+	u, _ := user.LookupId(strconv.Itoa(os.Getuid()))
+	g, _ := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+	assert.Nil(t, os.WriteFile(configFile, []byte(fmt.Sprintf(`
+rules:
+  - -a exit,always -S execve
+spool:
+  enabled: true
+  directory: %s
+  full_policy: block
+output:
+  file:
+    enabled: true
+    attempts: 1
+    path: %s
+    mode: 0600
+    user: %s
+    group: %s
+`, path.Join(dir, "spool"), path.Join(dir, "b.log"), u.Username, g.Name)), 0600))
+
+	config, err := loadConfig(configFile)
+	assert.Nil(t, err)
+
+	// The output is down and its spool is full, so the marshaller is stuck writing to it
+	s, err := OpenSpool(path.Join(dir, "spool", "file"), SPOOL_MIN_SEGMENT_SIZE*2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := NewMultiAuditWriter()
+	writer.AddSpooled("file", NewAuditWriter(&flakyWriter{failures: 1000}, 1), s, 0)
+	m := NewAuditMarshaller(writer, uint16(1100), uint16(1399), false, false, 0, nil)
+
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		for i := 1; i <= 30; i++ {
+			seq := strconv.Itoa(i)
+			msg := new1300(seq)
+			msg.Data = append(msg.Data, ` comm="`+strings.Repeat("a", 8192)+`"`...)
+			m.Consume(msg)
+			m.Consume(new1320(seq))
+		}
+	}()
+
+	select {
+	case <-consumed:
+		t.Fatal("The marshaller should have blocked on the full spool")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Reloading is how the output would be fixed, it must not wait on the marshaller
+	r := NewReloader(configFile, config, &fakeRuleClient{}, writer, m, NewEnricher(writer, nil, 1, 1, time.Second), nil)
+	reloaded := make(chan error)
+	go func() { reloaded <- r.Reload() }()
+
+	select {
+	case err := <-reloaded:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reload is stuck behind the full spool")
+	}
+
+	// What piled up in the spool goes out through the new output
+	<-consumed
+	assert.Eventually(t, func() bool {
+		b, _ := os.ReadFile(path.Join(dir, "b.log"))
+		return strings.Contains(string(b), `"sequence":1,`) && strings.Contains(string(b), `"sequence":30,`)
+	}, time.Second*5, time.Millisecond*10)
+	writer.Close()
+}
+
+func TestReloader_ReloadSpooledRestoreFails(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	dir := t.TempDir()
+	configFile := path.Join(dir, "go-audit.yaml")
+	writeConfig := func(output, owner string) {
+		g, _ := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+		assert.Nil(t, os.WriteFile(configFile, []byte(fmt.Sprintf(`
+rules:
+  - -a exit,always -S execve
+spool:
+  enabled: true
+  directory: %s
+output:
+  file:
+    enabled: true
+    attempts: 1
+    path: %s
+    mode: 0600
+    user: %s
+    group: %s
+`, path.Join(dir, "spool"), output, owner, g.Name)), 0600))
+	}
+
+	u, _ := user.LookupId(strconv.Itoa(os.Getuid()))
+	assert.Nil(t, os.Mkdir(path.Join(dir, "logs"), 0700))
+	writeConfig(path.Join(dir, "logs", "a.log"), u.Username)
+	config, err := loadConfig(configFile)
+	assert.Nil(t, err)
+
+	writer, err := createOutput(config)
+	assert.Nil(t, err)
+
+	m := NewAuditMarshaller(writer, uint16(1100), uint16(1399), false, false, 0, nil)
+	r := NewReloader(configFile, config, &fakeRuleClient{}, writer, m, NewEnricher(writer, nil, 1, 1, time.Second), nil)
+
+	// Neither the new output nor the old one can be opened, we keep running without outputs
+	assert.Nil(t, os.RemoveAll(path.Join(dir, "logs")))
+	writeConfig(path.Join(dir, "b.log"), "go-audit-nope")
+	assert.EqualError(t, r.Reload(), "Could not find uid for user go-audit-nope. Error: user: unknown user go-audit-nope")
+	assert.Contains(t, elb.String(), "Failed to restore the previous outputs, nothing is written until the config is reloaded. Error: ")
+	assert.Equal(t, 0, writer.Len())
+
+	// Fixing the config brings them back
+	writeConfig(path.Join(dir, "b.log"), u.Username)
+	assert.Nil(t, r.Reload())
+	assert.Equal(t, 1, writer.Len())
+	writer.Close()
+}
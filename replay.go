@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	REPLAY_WINDOW   = 100         // Sequence numbers this far apart can't belong to the same event, complete the older one
+	REPLAY_MAX_LINE = 1024 * 1024 // Longest line we will read from a replay file
+)
+
+// recordTypes maps the names auditd writes in `type=` to message types, from linux/audit.h and libaudit.h
+var recordTypes = map[string]uint16{
+	"USER": 1005, "LOGIN": 1006,
+	"USER_AUTH": 1100, "USER_ACCT": 1101, "USER_MGMT": 1102, "CRED_ACQ": 1103, "CRED_DISP": 1104,
+	"USER_START": 1105, "USER_END": 1106, "USER_AVC": 1107, "USER_CHAUTHTOK": 1108, "USER_ERR": 1109,
+	"CRED_REFR": 1110, "USYS_CONFIG": 1111, "USER_LOGIN": 1112, "USER_LOGOUT": 1113, "ADD_USER": 1114,
+	"DEL_USER": 1115, "ADD_GROUP": 1116, "DEL_GROUP": 1117, "DAC_CHECK": 1118, "CHGRP_ID": 1119, "TEST": 1120,
+	"TRUSTED_APP": 1121, "USER_SELINUX_ERR": 1122, "USER_CMD": 1123, "USER_TTY": 1124, "CHUSER_ID": 1125,
+	"GRP_AUTH": 1126, "SYSTEM_BOOT": 1127, "SYSTEM_SHUTDOWN": 1128, "SYSTEM_RUNLEVEL": 1129,
+	"SERVICE_START": 1130, "SERVICE_STOP": 1131, "GRP_MGMT": 1132, "GRP_CHAUTHTOK": 1133, "MAC_CHECK": 1134,
+	"ACCT_LOCK": 1135, "ACCT_UNLOCK": 1136, "USER_DEVICE": 1137, "SOFTWARE_UPDATE": 1138,
+	"DAEMON_START": 1200, "DAEMON_END": 1201, "DAEMON_ABORT": 1202, "DAEMON_CONFIG": 1203,
+	"DAEMON_ROTATE": 1205, "DAEMON_RESUME": 1206, "DAEMON_ACCEPT": 1207, "DAEMON_CLOSE": 1208, "DAEMON_ERR": 1209,
+	"SYSCALL": 1300, "PATH": 1302, "IPC": 1303, "SOCKETCALL": 1304, "CONFIG_CHANGE": 1305, "SOCKADDR": 1306,
+	"CWD": 1307, "EXECVE": 1309, "IPC_SET_PERM": 1311, "MQ_OPEN": 1312, "MQ_SENDRECV": 1313, "MQ_NOTIFY": 1314,
+	"MQ_GETSETATTR": 1315, "KERNEL_OTHER": 1316, "FD_PAIR": 1317, "OBJ_PID": 1318, "TTY": 1319, "EOE": 1320,
+	"BPRM_FCAPS": 1321, "CAPSET": 1322, "MMAP": 1323, "NETFILTER_PKT": 1324, "NETFILTER_CFG": 1325,
+	"SECCOMP": 1326, "PROCTITLE": 1327, "FEATURE_CHANGE": 1328, "REPLACE": 1329, "KERN_MODULE": 1330,
+	"FANOTIFY": 1331, "TIME_INJOFFSET": 1332, "TIME_ADJNTPVAL": 1333, "BPF": 1334, "EVENT_LISTENER": 1335,
+	"URINGOP": 1336, "OPENAT2": 1337, "DM_CTRL": 1338, "DM_EVENT": 1339,
+	"AVC": 1400, "SELINUX_ERR": 1401, "AVC_PATH": 1402, "MAC_POLICY_LOAD": 1403, "MAC_STATUS": 1404,
+	"MAC_CONFIG_CHANGE": 1405, "MAC_UNLBL_ALLOW": 1406, "MAC_CIPSOV4_ADD": 1407, "MAC_CIPSOV4_DEL": 1408,
+	"MAC_MAP_ADD": 1409, "MAC_MAP_DEL": 1410, "MAC_IPSEC_ADDSA": 1411, "MAC_IPSEC_DELSA": 1412,
+	"MAC_IPSEC_ADDSPD": 1413, "MAC_IPSEC_DELSPD": 1414, "MAC_IPSEC_EVENT": 1415, "MAC_UNLBL_STCADD": 1416,
+	"MAC_UNLBL_STCDEL": 1417, "MAC_CALIPSO_ADD": 1418, "MAC_CALIPSO_DEL": 1419,
+	"ANOM_PROMISCUOUS": 1700, "ANOM_ABEND": 1701, "ANOM_LINK": 1702, "ANOM_CREAT": 1703,
+	"INTEGRITY_DATA": 1800, "INTEGRITY_METADATA": 1801, "INTEGRITY_STATUS": 1802, "INTEGRITY_HASH": 1803,
+	"INTEGRITY_PCR": 1804, "INTEGRITY_RULE": 1805, "INTEGRITY_EVM_XATTR": 1806, "INTEGRITY_POLICY_RULE": 1807,
+	"KERNEL": 2000,
+}
+
+// runReplay sends the records in file, or stdin if file is `-`, through the filters, extra parsers and outputs as if
+// they came from the kernel. Nothing is done with netlink or the audit rules.
+// file can be an audit log or a capture file, captures are replayed with the time between frames kept if timing is set
+func runReplay(config *viper.Viper, writer *MultiAuditWriter, file string, timing bool) error {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return fmt.Errorf("Failed to open replay file. Error: %s", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(CAPTURE_MAGIC))
+	capture := isCapture(magic)
+
+	filters, err := createFilters(config)
+	if err != nil {
+		return err
+	}
+
+	extraParsers, err := createExtraParsers(config)
+	if err != nil {
+		return err
+	}
+
+	enricher := NewEnricher(
+		writer,
+		extraParsers,
+		config.GetInt("enrichment.workers"),
+		config.GetInt("enrichment.queue_size"),
+		config.GetDuration("enrichment.timeout"),
+	)
+
+	throttle, err := createThrottle(config, enricher)
+	if err != nil {
+		return err
+	}
+
+	// Old events go through far faster than they happened, the clock would squash them into a few windows
+	throttle.UseEventTime()
+	go throttle.Run()
+
+	// Log files routinely skip sequence numbers, tracking them would only be noise. Captures have every frame
+	marshaller := NewAuditMarshaller(
+		throttle,
+		uint16(config.GetInt("events.min")),
+		uint16(config.GetInt("events.max")),
+		capture && config.GetBool("message_tracking.enabled"),
+		capture && config.GetBool("message_tracking.log_out_of_order"),
+		config.GetInt("message_tracking.max_out_of_order"),
+		filters,
+	)
+
+	var records, skipped int
+	if capture {
+		if timing {
+			go marshaller.RunFlusher(completeAfter / 2)
+		}
+		records, err = replayCapture(br, marshaller, timing)
+	} else {
+		records, skipped, err = replay(br, marshaller)
+	}
+
+	marshaller.Close()
+	throttle.Close()
+	enricher.Close()
+	writer.Close()
+
+	if err != nil {
+		return fmt.Errorf("Failed to read replay file. Error: %s", err)
+	}
+
+	if capture {
+		l.Printf("Replayed %d frames from %s\n", records, file)
+	} else {
+		l.Printf("Replayed %d records from %s, skipped %d\n", records, file, skipped)
+	}
+	return nil
+}
+
+// replayCapture feeds every frame in a capture file through the marshaller. With timing the frames are spaced out
+// like they were received and message groups complete on their own, otherwise they go as fast as possible and
+// groups complete the same way they do when replaying a log
+func replayCapture(r io.Reader, m *AuditMarshaller, timing bool) (frames int, err error) {
+	cr, err := NewCaptureReader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	var last time.Time
+	for {
+		msg, at, err := cr.Next()
+		if err == io.EOF {
+			return frames, nil
+		} else if err != nil {
+			return frames, err
+		}
+
+		if timing && !last.IsZero() && at.After(last) {
+			time.Sleep(at.Sub(last))
+		}
+		last = at
+
+		// Consume strips the header so grab the sequence first
+		_, seq := parseAuditHeader(&syscall.NetlinkMessage{Data: msg.Data})
+
+		frames++
+		m.Consume(msg)
+		if !timing {
+			m.CompleteDistant(seq, REPLAY_WINDOW)
+		}
+	}
+}
+
+// replay feeds every record in r through the marshaller. Anything that isn't a record, like the `----` separators
+// ausearch prints, is ignored. Records we can't make sense of are logged and counted as skipped
+func replay(r io.Reader, m *AuditMarshaller) (records int, skipped int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, MAX_AUDIT_MESSAGE_LENGTH), REPLAY_MAX_LINE)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if !strings.HasPrefix(text, "type=") && !strings.HasPrefix(text, "node=") {
+			continue
+		}
+
+		msg, err := parseReplayRecord(text)
+		if err != nil {
+			el.Printf("Skipping line %d. Error: %s\n", line, err)
+			skipped++
+			continue
+		}
+
+		// Consume strips the header so grab the sequence first
+		_, seq := parseAuditHeader(&syscall.NetlinkMessage{Data: msg.Data})
+
+		records++
+		m.Consume(msg)
+		m.CompleteDistant(seq, REPLAY_WINDOW)
+	}
+
+	return records, skipped, scanner.Err()
+}
+
+// parseReplayRecord turns a `type=SYSCALL msg=audit(...): ...` line into the netlink message the kernel would have sent
+func parseReplayRecord(line string) (*syscall.NetlinkMessage, error) {
+	// auditd in the enriched log format adds the interpreted fields after a group separator, we only want the raw ones
+	if i := strings.IndexByte(line, 0x1d); i >= 0 {
+		line = line[:i]
+	}
+
+	// name_format in auditd.conf can put the node first
+	if strings.HasPrefix(line, "node=") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("Record is missing the type")
+		}
+		line = line[i+1:]
+	}
+
+	i := strings.Index(line, " msg=audit(")
+	if !strings.HasPrefix(line, "type=") || i < 0 {
+		return nil, fmt.Errorf("Record is missing `type=` or `msg=audit(`")
+	}
+
+	name := line[len("type="):i]
+	msgType, err := parseRecordType(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data := line[i+len(" msg="):]
+	if !strings.Contains(data, "): ") {
+		if !strings.HasSuffix(data, "):") {
+			return nil, fmt.Errorf("Record header is not terminated")
+		}
+		data += " "
+	}
+
+	return &syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{
+			Len:  uint32(syscall.SizeofNlMsghdr + len(data)),
+			Type: msgType,
+		},
+		Data: []byte(data),
+	}, nil
+}
+
+// parseRecordType understands the names auditd writes, `UNKNOWN[1334]` for types it didn't know about and plain numbers
+func parseRecordType(name string) (uint16, error) {
+	if t, ok := recordTypes[name]; ok {
+		return t, nil
+	}
+
+	num := name
+	if strings.HasPrefix(name, "UNKNOWN[") && strings.HasSuffix(name, "]") {
+		num = name[len("UNKNOWN[") : len(name)-1]
+	}
+
+	t, err := strconv.ParseUint(num, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Unknown record type `%s`", name)
+	}
+
+	return uint16(t), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseReplayRecord(t *testing.T) {
+	msg, err := parseReplayRecord(`type=SYSCALL msg=audit(1500000000.123:4200): arch=c000003e syscall=59 success=yes`)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1300), msg.Header.Type)
+	assert.Equal(t, "audit(1500000000.123:4200): arch=c000003e syscall=59 success=yes", string(msg.Data))
+	assert.Equal(t, uint32(syscall.SizeofNlMsghdr+len(msg.Data)), msg.Header.Len)
+
+	// node prefix and enriched fields
+	msg, err = parseReplayRecord("node=host1 type=CWD msg=audit(1500000000.123:4200): cwd=\"/root\"\x1dUID=\"root\"")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1307), msg.Header.Type)
+	assert.Equal(t, `audit(1500000000.123:4200): cwd="/root"`, string(msg.Data))
+
+	// Unknown and numeric types
+	msg, err = parseReplayRecord(`type=UNKNOWN[1399] msg=audit(1500000000.123:4200): a=b`)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1399), msg.Header.Type)
+
+	msg, err = parseReplayRecord(`type=1306 msg=audit(1500000000.123:4200): saddr=01`)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1306), msg.Header.Type)
+
+	// An EOE with the trailing space trimmed
+	msg, err = parseReplayRecord(`type=EOE msg=audit(1500000000.123:4200):`)
+	assert.Nil(t, err)
+	assert.Equal(t, "audit(1500000000.123:4200): ", string(msg.Data))
+
+	_, err = parseReplayRecord(`type=NOPE msg=audit(1500000000.123:4200): a=b`)
+	assert.EqualError(t, err, "Unknown record type `NOPE`")
+
+	_, err = parseReplayRecord(`type=SYSCALL arch=c000003e`)
+	assert.EqualError(t, err, "Record is missing `type=` or `msg=audit(`")
+
+	_, err = parseReplayRecord(`type=SYSCALL msg=audit(1500000000.123:42`)
+	assert.EqualError(t, err, "Record header is not terminated")
+}
+
+func Test_replay(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	input := strings.Join([]string{
+		`type=SYSCALL msg=audit(1500000000.123:4200): syscall=59`,
+		`type=CWD msg=audit(1500000000.123:4200): cwd="/"`,
+		`----`,
+		`type=SYSCALL msg=audit(1500000001.000:4201): syscall=42`,
+		`type=BOGUS msg=audit(1500000001.000:4201): a=b`,
+		`type=EOE msg=audit(1500000001.000:4201): `,
+		// A reboot starts the sequence over, 4200 should not have to wait for the end
+		`type=SYSCALL msg=audit(1500000002.000:1): syscall=1`,
+		`type=SYSCALL msg=audit(1500000002.000:2): syscall=2`,
+	}, "\n")
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(NewAuditWriter(w, 1), uint16(1300), uint16(1399), false, false, 0, nil)
+
+	records, skipped, err := replay(strings.NewReader(input), m)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, records)
+	assert.Equal(t, 1, skipped)
+	assert.Equal(t, "", lb.String())
+	assert.Equal(t, "Skipping line 5. Error: Unknown record type `BOGUS`\n", elb.String())
+
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"sequence":4201`)
+	assert.Contains(t, lines[1], `"sequence":4200`)
+	assert.Contains(t, lines[1], `cwd=\"/\"`)
+
+	m.Close()
+	lines = strings.Split(strings.TrimSpace(w.String()), "\n")
+	assert.Len(t, lines, 4)
+	assert.Contains(t, lines[2], `"sequence":1,`)
+	assert.Contains(t, lines[3], `"sequence":2,`)
+}
+
+func Test_replayCapture(t *testing.T) {
+	at := time.Now()
+	capture := []byte(CAPTURE_MAGIC)
+	capture = appendCaptureFrame(capture, new1300("1"), at)
+	capture = appendCaptureFrame(capture, new1300("2"), at.Add(50*time.Millisecond))
+	capture = appendCaptureFrame(capture, new1320("1"), at.Add(100*time.Millisecond))
+
+	// As fast as possible
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(NewAuditWriter(w, 1), uint16(1300), uint16(1399), false, false, 0, nil)
+
+	start := time.Now()
+	frames, err := replayCapture(bytes.NewReader(capture), m, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, frames)
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	assert.Len(t, lines, 1)
+	assert.Contains(t, lines[0], `"sequence":1,`)
+
+	m.Close()
+	lines = strings.Split(strings.TrimSpace(w.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `"sequence":2,`)
+
+	// With the original timing
+	w.Reset()
+	m = NewAuditMarshaller(NewAuditWriter(w, 1), uint16(1300), uint16(1399), false, false, 0, nil)
+
+	start = time.Now()
+	frames, err = replayCapture(bytes.NewReader(capture), m, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, frames)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Contains(t, w.String(), `"sequence":1,`)
+
+	// Errors in the middle are returned along with what was replayed
+	frames, err = replayCapture(bytes.NewReader(capture[:len(capture)-1]), m, false)
+	assert.EqualError(t, err, "Capture file ends in the middle of a frame")
+	assert.Equal(t, 2, frames)
+}
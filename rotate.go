@@ -0,0 +1,319 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Suffixes of compressed rotated files, the empty one is an uncompressed file
+var rotateSuffixes = map[string]string{
+	"none": "",
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// RotatingFile appends to a file and moves it out of the way once it grows past maxSize or the interval it was
+// written in is over. Rotated files are named path.1 for the newest up to path.<keep> for the oldest, with a .gz or
+// .zst suffix when they are compressed. Every file it creates gets the same mode and owner
+type RotatingFile struct {
+	mu          sync.Mutex
+	path        string
+	mode        os.FileMode
+	uid         int
+	gid         int
+	maxSize     int64         // Rotate once the file would grow past this many bytes, 0 to never rotate on size
+	interval    time.Duration // Rotate when a write happens in a later interval than the last one, 0 to never rotate on time
+	keep        int           // Number of rotated files kept, at least 1
+	compression string        // none, gzip or zstd
+
+	f        *os.File
+	size     int64
+	period   time.Time      // Start of the interval the current file was last written in
+	compress sync.WaitGroup // A rotated file is being compressed
+	now      func() time.Time
+}
+
+// NewRotatingFile opens path for appending, creating it if it is missing. A uid or gid of -1 leaves it as it is
+func NewRotatingFile(path string, mode os.FileMode, uid, gid int, maxSize int64, interval time.Duration, keep int, compression string) (*RotatingFile, error) {
+	if _, ok := rotateSuffixes[compression]; !ok {
+		return nil, fmt.Errorf("Output rotate.compression for file must be `none`, `gzip` or `zstd`, got `%s`", compression)
+	}
+
+	r := &RotatingFile{
+		path:        path,
+		mode:        mode,
+		uid:         uid,
+		gid:         gid,
+		maxSize:     maxSize,
+		interval:    interval,
+		keep:        keep,
+		compression: compression,
+		now:         time.Now,
+	}
+
+	f, err := r.open()
+	if err != nil {
+		return nil, err
+	}
+
+	r.use(f)
+	return r, nil
+}
+
+// Write appends p to the file, rotating it first if it is time to
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	now := r.now()
+	if r.due(now, len(p)) {
+		if err := r.rotate(); err != nil {
+			// Keep writing to the current file, the next rotation is tried once this one would have been over
+			el.Printf("Failed to rotate %s, still writing to it. Error: %s\n", r.path, err)
+			r.size = 0
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	r.period = r.truncate(now)
+	return n, err
+}
+
+// Chown changes the owner of the current file and every file created from now on
+func (r *RotatingFile) Chown(uid, gid int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.uid, r.gid = uid, gid
+	return r.own(r.f)
+}
+
+// Reopen opens the file at path again, used after something else moved it away. The current file is kept if the
+// new one can not be opened
+func (r *RotatingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, err := r.open()
+	if err != nil {
+		return err
+	}
+
+	if r.f != nil {
+		if err := r.f.Close(); err != nil {
+			el.Printf("Error closing old log file: %+v\n", err)
+		}
+	}
+
+	r.use(f)
+	return nil
+}
+
+// Close syncs and closes the file, after waiting for a rotated file that is being compressed
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.compress.Wait()
+
+	if r.f == nil {
+		return nil
+	}
+
+	f := r.f
+	r.f = nil
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// open opens path with the right mode and owner
+func (r *RotatingFile) open() (*os.File, error) {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, r.mode)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open output file. Error: %s", err)
+	}
+
+	if err := r.own(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// own sets the mode and owner of a file we created
+func (r *RotatingFile) own(f *os.File) error {
+	if err := f.Chmod(r.mode); err != nil {
+		return fmt.Errorf("Failed to set file permissions. Error: %s", err)
+	}
+
+	if err := f.Chown(r.uid, r.gid); err != nil {
+		return fmt.Errorf("Could not chown output file. Error: %s", err)
+	}
+
+	return nil
+}
+
+// use starts writing to f. A file that already has lines in it counts as written in the interval it was last changed
+func (r *RotatingFile) use(f *os.File) {
+	r.f = f
+	r.size = 0
+	r.period = r.truncate(r.now())
+
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		r.size = info.Size()
+		r.period = r.truncate(info.ModTime())
+	}
+}
+
+// due reports if the file has to be rotated before n more bytes are written to it
+func (r *RotatingFile) due(now time.Time, n int) bool {
+	if r.size == 0 {
+		return false
+	}
+
+	if r.maxSize > 0 && r.size+int64(n) > r.maxSize {
+		return true
+	}
+
+	return r.interval > 0 && r.truncate(now).After(r.period)
+}
+
+func (r *RotatingFile) truncate(t time.Time) time.Time {
+	if r.interval <= 0 {
+		return time.Time{}
+	}
+
+	return t.Truncate(r.interval)
+}
+
+// rotate moves every rotated file one generation up, dropping the oldest, and then the current file to path.1
+func (r *RotatingFile) rotate() error {
+	// The last rotated file has to be done compressing before it is moved
+	r.compress.Wait()
+
+	for i := r.keep; i >= 1; i-- {
+		for _, suffix := range rotateSuffixes {
+			name := r.generation(i) + suffix
+			if _, err := os.Lstat(name); err != nil {
+				continue
+			}
+
+			if i == r.keep {
+				if err := os.Remove(name); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := os.Rename(name, r.generation(i+1)+suffix); err != nil {
+				return err
+			}
+		}
+	}
+
+	rotated := r.generation(1)
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+
+	f, err := r.open()
+	if err != nil {
+		// Writes keep going to the old file under its new name until the next rotation
+		return err
+	}
+
+	if err := r.f.Close(); err != nil {
+		el.Printf("Error closing old log file: %+v\n", err)
+	}
+
+	r.use(f)
+
+	if r.compression != "none" {
+		r.compress.Add(1)
+		go func() {
+			defer r.compress.Done()
+			if err := r.compressFile(rotated); err != nil {
+				el.Printf("Failed to compress %s. Error: %s\n", rotated, err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+func (r *RotatingFile) generation(i int) string {
+	return r.path + "." + strconv.Itoa(i)
+}
+
+// compressFile replaces name with a compressed copy
+func (r *RotatingFile) compressFile(name string) (err error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	target := name + rotateSuffixes[r.compression]
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, r.mode)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+
+		if err != nil {
+			os.Remove(target)
+			return
+		}
+
+		err = os.Remove(name)
+	}()
+
+	if err := r.own(out); err != nil {
+		return err
+	}
+
+	var w io.WriteCloser
+	switch r.compression {
+	case "gzip":
+		w = gzip.NewWriter(out)
+	case "zstd":
+		z, err := zstd.NewWriter(out)
+		if err != nil {
+			return err
+		}
+		w = z
+	}
+
+	if _, err := io.Copy(w, in); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
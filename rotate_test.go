@@ -0,0 +1,226 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func assertFileContent(t *testing.T, name string, expected string) {
+	t.Helper()
+
+	b, err := os.ReadFile(name)
+	if assert.Nil(t, err) {
+		assert.Equal(t, expected, string(b))
+	}
+}
+
+func TestRotatingFile_Size(t *testing.T) {
+	p := path.Join(t.TempDir(), "audit.log")
+	r, err := NewRotatingFile(p, 0640, -1, -1, 10, 0, 2, "none")
+	assert.Nil(t, err)
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		n, err := r.Write([]byte(line))
+		assert.Nil(t, err)
+		assert.Equal(t, len(line), n)
+	}
+
+	// A line that would take the file past 10 bytes goes in a new file
+	assertFileContent(t, p, "four\nfive\n")
+	assertFileContent(t, p+".1", "three\n")
+	assertFileContent(t, p+".2", "one\ntwo\n")
+
+	// Only 2 rotated files are kept
+	r.Write([]byte("six\n"))
+	assertFileContent(t, p, "six\n")
+	assertFileContent(t, p+".1", "four\nfive\n")
+	assertFileContent(t, p+".2", "three\n")
+	assert.NoFileExists(t, p+".3")
+
+	for _, name := range []string{p, p + ".1", p + ".2"} {
+		info, err := os.Stat(name)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0640), info.Mode())
+	}
+
+	assert.Nil(t, r.Close())
+	_, err = r.Write([]byte("six\n"))
+	assert.Equal(t, os.ErrClosed, err)
+}
+
+func TestRotatingFile_Interval(t *testing.T) {
+	p := path.Join(t.TempDir(), "audit.log")
+
+	// Left over from yesterday
+	assert.Nil(t, os.WriteFile(p, []byte("old\n"), 0600))
+	yesterday := time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC)
+	assert.Nil(t, os.Chtimes(p, yesterday, yesterday))
+
+	r, err := NewRotatingFile(p, 0600, -1, -1, 0, time.Hour*24, 3, "none")
+	assert.Nil(t, err)
+
+	now := time.Date(2026, 10, 17, 1, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	r.Write([]byte("a\n"))
+	assertFileContent(t, p+".1", "old\n")
+
+	now = now.Add(time.Hour * 22)
+	r.Write([]byte("b\n"))
+	assertFileContent(t, p, "a\nb\n")
+
+	now = now.Add(time.Hour)
+	r.Write([]byte("c\n"))
+	assertFileContent(t, p, "c\n")
+	assertFileContent(t, p+".1", "a\nb\n")
+	assertFileContent(t, p+".2", "old\n")
+	assert.Nil(t, r.Close())
+}
+
+func TestRotatingFile_Compression(t *testing.T) {
+	read := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+
+	for compression, suffix := range map[string]string{"gzip": ".gz", "zstd": ".zst"} {
+		t.Run(compression, func(t *testing.T) {
+			p := path.Join(t.TempDir(), "audit.log")
+			r, err := NewRotatingFile(p, 0600, -1, -1, 4, 0, 2, compression)
+			assert.Nil(t, err)
+
+			for _, line := range []string{"one\n", "two\n", "three\n"} {
+				r.Write([]byte(line))
+			}
+			assert.Nil(t, r.Close())
+
+			assert.NoFileExists(t, p+".1")
+			assert.NoFileExists(t, p+".2")
+			for name, expected := range map[string]string{p + ".1" + suffix: "two\n", p + ".2" + suffix: "one\n"} {
+				f, err := os.Open(name)
+				if !assert.Nil(t, err) {
+					continue
+				}
+
+				info, _ := f.Stat()
+				assert.Equal(t, os.FileMode(0600), info.Mode())
+
+				z, err := read[compression](f)
+				assert.Nil(t, err)
+				b, err := io.ReadAll(z)
+				assert.Nil(t, err)
+				assert.Equal(t, expected, string(b))
+				f.Close()
+			}
+		})
+	}
+}
+
+func TestRotatingFile_Reopen(t *testing.T) {
+	p := path.Join(t.TempDir(), "audit.log")
+	r, err := NewRotatingFile(p, 0600, -1, -1, 0, 0, 0, "none")
+	assert.Nil(t, err)
+
+	r.Write([]byte("one\n"))
+	assert.Nil(t, os.Rename(p, p+".moved"))
+	assert.Nil(t, r.Reopen())
+	r.Write([]byte("two\n"))
+
+	assertFileContent(t, p+".moved", "one\n")
+	assertFileContent(t, p, "two\n")
+
+	// The current file is kept if the new one can't be opened
+	assert.Nil(t, os.Rename(p, p+".moved"))
+	assert.Nil(t, os.Mkdir(p, 0700))
+	assert.EqualError(t, r.Reopen(), "Failed to open output file. Error: open "+p+": is a directory")
+	r.Write([]byte("three\n"))
+	assertFileContent(t, p+".moved", "two\nthree\n")
+	assert.Nil(t, r.Close())
+}
+
+func TestRotatingFile_Failed(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	p := path.Join(t.TempDir(), "audit.log")
+	r, err := NewRotatingFile(p, 0600, -1, -1, 8, 0, 1, "none")
+	assert.Nil(t, err)
+
+	// The oldest rotated file can't be removed
+	assert.Nil(t, os.MkdirAll(path.Join(p+".1", "busy"), 0700))
+
+	r.Write([]byte("one\n"))
+	r.Write([]byte("two\n"))
+	r.Write([]byte("333\n"))
+	assertFileContent(t, p, "one\ntwo\n333\n")
+	assert.Equal(t, "Failed to rotate "+p+", still writing to it. Error: remove "+p+".1: directory not empty\n", elb.String())
+
+	// It is tried again once the file has grown by max size again
+	elb.Reset()
+	r.Write([]byte("4\n"))
+	assert.Empty(t, elb.String())
+	r.Write([]byte("55555\n"))
+	assert.Contains(t, elb.String(), "Failed to rotate ")
+	assert.Nil(t, r.Close())
+}
+
+func Test_createFileOutput_Rotate(t *testing.T) {
+	u, _ := user.LookupId(strconv.Itoa(os.Getuid()))
+	g, _ := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+
+	newConfig := func() *viper.Viper {
+		c := viper.New()
+		c.Set("output.file.attempts", 1)
+		c.Set("output.file.path", path.Join(t.TempDir(), "audit.log"))
+		c.Set("output.file.mode", 0600)
+		c.Set("output.file.user", u.Username)
+		c.Set("output.file.group", g.Name)
+		c.Set("output.file.rotate.max_size", "1MB")
+		c.Set("output.file.rotate.interval", "24h")
+		c.Set("output.file.rotate.keep", 5)
+		c.Set("output.file.rotate.compression", "zstd")
+		return c
+	}
+
+	lb, _ := hookLogger()
+	defer resetLogger()
+
+	c := newConfig()
+	w, err := createFileOutput(c)
+	assert.Nil(t, err)
+	if assert.IsType(t, &RotatingFile{}, w.w) {
+		r := w.w.(*RotatingFile)
+		assert.Equal(t, int64(1024*1024), r.maxSize)
+		assert.Equal(t, time.Hour*24, r.interval)
+		assert.Equal(t, 5, r.keep)
+		assert.Equal(t, "zstd", r.compression)
+		assert.Equal(t, os.Getuid(), r.uid)
+	}
+	assert.Equal(t, "Rotating "+c.GetString("output.file.path")+" at 1048576 bytes or every 24h0m0s, keeping 5 files\n", lb.String())
+	assert.Nil(t, w.Close())
+
+	c = newConfig()
+	c.Set("output.file.rotate.interval", "-1h")
+	_, err = createFileOutput(c)
+	assert.EqualError(t, err, "Output rotate.interval for file can not be negative, got `-1h`")
+
+	c = newConfig()
+	c.Set("output.file.rotate.keep", 0)
+	_, err = createFileOutput(c)
+	assert.EqualError(t, err, "Output rotate.keep for file must be at least 1, 0 provided")
+
+	c = newConfig()
+	c.Set("output.file.rotate.compression", "xz")
+	_, err = createFileOutput(c)
+	assert.EqualError(t, err, "Output rotate.compression for file must be `none`, `gzip` or `zstd`, got `xz`")
+}
@@ -0,0 +1,728 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// See linux/audit.h for all of these
+const (
+	AUDIT_MAX_FIELDS      = 64
+	AUDIT_BITMASK_SIZE    = 64
+	AUDIT_MAX_KEY_LEN     = 256
+	AUDIT_SYSCALL_CLASSES = 16 // The top bits of a syscall mask select classes of syscalls instead
+
+	AUDIT_KEY_SEPARATOR = "\x01"
+
+	// Rule lists
+	AUDIT_FILTER_USER       = 0x00
+	AUDIT_FILTER_TASK       = 0x01
+	AUDIT_FILTER_ENTRY      = 0x02
+	AUDIT_FILTER_EXIT       = 0x04
+	AUDIT_FILTER_EXCLUDE    = 0x05
+	AUDIT_FILTER_FS         = 0x06
+	AUDIT_FILTER_URING_EXIT = 0x07
+	AUDIT_FILTER_PREPEND    = 0x10
+
+	// Rule actions
+	AUDIT_NEVER  = 0
+	AUDIT_ALWAYS = 2
+
+	// Field comparison operators
+	AUDIT_BIT_MASK              = 0x08000000
+	AUDIT_LESS_THAN             = 0x10000000
+	AUDIT_GREATER_THAN          = 0x20000000
+	AUDIT_NOT_EQUAL             = 0x30000000
+	AUDIT_EQUAL                 = 0x40000000
+	AUDIT_BIT_TEST              = AUDIT_BIT_MASK | AUDIT_EQUAL
+	AUDIT_LESS_THAN_OR_EQUAL    = AUDIT_LESS_THAN | AUDIT_EQUAL
+	AUDIT_GREATER_THAN_OR_EQUAL = AUDIT_GREATER_THAN | AUDIT_EQUAL
+
+	// Rule fields
+	AUDIT_PID          = 0
+	AUDIT_UID          = 1
+	AUDIT_EUID         = 2
+	AUDIT_SUID         = 3
+	AUDIT_FSUID        = 4
+	AUDIT_GID          = 5
+	AUDIT_EGID         = 6
+	AUDIT_SGID         = 7
+	AUDIT_FSGID        = 8
+	AUDIT_LOGINUID     = 9
+	AUDIT_PERS         = 10
+	AUDIT_ARCH         = 11
+	AUDIT_MSGTYPE      = 12
+	AUDIT_SUBJ_USER    = 13
+	AUDIT_SUBJ_ROLE    = 14
+	AUDIT_SUBJ_TYPE    = 15
+	AUDIT_SUBJ_SEN     = 16
+	AUDIT_SUBJ_CLR     = 17
+	AUDIT_PPID         = 18
+	AUDIT_OBJ_USER     = 19
+	AUDIT_OBJ_ROLE     = 20
+	AUDIT_OBJ_TYPE     = 21
+	AUDIT_OBJ_LEV_LOW  = 22
+	AUDIT_OBJ_LEV_HIGH = 23
+	AUDIT_SESSIONID    = 25
+	AUDIT_FSTYPE       = 26
+	AUDIT_DEVMAJOR     = 100
+	AUDIT_DEVMINOR     = 101
+	AUDIT_INODE        = 102
+	AUDIT_EXIT         = 103
+	AUDIT_SUCCESS      = 104
+	AUDIT_WATCH        = 105
+	AUDIT_PERM         = 106
+	AUDIT_DIR          = 107
+	AUDIT_FILETYPE     = 108
+	AUDIT_OBJ_UID      = 109
+	AUDIT_OBJ_GID      = 110
+	AUDIT_EXE          = 112
+	AUDIT_SADDR_FAM    = 113
+	AUDIT_ARG0         = 200
+	AUDIT_ARG1         = 201
+	AUDIT_ARG2         = 202
+	AUDIT_ARG3         = 203
+	AUDIT_FILTERKEY    = 210
+
+	// Watch permissions
+	AUDIT_PERM_EXEC  = 1
+	AUDIT_PERM_WRITE = 2
+	AUDIT_PERM_READ  = 4
+	AUDIT_PERM_ATTR  = 8
+
+	AUDIT_UID_UNSET = 0xffffffff
+)
+
+type ruleFieldKind int
+
+const (
+	fieldNumber ruleFieldKind = iota
+	fieldString
+	fieldUid
+	fieldGid
+	fieldArch
+	fieldExit
+	fieldPerm
+	fieldFiletype
+)
+
+type ruleField struct {
+	id   uint32
+	kind ruleFieldKind
+}
+
+// ruleFields are the field names auditctl understands for -F
+var ruleFields = map[string]ruleField{
+	"pid":          {AUDIT_PID, fieldNumber},
+	"uid":          {AUDIT_UID, fieldUid},
+	"euid":         {AUDIT_EUID, fieldUid},
+	"suid":         {AUDIT_SUID, fieldUid},
+	"fsuid":        {AUDIT_FSUID, fieldUid},
+	"gid":          {AUDIT_GID, fieldGid},
+	"egid":         {AUDIT_EGID, fieldGid},
+	"sgid":         {AUDIT_SGID, fieldGid},
+	"fsgid":        {AUDIT_FSGID, fieldGid},
+	"auid":         {AUDIT_LOGINUID, fieldUid},
+	"loginuid":     {AUDIT_LOGINUID, fieldUid},
+	"pers":         {AUDIT_PERS, fieldNumber},
+	"arch":         {AUDIT_ARCH, fieldArch},
+	"msgtype":      {AUDIT_MSGTYPE, fieldNumber},
+	"subj_user":    {AUDIT_SUBJ_USER, fieldString},
+	"subj_role":    {AUDIT_SUBJ_ROLE, fieldString},
+	"subj_type":    {AUDIT_SUBJ_TYPE, fieldString},
+	"subj_sen":     {AUDIT_SUBJ_SEN, fieldString},
+	"subj_clr":     {AUDIT_SUBJ_CLR, fieldString},
+	"ppid":         {AUDIT_PPID, fieldNumber},
+	"obj_user":     {AUDIT_OBJ_USER, fieldString},
+	"obj_role":     {AUDIT_OBJ_ROLE, fieldString},
+	"obj_type":     {AUDIT_OBJ_TYPE, fieldString},
+	"obj_lev_low":  {AUDIT_OBJ_LEV_LOW, fieldString},
+	"obj_lev_high": {AUDIT_OBJ_LEV_HIGH, fieldString},
+	"sessionid":    {AUDIT_SESSIONID, fieldNumber},
+	"fstype":       {AUDIT_FSTYPE, fieldNumber},
+	"devmajor":     {AUDIT_DEVMAJOR, fieldNumber},
+	"devminor":     {AUDIT_DEVMINOR, fieldNumber},
+	"inode":        {AUDIT_INODE, fieldNumber},
+	"exit":         {AUDIT_EXIT, fieldExit},
+	"success":      {AUDIT_SUCCESS, fieldNumber},
+	"path":         {AUDIT_WATCH, fieldString},
+	"dir":          {AUDIT_DIR, fieldString},
+	"perm":         {AUDIT_PERM, fieldPerm},
+	"filetype":     {AUDIT_FILETYPE, fieldFiletype},
+	"obj_uid":      {AUDIT_OBJ_UID, fieldUid},
+	"obj_gid":      {AUDIT_OBJ_GID, fieldGid},
+	"exe":          {AUDIT_EXE, fieldString},
+	"saddr_fam":    {AUDIT_SADDR_FAM, fieldNumber},
+	"a0":           {AUDIT_ARG0, fieldNumber},
+	"a1":           {AUDIT_ARG1, fieldNumber},
+	"a2":           {AUDIT_ARG2, fieldNumber},
+	"a3":           {AUDIT_ARG3, fieldNumber},
+	"key":          {AUDIT_FILTERKEY, fieldString},
+}
+
+// Longer operators first so `>=` isn't read as `>`
+var ruleOperators = []struct {
+	op    string
+	value uint32
+}{
+	{"!=", AUDIT_NOT_EQUAL},
+	{">=", AUDIT_GREATER_THAN_OR_EQUAL},
+	{"<=", AUDIT_LESS_THAN_OR_EQUAL},
+	{"&=", AUDIT_BIT_TEST},
+	{"=", AUDIT_EQUAL},
+	{">", AUDIT_GREATER_THAN},
+	{"<", AUDIT_LESS_THAN},
+	{"&", AUDIT_BIT_MASK},
+}
+
+var ruleLists = map[string]uint32{
+	"task":       AUDIT_FILTER_TASK,
+	"exit":       AUDIT_FILTER_EXIT,
+	"user":       AUDIT_FILTER_USER,
+	"exclude":    AUDIT_FILTER_EXCLUDE,
+	"filesystem": AUDIT_FILTER_FS,
+	"io_uring":   AUDIT_FILTER_URING_EXIT,
+}
+
+var ruleActions = map[string]uint32{
+	"never":  AUDIT_NEVER,
+	"always": AUDIT_ALWAYS,
+}
+
+// File type values for -F filetype, these are the S_IF* mode bits
+var ruleFiletypes = map[string]uint32{
+	"file":      0100000,
+	"dir":       0040000,
+	"socket":    0140000,
+	"link":      0120000,
+	"character": 0020000,
+	"block":     0060000,
+	"fifo":      0010000,
+}
+
+// auditRuleData mirrors struct audit_rule_data from linux/audit.h without the trailing string buffer
+type auditRuleData struct {
+	Flags      uint32
+	Action     uint32
+	FieldCount uint32
+	Mask       [AUDIT_BITMASK_SIZE]uint32
+	Fields     [AUDIT_MAX_FIELDS]uint32
+	Values     [AUDIT_MAX_FIELDS]uint32
+	FieldFlags [AUDIT_MAX_FIELDS]uint32
+	BufLen     uint32
+}
+
+// AuditRule is a single audit rule as the kernel sees it
+type AuditRule struct {
+	auditRuleData
+	Buf []byte
+}
+
+// ruleOp is what a line in the `rules` config asks us to do
+type ruleOp int
+
+const (
+	ruleAdd ruleOp = iota
+	ruleDelete
+	ruleDeleteAll
+	ruleSetStatus
+)
+
+// AuditRuleCommand is a single parsed line from the `rules` config
+type AuditRuleCommand struct {
+	op     ruleOp
+	rule   *AuditRule
+	status *AuditStatusPayload
+}
+
+// AuditRuleClient is the part of the netlink client used to manage audit rules
+type AuditRuleClient interface {
+	AddRule(rule *AuditRule) error
+	DeleteRule(rule *AuditRule) error
+	ListRules() ([]*AuditRule, error)
+	SetStatus(status *AuditStatusPayload) error
+}
+
+// ParseAuditRule parses a single line of auditctl syntax. Supports -a, -A, -d, -w, -W, -p, -F, -S, -k, -D, -e, -b, -r,
+// -f and --backlog_wait_time
+func ParseAuditRule(line string) (*AuditRuleCommand, error) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil, errors.New("Rule is empty")
+	}
+
+	switch args[0] {
+	case "-D":
+		if len(args) != 1 {
+			return nil, errors.New("-D does not take any other options")
+		}
+		return &AuditRuleCommand{op: ruleDeleteAll}, nil
+
+	case "-e", "-b", "-r", "-f", "--backlog_wait_time":
+		return parseStatusRule(args)
+	}
+
+	p := &ruleParser{rule: &AuditRule{}}
+	if err := p.parse(args); err != nil {
+		return nil, err
+	}
+
+	return &AuditRuleCommand{op: p.op, rule: p.rule}, nil
+}
+
+func parseStatusRule(args []string) (*AuditRuleCommand, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("%s takes exactly one value", args[0])
+	}
+
+	v, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%s value `%s` is not a number", args[0], args[1])
+	}
+
+	status := &AuditStatusPayload{}
+	switch args[0] {
+	case "-e":
+		if v > 2 {
+			return nil, fmt.Errorf("-e must be 0, 1 or 2, got %d", v)
+		}
+		status.Mask = AUDIT_STATUS_ENABLED
+		status.Enabled = uint32(v)
+	case "-b":
+		status.Mask = AUDIT_STATUS_BACKLOG_LIMIT
+		status.BacklogLimit = uint32(v)
+	case "-r":
+		status.Mask = AUDIT_STATUS_RATE_LIMIT
+		status.RateLimit = uint32(v)
+	case "-f":
+		if v > 2 {
+			return nil, fmt.Errorf("-f must be 0, 1 or 2, got %d", v)
+		}
+		status.Mask = AUDIT_STATUS_FAILURE
+		status.Failure = uint32(v)
+	case "--backlog_wait_time":
+		status.Mask = AUDIT_STATUS_BACKLOG_WAIT_TIME
+		status.BacklogWaitTime = uint32(v)
+	}
+
+	return &AuditRuleCommand{op: ruleSetStatus, status: status}, nil
+}
+
+type ruleParser struct {
+	rule     *AuditRule
+	op       ruleOp
+	list     bool
+	watch    string
+	perm     uint32
+	keys     []string
+	syscalls []string
+	arch     uint32
+}
+
+func (p *ruleParser) parse(args []string) error {
+	for i := 0; i < len(args); i++ {
+		opt := args[i]
+		if i+1 >= len(args) {
+			return fmt.Errorf("%s is missing a value", opt)
+		}
+		i++
+		val := args[i]
+
+		var err error
+		switch opt {
+		case "-a", "-A", "-d":
+			err = p.setList(opt, val)
+		case "-w", "-W":
+			err = p.setWatch(opt, val)
+		case "-p":
+			p.perm, err = parsePerm(val)
+		case "-S":
+			p.syscalls = append(p.syscalls, strings.Split(val, ",")...)
+		case "-F":
+			err = p.addField(val)
+		case "-k":
+			p.keys = append(p.keys, val)
+		default:
+			err = fmt.Errorf("Unsupported option %s", opt)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if !p.list && p.watch == "" {
+		return errors.New("Rule must have one of -a, -A, -d, -w or -W")
+	}
+
+	if p.watch != "" {
+		if len(p.syscalls) > 0 {
+			return errors.New("-S can not be used with a watch")
+		}
+
+		field := uint32(AUDIT_WATCH)
+		if info, err := os.Stat(p.watch); err == nil && info.IsDir() {
+			field = AUDIT_DIR
+		}
+
+		if err := p.addString(field, AUDIT_EQUAL, strings.TrimSuffix(p.watch, "/")); err != nil {
+			return err
+		}
+
+		if p.perm != 0 {
+			if err := p.add(AUDIT_PERM, AUDIT_EQUAL, p.perm); err != nil {
+				return err
+			}
+		}
+
+		p.rule.Flags = AUDIT_FILTER_EXIT
+		p.rule.Action = AUDIT_ALWAYS
+		p.setAllSyscalls()
+	} else if p.perm != 0 {
+		return errors.New("-p can only be used with a watch")
+	} else if err := p.setSyscalls(); err != nil {
+		return err
+	}
+
+	if len(p.keys) > 0 {
+		key := strings.Join(p.keys, AUDIT_KEY_SEPARATOR)
+		if len(key) > AUDIT_MAX_KEY_LEN {
+			return fmt.Errorf("Key is longer than %d characters", AUDIT_MAX_KEY_LEN)
+		}
+
+		if err := p.addString(AUDIT_FILTERKEY, AUDIT_EQUAL, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *ruleParser) setList(opt, val string) error {
+	if p.list || p.watch != "" {
+		return errors.New("Only one of -a, -A, -d, -w or -W can be used in a rule")
+	}
+
+	var list, action uint32
+	var haveList, haveAction bool
+	for _, part := range strings.Split(val, ",") {
+		if v, ok := ruleLists[part]; ok && !haveList {
+			list, haveList = v, true
+		} else if v, ok := ruleActions[part]; ok && !haveAction {
+			action, haveAction = v, true
+		} else {
+			return fmt.Errorf("Unknown list or action `%s` in %s %s", part, opt, val)
+		}
+	}
+
+	if !haveList || !haveAction {
+		return fmt.Errorf("%s needs both a list and an action, got `%s`", opt, val)
+	}
+
+	p.list = true
+	p.rule.Flags = list
+	p.rule.Action = action
+
+	switch opt {
+	case "-A":
+		p.rule.Flags |= AUDIT_FILTER_PREPEND
+	case "-d":
+		p.op = ruleDelete
+	}
+
+	return nil
+}
+
+func (p *ruleParser) setWatch(opt, val string) error {
+	if p.list || p.watch != "" {
+		return errors.New("Only one of -a, -A, -d, -w or -W can be used in a rule")
+	}
+
+	if !strings.HasPrefix(val, "/") {
+		return fmt.Errorf("Watch path `%s` must be absolute", val)
+	}
+
+	p.watch = val
+	if opt == "-W" {
+		p.op = ruleDelete
+	}
+
+	return nil
+}
+
+func parsePerm(val string) (uint32, error) {
+	var perm uint32
+	for _, c := range val {
+		switch c {
+		case 'r':
+			perm |= AUDIT_PERM_READ
+		case 'w':
+			perm |= AUDIT_PERM_WRITE
+		case 'x':
+			perm |= AUDIT_PERM_EXEC
+		case 'a':
+			perm |= AUDIT_PERM_ATTR
+		default:
+			return 0, fmt.Errorf("Unknown permission `%c` in `%s`", c, val)
+		}
+	}
+
+	return perm, nil
+}
+
+func (p *ruleParser) addField(val string) error {
+	var name, value string
+	var op uint32
+	for _, o := range ruleOperators {
+		if i := strings.Index(val, o.op); i > 0 {
+			name, value, op = val[:i], val[i+len(o.op):], o.value
+			break
+		}
+	}
+
+	if name == "" {
+		return fmt.Errorf("Could not find an operator in -F %s", val)
+	}
+
+	field, ok := ruleFields[name]
+	if !ok {
+		return fmt.Errorf("Unknown field `%s` in -F %s", name, val)
+	}
+
+	if field.kind == fieldString {
+		if op != AUDIT_EQUAL && op != AUDIT_NOT_EQUAL {
+			return fmt.Errorf("Field `%s` only supports = and !=", name)
+		}
+
+		if field.id == AUDIT_FILTERKEY {
+			p.keys = append(p.keys, value)
+			return nil
+		}
+
+		return p.addString(field.id, op, value)
+	}
+
+	v, err := parseFieldValue(field.kind, value)
+	if err != nil {
+		return fmt.Errorf("Invalid value for -F %s. Error: %s", val, err)
+	}
+
+	if field.id == AUDIT_ARCH {
+		if op != AUDIT_EQUAL && op != AUDIT_NOT_EQUAL {
+			return errors.New("Field `arch` only supports = and !=")
+		}
+		p.arch = v
+	}
+
+	return p.add(field.id, op, v)
+}
+
+func parseFieldValue(kind ruleFieldKind, value string) (uint32, error) {
+	switch kind {
+	case fieldUid:
+		if value == "-1" || value == "unset" {
+			return AUDIT_UID_UNSET, nil
+		}
+
+		if v, err := strconv.ParseUint(value, 10, 32); err == nil {
+			return uint32(v), nil
+		}
+
+		u, err := user.Lookup(value)
+		if err != nil {
+			return 0, err
+		}
+
+		v, err := strconv.ParseUint(u.Uid, 10, 32)
+		return uint32(v), err
+
+	case fieldGid:
+		if value == "-1" || value == "unset" {
+			return AUDIT_UID_UNSET, nil
+		}
+
+		if v, err := strconv.ParseUint(value, 10, 32); err == nil {
+			return uint32(v), nil
+		}
+
+		g, err := user.LookupGroup(value)
+		if err != nil {
+			return 0, err
+		}
+
+		v, err := strconv.ParseUint(g.Gid, 10, 32)
+		return uint32(v), err
+
+	case fieldArch:
+		if arch, ok := parseArch(value); ok {
+			return arch, nil
+		}
+		return 0, fmt.Errorf("unknown arch `%s`", value)
+
+	case fieldExit:
+		name := strings.TrimPrefix(value, "-")
+		if num, ok := errnoNumbers[name]; ok {
+			if strings.HasPrefix(value, "-") {
+				return uint32(-int32(num)), nil
+			}
+			return uint32(num), nil
+		}
+
+	case fieldPerm:
+		return parsePerm(value)
+
+	case fieldFiletype:
+		if v, ok := ruleFiletypes[value]; ok {
+			return v, nil
+		}
+		return 0, fmt.Errorf("unknown file type `%s`", value)
+	}
+
+	v, err := strconv.ParseInt(value, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("`%s` is not a number", value)
+	}
+
+	return uint32(v), nil
+}
+
+func (p *ruleParser) add(field, op, value uint32) error {
+	r := p.rule
+	if r.FieldCount >= AUDIT_MAX_FIELDS {
+		return fmt.Errorf("Rules can have at most %d fields", AUDIT_MAX_FIELDS)
+	}
+
+	r.Fields[r.FieldCount] = field
+	r.FieldFlags[r.FieldCount] = op
+	r.Values[r.FieldCount] = value
+	r.FieldCount++
+	return nil
+}
+
+func (p *ruleParser) addString(field, op uint32, value string) error {
+	if err := p.add(field, op, uint32(len(value))); err != nil {
+		return err
+	}
+
+	p.rule.Buf = append(p.rule.Buf, value...)
+	p.rule.BufLen = uint32(len(p.rule.Buf))
+	return nil
+}
+
+func (p *ruleParser) setAllSyscalls() {
+	for i := range p.rule.Mask {
+		p.rule.Mask[i] = 0xffffffff
+	}
+}
+
+func (p *ruleParser) setSyscalls() error {
+	list := p.rule.Flags &^ AUDIT_FILTER_PREPEND
+	if len(p.syscalls) == 0 {
+		// Syscall rules without any -S apply to every syscall
+		if list == AUDIT_FILTER_EXIT || list == AUDIT_FILTER_URING_EXIT {
+			p.setAllSyscalls()
+		}
+		return nil
+	}
+
+	if list != AUDIT_FILTER_EXIT && list != AUDIT_FILTER_URING_EXIT {
+		return errors.New("-S can only be used with the exit or io_uring lists")
+	}
+
+	arch := p.arch
+	if arch == 0 {
+		arch, _ = nativeArch()
+	}
+
+	for _, name := range p.syscalls {
+		if name == "all" {
+			p.setAllSyscalls()
+			continue
+		}
+
+		num, ok := syscallNumber(arch, name)
+		if !ok {
+			v, err := strconv.Atoi(name)
+			if err != nil {
+				return fmt.Errorf("Unknown syscall `%s` for arch %s", name, archNames[arch])
+			}
+			num = v
+		}
+
+		if num < 0 || num >= AUDIT_BITMASK_SIZE*32 {
+			return fmt.Errorf("Syscall number %d is out of range", num)
+		}
+
+		p.rule.Mask[num/32] |= 1 << uint(num%32)
+	}
+
+	return nil
+}
+
+// MarshalBinary encodes the rule in the layout the kernel expects
+func (r *AuditRule) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, Endianness, &r.auditRuleData); err != nil {
+		return nil, err
+	}
+
+	buf.Write(r.Buf)
+	return buf.Bytes(), nil
+}
+
+// parseAuditRule decodes a rule the kernel sent us
+func parseAuditRule(b []byte) (*AuditRule, error) {
+	r := &AuditRule{}
+	size := binary.Size(&r.auditRuleData)
+	if len(b) < size {
+		return nil, fmt.Errorf("Rule is too short, %d bytes", len(b))
+	}
+
+	if err := binary.Read(bytes.NewReader(b[:size]), Endianness, &r.auditRuleData); err != nil {
+		return nil, err
+	}
+
+	if r.FieldCount > AUDIT_MAX_FIELDS || len(b) < size+int(r.BufLen) {
+		return nil, errors.New("Rule is malformed")
+	}
+
+	r.Buf = append([]byte{}, b[size:size+int(r.BufLen)]...)
+	return r, nil
+}
+
+func (cmd *AuditRuleCommand) apply(c AuditRuleClient) error {
+	switch cmd.op {
+	case ruleAdd:
+		return c.AddRule(cmd.rule)
+	case ruleDelete:
+		return c.DeleteRule(cmd.rule)
+	case ruleDeleteAll:
+		return deleteAllRules(c)
+	case ruleSetStatus:
+		return c.SetStatus(cmd.status)
+	}
+
+	return fmt.Errorf("Unknown rule operation %d", cmd.op)
+}
+
+// deleteAllRules does what `auditctl -D` does, lists every rule and deletes them one at a time
+func deleteAllRules(c AuditRuleClient) error {
+	rules, err := c.ListRules()
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if err := c.DeleteRule(rule); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RuleChecker periodically compares the rules loaded in the kernel with the ones from the config, anyone with root
+// could have removed or added rules behind our back
+type RuleChecker struct {
+	mu       sync.Mutex
+	client   AuditRuleClient
+	writer   GroupWriter
+	reapply  func() error
+	expected []*AuditRule
+	shared   bool // Another audit daemon loads rules too, only ours have to be there
+}
+
+// NewRuleChecker checks that the loaded rules are the expected ones, see expectedRules.
+// If reapply is not nil it is called to load the configured rules again whenever drift is found
+func NewRuleChecker(client AuditRuleClient, writer GroupWriter, expected []*AuditRule, shared bool, reapply func() error) *RuleChecker {
+	return &RuleChecker{
+		client:   client,
+		writer:   writer,
+		reapply:  reapply,
+		expected: expected,
+		shared:   shared,
+	}
+}
+
+// Run checks the rules every interval, it never returns
+func (rc *RuleChecker) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		rc.Check()
+	}
+}
+
+// Check compares the loaded rules with the expected ones and emits an event if they differ
+func (rc *RuleChecker) Check() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	loaded, err := rc.client.ListRules()
+	if err != nil {
+		el.Printf("Failed to list the loaded audit rules. Error: %s\n", err)
+		return
+	}
+
+	missing, unexpected, drifted := diffRules(rc.expected, loaded)
+	if rc.shared {
+		// Whatever the other daemon loaded is none of our business, and it decides where our rules go
+		unexpected, drifted = 0, missing > 0
+	}
+
+	if !drifted {
+		return
+	}
+
+	el.Printf("Audit rules do not match the config, %d missing and %d unexpected\n", missing, unexpected)
+
+	data := fmt.Sprintf(
+		"op=rules_drift expected=%d loaded=%d missing=%d unexpected=%d",
+		len(rc.expected), len(loaded), missing, unexpected,
+	)
+
+	result := "disabled"
+	if rc.reapply != nil {
+		result = "success"
+		if err := rc.reapply(); err != nil {
+			el.Printf("Failed to reapply audit rules. Error: %s\n", err)
+			result = "failed"
+		}
+	}
+
+	if err := rc.writer.Write(NewSyntheticMessageGroup(EVENT_RULES_DRIFT, data+" reapply="+result)); err != nil {
+		el.Printf("Failed to write the audit rules drift event. Error: %s\n", err)
+	}
+}
+
+// Reload calls apply to load new rules while no check is running, then expected becomes the expected state and
+// reapply replaces the old one. Both are left alone if apply fails
+func (rc *RuleChecker) Reload(apply func() error, expected []*AuditRule, reapply func() error) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if err := apply(); err != nil {
+		return err
+	}
+
+	rc.expected = expected
+	rc.reapply = reapply
+	return nil
+}
+
+// expectedRules works out the rules the kernel holds once the commands are applied to an empty rule list, which is
+// what setRules starts from after flushing. Status commands don't change any rules
+func expectedRules(cmds []*AuditRuleCommand) []*AuditRule {
+	var rules []*AuditRule
+	for _, cmd := range cmds {
+		switch cmd.op {
+		case ruleDeleteAll:
+			rules = nil
+
+		case ruleAdd:
+			// The kernel drops the prepend flag once the rule is in place
+			r := *cmd.rule
+			r.Flags &^= AUDIT_FILTER_PREPEND
+
+			if indexRule(rules, &r) >= 0 {
+				// The kernel refuses to load the same rule twice
+				continue
+			}
+
+			if cmd.rule.Flags&AUDIT_FILTER_PREPEND != 0 {
+				rules = append([]*AuditRule{&r}, rules...)
+			} else {
+				rules = append(rules, &r)
+			}
+
+		case ruleDelete:
+			r := *cmd.rule
+			r.Flags &^= AUDIT_FILTER_PREPEND
+
+			if i := indexRule(rules, &r); i >= 0 {
+				rules = append(rules[:i:i], rules[i+1:]...)
+			}
+		}
+	}
+
+	return rules
+}
+
+func indexRule(rules []*AuditRule, r *AuditRule) int {
+	k := ruleKey(r)
+	for i, rule := range rules {
+		if ruleKey(rule) == k {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// diffRules counts the rules that are only in one of the lists. Rule order matters to the kernel so the lists have
+// drifted if they are not identical, even when nothing is missing or unexpected
+func diffRules(expected, loaded []*AuditRule) (missing, unexpected int, drifted bool) {
+	counts := make(map[string]int, len(expected))
+	for _, r := range expected {
+		counts[ruleKey(r)]++
+	}
+
+	for i, r := range loaded {
+		k := ruleKey(r)
+		if i >= len(expected) || ruleKey(expected[i]) != k {
+			drifted = true
+		}
+
+		if counts[k] > 0 {
+			counts[k]--
+		} else {
+			unexpected++
+		}
+	}
+
+	for _, c := range counts {
+		missing += c
+	}
+
+	return missing, unexpected, drifted || len(expected) != len(loaded)
+}
+
+// ruleKey identifies a rule. The kernel swaps syscall class bits for the syscalls in the class, so they are left out
+func ruleKey(r *AuditRule) string {
+	c := *r
+	c.Mask[AUDIT_BITMASK_SIZE-1] &= 1<<(32-AUDIT_SYSCALL_CLASSES) - 1
+
+	b, _ := c.MarshalBinary()
+	return string(b)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleChecker_Check(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	a := parseTestRule(t, "-a exit,always -S execve")
+	b := parseTestRule(t, "-w /etc/passwd -p wa")
+
+	c := &fakeRuleClient{rules: []*AuditRule{a, b}}
+	w := &groupRecorder{}
+	rc := NewRuleChecker(c, w, []*AuditRule{a, b}, false, nil)
+
+	// Nothing changed
+	rc.Check()
+	assert.Empty(t, w.groups)
+	assert.Empty(t, elb.String())
+
+	// Rules were flushed
+	c.rules = nil
+	rc.Check()
+	assert.Equal(t, "Audit rules do not match the config, 2 missing and 0 unexpected\n", elb.String())
+	if assert.Len(t, w.groups, 1) {
+		msg := w.groups[0].Msgs[0]
+		assert.Equal(t, uint16(EVENT_RULES_DRIFT), msg.Type)
+		assert.Regexp(t, regexp.MustCompile(`^audit\([0-9]+\.[0-9]{3}:0\): op=rules_drift expected=2 loaded=0 missing=2 unexpected=0 reapply=disabled$`), msg.Data)
+		assert.Equal(t, msg.AuditTime, w.groups[0].AuditTime)
+	}
+
+	// Order matters
+	elb.Reset()
+	c.rules = []*AuditRule{b, a}
+	rc.Check()
+	assert.Equal(t, "Audit rules do not match the config, 0 missing and 0 unexpected\n", elb.String())
+	assert.Len(t, w.groups, 2)
+
+	// Reapplying puts things back, what we expect stays what the config says
+	elb.Reset()
+	w.groups = nil
+	c.rules = []*AuditRule{a, b, a}
+	rc.reapply = func() error {
+		c.rules = []*AuditRule{a, b}
+		return nil
+	}
+	rc.Check()
+	assert.Equal(t, "Audit rules do not match the config, 0 missing and 1 unexpected\n", elb.String())
+	if assert.Len(t, w.groups, 1) {
+		assert.Contains(t, w.groups[0].Msgs[0].Data, "expected=2 loaded=3 missing=0 unexpected=1 reapply=success")
+	}
+	assert.Equal(t, []*AuditRule{a, b}, rc.expected)
+
+	elb.Reset()
+	w.groups = nil
+	rc.Check()
+	assert.Empty(t, elb.String())
+	assert.Empty(t, w.groups)
+
+	// Failing to reapply is still reported
+	elb.Reset()
+	w.groups = nil
+	c.rules = []*AuditRule{b}
+	rc.reapply = func() error { return errors.New("testing") }
+	rc.Check()
+	assert.Equal(t, "Audit rules do not match the config, 1 missing and 0 unexpected\nFailed to reapply audit rules. Error: testing\n", elb.String())
+	if assert.Len(t, w.groups, 1) {
+		assert.Contains(t, w.groups[0].Msgs[0].Data, "reapply=failed")
+	}
+
+	// Listing errors are logged and nothing is emitted
+	elb.Reset()
+	w.groups = nil
+	c.listErr = errors.New("testing")
+	rc.Check()
+	assert.Equal(t, "Failed to list the loaded audit rules. Error: testing\n", elb.String())
+	assert.Empty(t, w.groups)
+	assert.Empty(t, lb.String())
+}
+
+func TestRuleChecker_CheckShared(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	a := parseTestRule(t, "-a exit,always -S execve")
+	b := parseTestRule(t, "-w /etc/passwd -p wa")
+	other := parseTestRule(t, "-a exit,always -S connect")
+
+	// Rules from the other daemon and the order they put ours in don't matter
+	c := &fakeRuleClient{rules: []*AuditRule{other, b, a}}
+	w := &groupRecorder{}
+	rc := NewRuleChecker(c, w, []*AuditRule{a, b}, true, nil)
+	rc.Check()
+	assert.Empty(t, elb.String())
+	assert.Empty(t, w.groups)
+
+	// Ours going missing does
+	c.rules = []*AuditRule{other, a}
+	rc.Check()
+	assert.Equal(t, "Audit rules do not match the config, 1 missing and 0 unexpected\n", elb.String())
+	if assert.Len(t, w.groups, 1) {
+		assert.Contains(t, w.groups[0].Msgs[0].Data, "expected=2 loaded=2 missing=1 unexpected=0 reapply=disabled")
+	}
+}
+
+func Test_expectedRules(t *testing.T) {
+	parse := func(lines ...string) []*AuditRuleCommand {
+		var cmds []*AuditRuleCommand
+		for _, line := range lines {
+			cmd, err := ParseAuditRule(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmds = append(cmds, cmd)
+		}
+		return cmds
+	}
+
+	a := parseTestRule(t, "-a exit,always -S execve")
+	b := parseTestRule(t, "-w /etc/passwd -p wa")
+	c := parseTestRule(t, "-a exit,always -S connect")
+
+	assert.Empty(t, expectedRules(nil))
+
+	// Flushes, status changes, prepends, deletes and duplicates are played out in order
+	rules := expectedRules(parse(
+		"-a exit,always -S open",
+		"-D",
+		"-b 8192",
+		"-a exit,always -S execve",
+		"-w /etc/passwd -p wa",
+		"-a always,exit -S execve",
+		"-A exit,always -S connect",
+		"-W /etc/passwd -p wa",
+		"-w /etc/passwd -p wa",
+	))
+	assert.Equal(t, []string{ruleKey(c), ruleKey(a), ruleKey(b)}, []string{ruleKey(rules[0]), ruleKey(rules[1]), ruleKey(rules[2])})
+	assert.Len(t, rules, 3)
+	assert.Zero(t, rules[0].Flags&AUDIT_FILTER_PREPEND)
+
+	// Kernel rules come back without the syscall class bits
+	loaded := *b
+	loaded.Mask[AUDIT_BITMASK_SIZE-1] = 0xffff
+	assert.Equal(t, ruleKey(b), ruleKey(&loaded))
+	assert.NotEqual(t, ruleKey(a), ruleKey(&loaded))
+}
+
+func parseTestRule(t *testing.T, line string) *AuditRule {
+	cmd, err := ParseAuditRule(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cmd.rule
+}
+
+// groupRecorder keeps every message group it is given
+type groupRecorder struct {
+	groups []*AuditMessageGroup
+}
+
+func (g *groupRecorder) Write(msg *AuditMessageGroup) error {
+	g.groups = append(g.groups, msg)
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAuditRule(t *testing.T) {
+	native, _ := nativeArch()
+	execve, _ := syscallNumber(native, "execve")
+
+	// syscall rule
+	cmd, err := ParseAuditRule("-a exit,always -F arch=b64 -S execve -F uid!=0 -F exit=-EPERM -k exec")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleAdd, cmd.op)
+	r := cmd.rule
+	assert.Equal(t, uint32(AUDIT_FILTER_EXIT), r.Flags)
+	assert.Equal(t, uint32(AUDIT_ALWAYS), r.Action)
+	assert.Equal(t, uint32(4), r.FieldCount)
+	assert.Equal(t, []uint32{AUDIT_ARCH, AUDIT_UID, AUDIT_EXIT, AUDIT_FILTERKEY}, r.Fields[:4])
+	assert.Equal(t, []uint32{AUDIT_EQUAL, AUDIT_NOT_EQUAL, AUDIT_EQUAL, AUDIT_EQUAL}, r.FieldFlags[:4])
+	assert.Equal(t, []uint32{native, 0, uint32(0xffffffff), 4}, r.Values[:4])
+	assert.Equal(t, "exec", string(r.Buf))
+	assert.Equal(t, uint32(4), r.BufLen)
+	assert.Equal(t, uint32(1)<<uint(execve%32), r.Mask[execve/32])
+
+	// order of list and action doesn't matter, prepend and delete
+	cmd, err = ParseAuditRule("-A always,task")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(AUDIT_FILTER_TASK|AUDIT_FILTER_PREPEND), cmd.rule.Flags)
+
+	cmd, err = ParseAuditRule("-d never,exit -F auid=unset")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleDelete, cmd.op)
+	assert.Equal(t, uint32(AUDIT_NEVER), cmd.rule.Action)
+	assert.Equal(t, uint32(AUDIT_UID_UNSET), cmd.rule.Values[0])
+	assert.Equal(t, uint32(0xffffffff), cmd.rule.Mask[0], "Exit rules without -S should match every syscall")
+
+	// file and dir watches
+	cmd, err = ParseAuditRule("-w /etc/passwd -p wa -k identity -k passwd")
+	assert.Nil(t, err)
+	r = cmd.rule
+	assert.Equal(t, uint32(AUDIT_FILTER_EXIT), r.Flags)
+	assert.Equal(t, uint32(AUDIT_ALWAYS), r.Action)
+	assert.Equal(t, []uint32{AUDIT_WATCH, AUDIT_PERM, AUDIT_FILTERKEY}, r.Fields[:3])
+	assert.Equal(t, []uint32{11, AUDIT_PERM_WRITE | AUDIT_PERM_ATTR, 15}, r.Values[:3])
+	assert.Equal(t, "/etc/passwdidentity\x01passwd", string(r.Buf))
+
+	cmd, err = ParseAuditRule("-W " + t.TempDir() + "/")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleDelete, cmd.op)
+	assert.Equal(t, uint32(AUDIT_DIR), cmd.rule.Fields[0])
+
+	// non rule commands
+	cmd, err = ParseAuditRule("-D")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleDeleteAll, cmd.op)
+
+	cmd, err = ParseAuditRule("-b 8192")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleSetStatus, cmd.op)
+	assert.Equal(t, &AuditStatusPayload{Mask: AUDIT_STATUS_BACKLOG_LIMIT, BacklogLimit: 8192}, cmd.status)
+
+	cmd, err = ParseAuditRule("--backlog_wait_time 60000")
+	assert.Nil(t, err)
+	assert.Equal(t, &AuditStatusPayload{Mask: AUDIT_STATUS_BACKLOG_WAIT_TIME, BacklogWaitTime: 60000}, cmd.status)
+
+	// errors
+	errs := map[string]string{
+		"":                            "Rule is empty",
+		"-D -k a":                     "-D does not take any other options",
+		"-e 3":                        "-e must be 0, 1 or 2, got 3",
+		"-r lots":                     "-r value `lots` is not a number",
+		"-a exit":                     "-a needs both a list and an action, got `exit`",
+		"-a exit,always -k":           "-k is missing a value",
+		"-a exit,always -w /etc":      "Only one of -a, -A, -d, -w or -W can be used in a rule",
+		"-a exit,always -F foo=1":     "Unknown field `foo` in -F foo=1",
+		"-a exit,always -F uid":       "Could not find an operator in -F uid",
+		"-a exit,always -F exe>/bin":  "Field `exe` only supports = and !=",
+		"-a exit,always -F pid=x":     "Invalid value for -F pid=x. Error: `x` is not a number",
+		"-a exit,always -S nope":      "Unknown syscall `nope` for arch " + archNames[native],
+		"-a exit,always -S 5000":      "Syscall number 5000 is out of range",
+		"-a task,always -S execve":    "-S can only be used with the exit or io_uring lists",
+		"-a exit,always -p w":         "-p can only be used with a watch",
+		"-w etc/passwd":               "Watch path `etc/passwd` must be absolute",
+		"-w /etc/passwd -p z":         "Unknown permission `z` in `z`",
+		"-w /etc/passwd -S execve":    "-S can not be used with a watch",
+		"-k a":                        "Rule must have one of -a, -A, -d, -w or -W",
+		"-a exit,always --loginuid 1": "Unsupported option --loginuid",
+	}
+
+	for rule, msg := range errs {
+		cmd, err = ParseAuditRule(rule)
+		assert.EqualError(t, err, msg, rule)
+		assert.Nil(t, cmd, rule)
+	}
+}
+
+func TestAuditRule_MarshalBinary(t *testing.T) {
+	cmd, err := ParseAuditRule("-a always,exit -S all -F path=/etc/shadow -k shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := cmd.rule.MarshalBinary()
+	assert.Nil(t, err)
+	assert.Len(t, b, 1040+len("/etc/shadowshadow"))
+
+	r, err := parseAuditRule(b)
+	assert.Nil(t, err)
+	assert.Equal(t, cmd.rule, r)
+
+	_, err = parseAuditRule(b[:100])
+	assert.EqualError(t, err, "Rule is too short, 100 bytes")
+
+	_, err = parseAuditRule(b[:1045])
+	assert.EqualError(t, err, "Rule is malformed")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// waitForShutdown blocks until we get a SIGTERM or SIGINT. A second one kills us right away
+func waitForShutdown() {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <-sigc
+	signal.Stop(sigc)
+	l.Printf("Got %s, shutting down\n", sig)
+}
+
+// shutdown stops receiving events, writes out every pending message group and closes the outputs.
+// If rules is not nil the kernel audit rules are put back the way they were before we started
+func shutdown(nlClient io.Closer, marshaller *AuditMarshaller, throttle *Throttle, enricher *Enricher, writer *MultiAuditWriter, c AuditRuleClient, checker *RuleChecker, rules []*AuditRule) {
+	if err := nlClient.Close(); err != nil {
+		el.Printf("Failed to close the netlink socket. Error: %s\n", err)
+	}
+
+	marshaller.Close()
+	throttle.Close()
+	enricher.Close()
+
+	if rules != nil {
+		restore := func() error { return restoreRules(c, rules) }
+
+		var err error
+		if checker != nil {
+			// Make sure the checker doesn't see the restored rules as drift and load ours again
+			err = checker.Reload(restore, rules, nil)
+		} else {
+			err = restore()
+		}
+
+		if err != nil {
+			el.Printf("Failed to restore the previous audit rules. Error: %s\n", err)
+		} else {
+			l.Printf("Restored %d audit rules that were loaded before go-audit started\n", len(rules))
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		el.Printf("Failed to close the outputs. Error: %s\n", err)
+	}
+
+	l.Println("Shut down")
+}
+
+// restoreRules replaces the loaded audit rules with the given ones
+func restoreRules(c AuditRuleClient, rules []*AuditRule) error {
+	if err := deleteAllRules(c); err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if err := c.AddRule(rule); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
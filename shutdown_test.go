@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_shutdown(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	out := &bytes.Buffer{}
+	writer := NewMultiAuditWriter()
+	writer.Add("test", NewAuditWriter(out, 1), 10)
+
+	e := NewEnricher(writer, nil, 1, 10, time.Second)
+	th := NewThrottle(e, nil, 0, 0, 0)
+	m := NewAuditMarshaller(th, uint16(1100), uint16(1399), false, false, 0, nil)
+	m.Consume(new1300("3"))
+	m.Consume(new1300("2"))
+
+	nl := &fakeCloser{}
+	c := &fakeRuleClient{rules: []*AuditRule{{}}}
+	shutdown(nl, m, th, e, writer, c, nil, []*AuditRule{{}, {}})
+
+	assert.True(t, nl.closed)
+	assert.Empty(t, m.msgs)
+	assert.Equal(t, []string{"list", "delete", "add", "add"}, c.calls)
+	assert.Equal(
+		t,
+		"{\"sequence\":2,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"arch=c000003e syscall=59\"}],\"uid_map\":{},\"arch\":\"x86_64\",\"syscall_name\":\"execve\"}\n"+
+			"{\"sequence\":3,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"arch=c000003e syscall=59\"}],\"uid_map\":{},\"arch\":\"x86_64\",\"syscall_name\":\"execve\"}\n",
+		out.String(),
+	)
+	assert.Equal(t, "Restored 2 audit rules that were loaded before go-audit started\nShut down\n", lb.String())
+	assert.Empty(t, elb.String())
+
+	// Nothing consumed after shutting down makes it out
+	m.Consume(new1300("4"))
+	assert.Empty(t, m.msgs)
+
+	// Rules are left alone unless asked, errors are logged and the rest still happens
+	lb.Reset()
+	writer = NewMultiAuditWriter()
+	e = NewEnricher(writer, nil, 1, 10, time.Second)
+	th = NewThrottle(e, nil, 0, 0, 0)
+	m = NewAuditMarshaller(th, uint16(1100), uint16(1399), false, false, 0, nil)
+	c = &fakeRuleClient{}
+	shutdown(&fakeCloser{err: errors.New("testing")}, m, th, e, writer, c, nil, nil)
+	assert.Nil(t, c.calls)
+	assert.Equal(t, "Shut down\n", lb.String())
+	assert.Equal(t, "Failed to close the netlink socket. Error: testing\n", elb.String())
+
+	// The rule checker takes the restored rules as the expected ones
+	c = &fakeRuleClient{}
+	rc := &RuleChecker{client: c, writer: &groupRecorder{}, reapply: func() error { return nil }}
+	restored := []*AuditRule{{}}
+	shutdown(&fakeCloser{}, m, th, e, NewMultiAuditWriter(), c, rc, restored)
+	assert.Nil(t, rc.reapply)
+	assert.Equal(t, restored, rc.expected)
+	assert.Equal(t, []string{"list", "add"}, c.calls)
+
+	elb.Reset()
+	c = &fakeRuleClient{listErr: errors.New("testing")}
+	shutdown(&fakeCloser{}, m, th, e, NewMultiAuditWriter(), c, nil, []*AuditRule{})
+	assert.Equal(t, "Failed to restore the previous audit rules. Error: testing\n", elb.String())
+}
+
+type fakeCloser struct {
+	closed bool
+	err    error
+}
+
+func (f *fakeCloser) Close() error {
+	f.closed = true
+	return f.err
+}
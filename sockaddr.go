@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Sockaddr is the decoded `saddr` of a SOCKADDR record
+type Sockaddr struct {
+	Family  string `json:"family"`
+	Address string `json:"address,omitempty"`
+	Port    uint16 `json:"port,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Pid     uint32 `json:"pid,omitempty"`
+}
+
+// parseSockaddr decodes the hex encoded struct sockaddr the kernel logs, returns nil if it can't be decoded
+func parseSockaddr(saddr string) *Sockaddr {
+	b, err := hex.DecodeString(saddr)
+	if err != nil || len(b) < 2 {
+		return nil
+	}
+
+	// sa_family is in host byte order, everything else we care about is in network byte order
+	family := Endianness.Uint16(b[0:2])
+	switch family {
+	case syscall.AF_INET:
+		if len(b) < 8 {
+			return nil
+		}
+
+		return &Sockaddr{
+			Family:  "inet",
+			Port:    binary.BigEndian.Uint16(b[2:4]),
+			Address: net.IP(b[4:8]).String(),
+		}
+
+	case syscall.AF_INET6:
+		if len(b) < 24 {
+			return nil
+		}
+
+		return &Sockaddr{
+			Family:  "inet6",
+			Port:    binary.BigEndian.Uint16(b[2:4]),
+			Address: net.IP(b[8:24]).String(),
+		}
+
+	case syscall.AF_UNIX:
+		path := b[2:]
+		if len(path) > 0 && path[0] == 0 {
+			// Abstract sockets start with a NUL, show them the way ss and netstat do
+			return &Sockaddr{Family: "unix", Path: "@" + strings.TrimRight(string(path[1:]), "\x00")}
+		}
+
+		if i := strings.IndexByte(string(path), 0); i >= 0 {
+			path = path[:i]
+		}
+
+		return &Sockaddr{Family: "unix", Path: string(path)}
+
+	case syscall.AF_NETLINK:
+		if len(b) < 8 {
+			return nil
+		}
+
+		return &Sockaddr{Family: "netlink", Pid: Endianness.Uint32(b[4:8])}
+	}
+
+	return &Sockaddr{Family: strconv.Itoa(int(family))}
+}
+
+// IP returns the address as a net.IP, or nil if this isn't an inet or inet6 address
+func (s *Sockaddr) IP() net.IP {
+	if s == nil || s.Address == "" {
+		return nil
+	}
+
+	return net.ParseIP(s.Address)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseSockaddr(t *testing.T) {
+	assert.Equal(t, &Sockaddr{Family: "inet", Address: "10.1.2.3", Port: 443}, parseSockaddr("020001BB0A0102030000000000000000"))
+	assert.Equal(t, &Sockaddr{Family: "inet6", Address: "fd00::1", Port: 22}, parseSockaddr("0A00001600000000FD00000000000000000000000000000100000000"))
+	assert.Equal(t, &Sockaddr{Family: "unix", Path: "/run/x.sock"}, parseSockaddr("0100"+hex.EncodeToString([]byte("/run/x.sock\x00\x00"))))
+	assert.Equal(t, &Sockaddr{Family: "unix", Path: "@foo"}, parseSockaddr("0100"+hex.EncodeToString([]byte("\x00foo"))))
+	assert.Equal(t, &Sockaddr{Family: "netlink", Pid: 1234}, parseSockaddr("10000000D204000000000000"))
+	assert.Equal(t, &Sockaddr{Family: "17"}, parseSockaddr("1100"))
+
+	// Garbage
+	assert.Nil(t, parseSockaddr(""))
+	assert.Nil(t, parseSockaddr("02"))
+	assert.Nil(t, parseSockaddr("nothex"))
+	assert.Nil(t, parseSockaddr("020001BB0A01"))
+	assert.Nil(t, parseSockaddr("0A00001600000000FD00"))
+	assert.Nil(t, parseSockaddr("1000"))
+}
+
+func TestSockaddr_IP(t *testing.T) {
+	assert.Equal(t, "10.1.2.3", parseSockaddr("020001BB0A0102030000000000000000").IP().String())
+	assert.Nil(t, parseSockaddr("0100").IP())
+
+	var s *Sockaddr
+	assert.Nil(t, s.IP())
+}
+
+func TestAuditMessageGroup_AddMessage_Sockaddr(t *testing.T) {
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1306, Data: "saddr=020001BB0A0102030000000000000000"})
+	assert.Equal(t, &Sockaddr{Family: "inet", Address: "10.1.2.3", Port: 443}, amg.Msgs[0].Sockaddr)
+
+	amg.AddMessage(&AuditMessage{Type: 1306, Data: "saddr=zz"})
+	assert.Nil(t, amg.Msgs[1].Sockaddr)
+}
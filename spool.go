@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SPOOL_HEADER_SIZE      = 8                // Length and crc32 of every record
+	SPOOL_MIN_SEGMENT_SIZE = 64 * 1024        // Smallest segment file we will create
+	SPOOL_MAX_SEGMENT_SIZE = 64 * 1024 * 1024 // Largest segment file we will create
+	SPOOL_SEGMENT_SUFFIX   = ".spool"
+	SPOOL_CURSOR_FILE      = "cursor"
+)
+
+var errSpoolClosed = errors.New("Spool is closed")
+
+// Spool is an on disk first in, first out queue of message groups.
+// Records are appended to numbered segment files and read back in the same order. Once every record in a segment
+// has been acknowledged the segment is removed. The read position is kept in a cursor file so a restart picks up
+// where the last run left off.
+type Spool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	dir         string
+	maxSize     int64
+	segmentSize int64
+	block       bool
+	closed      bool
+
+	segments []*spoolSegment // Oldest first, the last one is being appended to
+	unread   int64           // Bytes that have not been acknowledged yet
+
+	wf *os.File // Append handle for the last segment
+	rf *os.File // Read handle for the first segment
+	cf *os.File // Cursor file
+
+	readOff int64 // Offset of the next record to read in the first segment
+	pendOff int64 // Offset just past the records handed out but not yet acknowledged
+	pendSeg uint64
+	pending bool
+}
+
+type spoolSegment struct {
+	id   uint64
+	size int64
+}
+
+// OpenSpool opens or creates a spool in dir. maxSize is roughly how many bytes of unread records can be held.
+// When the spool is full the oldest segment is dropped, or Append blocks if block is set
+func OpenSpool(dir string, maxSize int64, block bool) (*Spool, error) {
+	if maxSize < SPOOL_MIN_SEGMENT_SIZE*2 {
+		return nil, fmt.Errorf("Spool max size must be at least %d bytes, %d provided", SPOOL_MIN_SEGMENT_SIZE*2, maxSize)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create spool directory. Error: %s", err)
+	}
+
+	s := &Spool{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: maxSize / 10,
+		block:       block,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	if s.segmentSize < SPOOL_MIN_SEGMENT_SIZE {
+		s.segmentSize = SPOOL_MIN_SEGMENT_SIZE
+	} else if s.segmentSize > SPOOL_MAX_SEGMENT_SIZE {
+		s.segmentSize = SPOOL_MAX_SEGMENT_SIZE
+	}
+
+	if err := s.load(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+
+	// Always start writing to a fresh segment so a record that was cut short by a crash is never appended to
+	if err := s.roll(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load finds any existing segments and the read position left behind by a previous run
+func (s *Spool) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("Failed to read spool directory. Error: %s", err)
+	}
+
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), SPOOL_SEGMENT_SUFFIX) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), SPOOL_SEGMENT_SUFFIX), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return fmt.Errorf("Failed to stat spool segment %s. Error: %s", e.Name(), err)
+		}
+
+		s.segments = append(s.segments, &spoolSegment{id: id, size: info.Size()})
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	s.cf, err = os.OpenFile(filepath.Join(s.dir, SPOOL_CURSOR_FILE), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open spool cursor. Error: %s", err)
+	}
+
+	cursor := make([]byte, 16)
+	if n, _ := s.cf.ReadAt(cursor, 0); n == len(cursor) {
+		seg := Endianness.Uint64(cursor[0:8])
+		off := int64(Endianness.Uint64(cursor[8:16]))
+
+		// Anything before the cursor segment was already sent
+		for len(s.segments) > 0 && s.segments[0].id < seg {
+			s.removeFirst()
+		}
+
+		if len(s.segments) > 0 && s.segments[0].id == seg && off <= s.segments[0].size {
+			s.readOff = off
+		}
+	}
+
+	for _, seg := range s.segments {
+		s.unread += seg.size
+	}
+	s.unread -= s.readOff
+
+	return nil
+}
+
+// Append adds a message group to the end of the spool
+func (s *Spool) Append(msg *AuditMessageGroup) error {
+	payload := &bytes.Buffer{}
+	payload.Write(make([]byte, SPOOL_HEADER_SIZE))
+	if err := gob.NewEncoder(payload).Encode(msg); err != nil {
+		return fmt.Errorf("Failed to encode message group for the spool. Error: %s", err)
+	}
+
+	rec := payload.Bytes()
+	Endianness.PutUint32(rec[0:4], uint32(len(rec)-SPOOL_HEADER_SIZE))
+	Endianness.PutUint32(rec[4:8], crc32.ChecksumIEEE(rec[SPOOL_HEADER_SIZE:]))
+	size := int64(len(rec))
+	if size > s.segmentSize {
+		return fmt.Errorf("Message group %d is too large for the spool, %d bytes", msg.Seq, size)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.closed && s.unread+size > s.maxSize {
+		if s.block {
+			s.cond.Wait()
+			continue
+		}
+
+		if len(s.segments) == 1 {
+			if err := s.roll(); err != nil {
+				return err
+			}
+		}
+
+		s.dropFirst()
+	}
+
+	if s.closed {
+		return errSpoolClosed
+	}
+
+	last := s.segments[len(s.segments)-1]
+	if last.size > 0 && last.size+size > s.segmentSize {
+		if err := s.roll(); err != nil {
+			return err
+		}
+		last = s.segments[len(s.segments)-1]
+	}
+
+	n, err := s.wf.Write(rec)
+	last.size += int64(n)
+	s.unread += int64(n)
+	if err != nil {
+		return fmt.Errorf("Failed to write to spool. Error: %s", err)
+	}
+
+	s.cond.Broadcast()
+	return nil
+}
+
+// Next returns the oldest message group that has not been acknowledged, blocking until one is available.
+// The same group is returned until Ack is called
+func (s *Spool) Next() (*AuditMessageGroup, error) {
+	msgs, err := s.NextBatch(1, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return msgs[0], nil
+}
+
+// NextBatch returns up to max of the oldest message groups that have not been acknowledged. It blocks until one is
+// available and then waits at most wait for more. A batch never spans segments. The same groups are returned until
+// Ack is called
+func (s *Spool) NextBatch(max int, wait time.Duration) ([]*AuditMessageGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []*AuditMessageGroup
+	var timer *time.Timer
+	expired := false
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		if s.closed {
+			return nil, errSpoolClosed
+		}
+
+		seg := s.segments[0]
+		if len(msgs) > 0 && seg.id != s.pendSeg {
+			// The segment was dropped to make room while we waited, and what we read from it with it
+			msgs = nil
+		}
+
+		off := s.readOff
+		if len(msgs) > 0 {
+			off = s.pendOff
+		}
+
+		if off >= seg.size {
+			if len(msgs) > 0 && (expired || len(s.segments) > 1) {
+				return msgs, nil
+			}
+
+			if len(msgs) == 0 && len(s.segments) > 1 {
+				s.removeFirst()
+				continue
+			}
+
+			if len(msgs) > 0 && timer == nil {
+				timer = time.AfterFunc(wait, func() {
+					s.mu.Lock()
+					defer s.mu.Unlock()
+
+					expired = true
+					s.cond.Broadcast()
+				})
+			}
+
+			// Caught up with the writer
+			s.cond.Wait()
+			continue
+		}
+
+		msg, next, err := s.read(seg, off)
+		if err != nil {
+			if len(msgs) > 0 {
+				// Hand out what we have, the bad record is skipped on the next call
+				return msgs, nil
+			}
+
+			el.Printf("Skipping the rest of spool segment %d. Error: %s\n", seg.id, err)
+			s.unread -= seg.size - s.readOff
+			s.readOff = seg.size
+			continue
+		}
+
+		msgs = append(msgs, msg)
+		s.pendSeg = seg.id
+		s.pendOff = next
+		s.pending = true
+
+		if len(msgs) >= max {
+			return msgs, nil
+		}
+	}
+}
+
+// Ack marks the groups returned by the last call to Next or NextBatch as sent
+func (s *Spool) Ack() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The segment may have been dropped while the group was being sent
+	if !s.pending || s.segments[0].id != s.pendSeg {
+		s.pending = false
+		return
+	}
+
+	s.unread -= s.pendOff - s.readOff
+	s.readOff = s.pendOff
+	s.pending = false
+	s.saveCursor()
+	s.cond.Broadcast()
+}
+
+// Close wakes up anyone waiting on the spool and closes the files. Unread records stay on disk for the next run
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	s.cond.Broadcast()
+	return s.closeFiles()
+}
+
+func (s *Spool) read(seg *spoolSegment, off int64) (*AuditMessageGroup, int64, error) {
+	if s.rf == nil {
+		f, err := os.Open(s.segmentPath(seg.id))
+		if err != nil {
+			return nil, 0, err
+		}
+		s.rf = f
+	}
+
+	header := make([]byte, SPOOL_HEADER_SIZE)
+	if _, err := s.rf.ReadAt(header, off); err != nil {
+		return nil, 0, fmt.Errorf("Failed to read record header: %s", err)
+	}
+
+	length := int64(Endianness.Uint32(header[0:4]))
+	if off+SPOOL_HEADER_SIZE+length > seg.size {
+		return nil, 0, errors.New("Record is truncated")
+	}
+
+	payload := make([]byte, length)
+	if _, err := s.rf.ReadAt(payload, off+SPOOL_HEADER_SIZE); err != nil && err != io.EOF {
+		return nil, 0, fmt.Errorf("Failed to read record: %s", err)
+	}
+
+	if crc32.ChecksumIEEE(payload) != Endianness.Uint32(header[4:8]) {
+		return nil, 0, errors.New("Record checksum mismatch")
+	}
+
+	msg := &AuditMessageGroup{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(msg); err != nil {
+		return nil, 0, fmt.Errorf("Failed to decode record: %s", err)
+	}
+
+	// gob leaves out empty maps
+	if msg.UidMap == nil {
+		msg.UidMap = make(map[string]string)
+	}
+
+	return msg, off + SPOOL_HEADER_SIZE + length, nil
+}
+
+// roll starts a new segment for writing
+func (s *Spool) roll() error {
+	var id uint64 = 1
+	if len(s.segments) > 0 {
+		id = s.segments[len(s.segments)-1].id + 1
+	}
+
+	f, err := os.OpenFile(s.segmentPath(id), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create spool segment. Error: %s", err)
+	}
+
+	if s.wf != nil {
+		s.wf.Close()
+	}
+
+	s.wf = f
+	s.segments = append(s.segments, &spoolSegment{id: id})
+	return nil
+}
+
+// dropFirst throws away the oldest segment and everything that was left unread in it
+func (s *Spool) dropFirst() {
+	seg := s.segments[0]
+	if seg.size > s.readOff {
+		el.Printf("Spool %s is full, dropped %d of the oldest message groups\n", s.dir, s.countRecords(seg, s.readOff))
+		s.unread -= seg.size - s.readOff
+	}
+
+	s.removeFirst()
+	s.saveCursor()
+}
+
+// removeFirst deletes the oldest segment from disk
+func (s *Spool) removeFirst() {
+	seg := s.segments[0]
+	if s.rf != nil {
+		s.rf.Close()
+		s.rf = nil
+	}
+
+	if err := os.Remove(s.segmentPath(seg.id)); err != nil && !os.IsNotExist(err) {
+		el.Printf("Failed to remove spool segment %d. Error: %s\n", seg.id, err)
+	}
+
+	s.segments = s.segments[1:]
+	s.readOff = 0
+}
+
+// countRecords walks the record headers in a segment starting at off
+func (s *Spool) countRecords(seg *spoolSegment, off int64) int {
+	f, err := os.Open(s.segmentPath(seg.id))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	count := 0
+	header := make([]byte, SPOOL_HEADER_SIZE)
+	for off < seg.size {
+		if _, err := f.ReadAt(header, off); err != nil {
+			break
+		}
+
+		off += SPOOL_HEADER_SIZE + int64(Endianness.Uint32(header[0:4]))
+		count++
+	}
+
+	return count
+}
+
+func (s *Spool) saveCursor() {
+	if len(s.segments) == 0 || s.cf == nil {
+		return
+	}
+
+	cursor := make([]byte, 16)
+	Endianness.PutUint64(cursor[0:8], s.segments[0].id)
+	Endianness.PutUint64(cursor[8:16], uint64(s.readOff))
+	if _, err := s.cf.WriteAt(cursor, 0); err != nil {
+		el.Printf("Failed to save spool cursor. Error: %s\n", err)
+	}
+}
+
+func (s *Spool) closeFiles() error {
+	var err error
+	for _, f := range []*os.File{s.wf, s.rf, s.cf} {
+		if f == nil {
+			continue
+		}
+
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	s.wf, s.rf, s.cf = nil, nil, nil
+	return err
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, SPOOL_SEGMENT_SUFFIX))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenSpool(t *testing.T) {
+	s, err := OpenSpool(t.TempDir(), 1024, false)
+	assert.EqualError(t, err, "Spool max size must be at least 131072 bytes, 1024 provided")
+	assert.Nil(t, s)
+
+	s, err = OpenSpool("/proc/go-audit/spool", 1024*1024, false)
+	assert.EqualError(t, err, "Failed to create spool directory. Error: mkdir /proc/go-audit: no such file or directory")
+	assert.Nil(t, s)
+}
+
+func TestSpool_AppendNextAck(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir, 1024*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, s.Append(newSpoolGroup(i)))
+	}
+
+	// Next keeps handing out the same group until it is acknowledged
+	msg, err := s.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, msg.Seq)
+	msg, err = s.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, msg.Seq)
+	assert.Equal(t, "syscall=59", msg.Msgs[0].Data)
+	assert.Equal(t, "59", msg.Syscall)
+	assert.NotNil(t, msg.UidMap)
+
+	s.Ack()
+	msg, err = s.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, msg.Seq)
+	s.Ack()
+	assert.Nil(t, s.Close())
+
+	// Only the unacknowledged group should come back after a restart
+	s, err = OpenSpool(dir, 1024*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = s.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, msg.Seq)
+	s.Ack()
+
+	assert.Nil(t, s.Append(newSpoolGroup(4)))
+	msg, err = s.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, msg.Seq)
+	s.Ack()
+
+	// Fully read segments should be cleaned up
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+SPOOL_SEGMENT_SUFFIX))
+	assert.Len(t, segments, 1)
+
+	// Next blocks until something is appended or the spool is closed
+	done := make(chan error)
+	go func() {
+		_, err := s.Next()
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Next should have blocked on an empty spool")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.Close()
+	assert.Equal(t, errSpoolClosed, <-done)
+	assert.Equal(t, errSpoolClosed, s.Append(newSpoolGroup(5)))
+}
+
+func TestSpool_NextBatch(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir, 1024*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		assert.Nil(t, s.Append(newSpoolGroup(i)))
+	}
+
+	// A full batch comes back right away, and again until it is acknowledged
+	msgs, err := s.NextBatch(3, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3}, spoolSeqs(msgs))
+	msgs, err = s.NextBatch(3, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3}, spoolSeqs(msgs))
+	s.Ack()
+
+	// A partial batch waits for more until the wait is up
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.Append(newSpoolGroup(6))
+	}()
+
+	start := time.Now()
+	msgs, err = s.NextBatch(10, 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{4, 5, 6}, spoolSeqs(msgs))
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+	assert.Nil(t, s.Close())
+
+	// Nothing was acknowledged past 3
+	s, err = OpenSpool(dir, 1024*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	msgs, err = s.NextBatch(10, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{4, 5, 6}, spoolSeqs(msgs))
+}
+
+func spoolSeqs(msgs []*AuditMessageGroup) []int {
+	var seqs []int
+	for _, msg := range msgs {
+		seqs = append(seqs, msg.Seq)
+	}
+	return seqs
+}
+
+func TestSpool_DropOldest(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	dir := t.TempDir()
+	s, err := OpenSpool(dir, SPOOL_MIN_SEGMENT_SIZE*2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	i := 1
+	for ; elb.Len() == 0; i++ {
+		assert.Nil(t, s.Append(newSpoolGroup(i)))
+	}
+
+	assert.Empty(t, lb.String())
+	assert.Regexp(t, "^Spool "+dir+" is full, dropped [0-9]+ of the oldest message groups\n$", elb.String())
+
+	// The oldest groups are gone but the newest one is still there
+	msg, err := s.Next()
+	assert.Nil(t, err)
+	assert.True(t, msg.Seq > 1, "The first message group should have been dropped")
+
+	last := msg.Seq
+	for ; last < i-1; last++ {
+		s.Ack()
+		msg, err = s.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, last+1, msg.Seq, "Message groups should be in order")
+	}
+}
+
+func TestSpool_Block(t *testing.T) {
+	s, err := OpenSpool(t.TempDir(), SPOOL_MIN_SEGMENT_SIZE*2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Fill it up
+	msg := newSpoolGroup(1)
+	assert.Nil(t, s.Append(msg))
+	size := s.unread
+	for s.unread+size <= s.maxSize {
+		assert.Nil(t, s.Append(msg))
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.Append(msg)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Append should have blocked on a full spool")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Reading frees up space
+	_, err = s.Next()
+	assert.Nil(t, err)
+	s.Ack()
+
+	assert.Nil(t, <-done)
+}
+
+func TestSpool_Corrupt(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	dir := t.TempDir()
+	s, err := OpenSpool(dir, 1024*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, s.Append(newSpoolGroup(1)))
+	assert.Nil(t, s.Append(newSpoolGroup(2)))
+	s.Close()
+
+	// Flip a byte in the middle of the first record
+	f, err := os.OpenFile(s.segmentPath(1), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff}, SPOOL_HEADER_SIZE+10)
+	f.Close()
+
+	s, err = OpenSpool(dir, 1024*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	assert.Nil(t, s.Append(newSpoolGroup(3)))
+	msg, err := s.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, msg.Seq)
+	assert.Empty(t, lb.String())
+	assert.Equal(t, "Skipping the rest of spool segment 1. Error: Record checksum mismatch\n", elb.String())
+}
+
+func newSpoolGroup(seq int) *AuditMessageGroup {
+	return &AuditMessageGroup{
+		Seq:       seq,
+		AuditTime: "10000001",
+		Msgs:      []*AuditMessage{{Type: 1300, Data: "syscall=59"}},
+		UidMap:    map[string]string{},
+		Syscall:   "59",
+	}
+}
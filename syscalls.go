@@ -0,0 +1,121 @@
+package main
+
+//go:generate go run mksyscalls.go
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Audit arch values, see AUDIT_ARCH_* in linux/audit.h
+const (
+	AUDIT_ARCH_X86_64      = 0xc000003e
+	AUDIT_ARCH_I386        = 0x40000003
+	AUDIT_ARCH_AARCH64     = 0xc00000b7
+	AUDIT_ARCH_ARM         = 0x40000028
+	AUDIT_ARCH_PPC64       = 0x80000015
+	AUDIT_ARCH_PPC64LE     = 0xc0000015
+	AUDIT_ARCH_S390X       = 0x80000016
+	AUDIT_ARCH_RISCV64     = 0xc00000f3
+	AUDIT_ARCH_LOONGARCH64 = 0xc0000102
+)
+
+// archNames are the names auditctl and ausyscall use for each arch
+var archNames = map[uint32]string{
+	AUDIT_ARCH_X86_64:      "x86_64",
+	AUDIT_ARCH_I386:        "i386",
+	AUDIT_ARCH_AARCH64:     "aarch64",
+	AUDIT_ARCH_ARM:         "arm",
+	AUDIT_ARCH_PPC64:       "ppc64",
+	AUDIT_ARCH_PPC64LE:     "ppc64le",
+	AUDIT_ARCH_S390X:       "s390x",
+	AUDIT_ARCH_RISCV64:     "riscv64",
+	AUDIT_ARCH_LOONGARCH64: "loongarch64",
+}
+
+// goArches maps GOARCH to the native audit arch and, if there is one, the 32 bit compat arch
+var goArches = map[string][2]uint32{
+	"amd64":   {AUDIT_ARCH_X86_64, AUDIT_ARCH_I386},
+	"386":     {AUDIT_ARCH_I386, 0},
+	"arm64":   {AUDIT_ARCH_AARCH64, AUDIT_ARCH_ARM},
+	"arm":     {AUDIT_ARCH_ARM, 0},
+	"ppc64":   {AUDIT_ARCH_PPC64, 0},
+	"ppc64le": {AUDIT_ARCH_PPC64LE, 0},
+	"s390x":   {AUDIT_ARCH_S390X, 0},
+	"riscv64": {AUDIT_ARCH_RISCV64, 0},
+	"loong64": {AUDIT_ARCH_LOONGARCH64, 0},
+}
+
+// syscallNumbers is the reverse of syscallNames
+var syscallNumbers = map[uint32]map[string]int{}
+
+func init() {
+	for arch, names := range syscallNames {
+		syscallNumbers[arch] = make(map[string]int, len(names))
+		for num, name := range names {
+			if name != "" {
+				syscallNumbers[arch][name] = num
+			}
+		}
+	}
+}
+
+// nativeArch returns the audit arch for the machine we are running on and the 32 bit compat arch, or 0 if there is none
+func nativeArch() (uint32, uint32) {
+	a := goArches[runtime.GOARCH]
+	return a[0], a[1]
+}
+
+// parseArch turns an arch name, b32, b64 or a number into an audit arch
+func parseArch(s string) (uint32, bool) {
+	native, compat := nativeArch()
+	switch s {
+	case "b64":
+		return native, native&0x80000000 != 0
+	case "b32":
+		if native&0x80000000 == 0 {
+			return native, native != 0
+		}
+		return compat, compat != 0
+	}
+
+	for arch, name := range archNames {
+		if name == s {
+			return arch, true
+		}
+	}
+
+	if v, err := strconv.ParseUint(s, 0, 32); err == nil {
+		return uint32(v), true
+	}
+
+	return 0, false
+}
+
+// syscallName returns the name of a syscall number for an audit arch, or an empty string if it is unknown
+func syscallName(arch uint32, num int) string {
+	names := syscallNames[arch]
+	if num < 0 || num >= len(names) {
+		return ""
+	}
+
+	return names[num]
+}
+
+// syscallNumber returns the number of a named syscall for an audit arch
+func syscallNumber(arch uint32, name string) (int, bool) {
+	num, ok := syscallNumbers[arch][strings.ToLower(name)]
+	return num, ok
+}
+
+// isSyscallName checks if name is a syscall on any arch we know about
+func isSyscallName(name string) bool {
+	for _, names := range syscallNumbers {
+		if _, ok := names[name]; ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	SYSLOG_TIMEOUT   = time.Second * 10                // Time to connect to the syslog server or to write a message to it
+	SYSLOG_MAX_PRI   = 191                             // local7 | debug
+	SYSLOG_TIMESTAMP = "2006-01-02T15:04:05.000Z07:00" // Audit timestamps have millisecond precision
+)
+
+// rfc5424Writer writes every line it is given as an RFC 5424 syslog message. Over stream sockets messages are framed
+// with octet counting from RFC 6587, or ended with a newline. The connection is made again if it breaks
+type rfc5424Writer struct {
+	network  string
+	address  string
+	tls      *tls.Config
+	stream   bool
+	octets   bool // Octet counting framing, otherwise messages end with a newline
+	priority int
+	hostname string
+	tag      string
+	pid      string
+	sdID     string // Structured data id of the element with the event details, empty to leave it out
+	conn     net.Conn
+	msg      *AuditMessageGroup // Message group being written
+	buf      bytes.Buffer
+	now      func() time.Time
+}
+
+func createRFC5424Output(config *viper.Viper, attempts int) (*AuditWriter, error) {
+	priority := config.GetInt("output.syslog.priority")
+	if priority < 0 || priority > SYSLOG_MAX_PRI {
+		return nil, fmt.Errorf("Output priority for syslog must be between 0 and %d, got %d", SYSLOG_MAX_PRI, priority)
+	}
+
+	network, address := config.GetString("output.syslog.network"), config.GetString("output.syslog.address")
+	if network == "" || address == "" {
+		return nil, fmt.Errorf("Output network and address for syslog must be set when the format is rfc5424")
+	}
+
+	var octets bool
+	switch framing := config.GetString("output.syslog.framing"); framing {
+	case "octet_counting":
+		octets = true
+	case "non_transparent":
+	default:
+		return nil, fmt.Errorf("Output framing for syslog must be `octet_counting` or `non_transparent`, got `%s`", framing)
+	}
+
+	// Only IANA can hand out ids without an enterprise number, the one we would use in examples is RFC 5612's and not
+	// meant to show up on the wire, so there is no default
+	sdID := config.GetString("output.syslog.sd_id")
+	if sdID == "" {
+		return nil, fmt.Errorf("Output sd_id for syslog must be set when the format is rfc5424, like `go-audit@<your private enterprise number>`")
+	}
+
+	if !isSyslogSDID(sdID) {
+		return nil, fmt.Errorf("Output sd_id for syslog must be `name@<private enterprise number>`, got `%s`", sdID)
+	}
+
+	tlsConfig, err := createTLSConfig(config, "output.syslog.tls")
+	if err != nil {
+		return nil, err
+	}
+
+	stream := strings.HasPrefix(network, "tcp") || network == "unix"
+	if tlsConfig != nil && !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("Output network for syslog must be tcp to use tls, got `%s`", network)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the hostname for syslog. Error: %s", err)
+	}
+
+	w := &rfc5424Writer{
+		network:  network,
+		address:  address,
+		tls:      tlsConfig,
+		stream:   stream,
+		octets:   octets,
+		priority: priority,
+		hostname: hostname,
+		tag:      config.GetString("output.syslog.tag"),
+		pid:      strconv.Itoa(os.Getpid()),
+		sdID:     sdID,
+		now:      time.Now,
+	}
+
+	if err := w.connect(); err != nil {
+		return nil, fmt.Errorf("Failed to open syslog writer. Error: %v", err)
+	}
+
+	return NewAuditWriter(w, attempts), nil
+}
+
+// Next is called by the AuditWriter with every message group before it is written
+func (w *rfc5424Writer) Next(msg *AuditMessageGroup) {
+	w.msg = msg
+}
+
+// Write sends a line as one syslog message, connecting first if the last write broke the connection
+func (w *rfc5424Writer) Write(p []byte) (int, error) {
+	if w.conn == nil {
+		if err := w.connect(); err != nil {
+			return 0, err
+		}
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(SYSLOG_TIMEOUT))
+	if _, err := w.conn.Write(w.format(bytes.TrimSuffix(p, []byte("\n")))); err != nil {
+		// Whatever made it out is lost with the connection, the AuditWriter retries the whole message
+		w.conn.Close()
+		w.conn = nil
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close closes the connection to the syslog server
+func (w *rfc5424Writer) Close() error {
+	if w.conn == nil {
+		return nil
+	}
+
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+func (w *rfc5424Writer) connect() error {
+	dialer := &net.Dialer{Timeout: SYSLOG_TIMEOUT}
+
+	var err error
+	if w.tls != nil {
+		w.conn, err = tls.DialWithDialer(dialer, w.network, w.address, w.tls)
+	} else {
+		w.conn, err = dialer.Dial(w.network, w.address)
+	}
+
+	if err != nil {
+		w.conn = nil
+	}
+
+	return err
+}
+
+// format builds the syslog message with its framing, the structured data is `-` without an sd_id
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [name@pen host="" seq="" syscall=""] MSG
+func (w *rfc5424Writer) format(msg []byte) []byte {
+	b := &w.buf
+	b.Reset()
+
+	timestamp := w.now()
+	if w.msg != nil {
+		if t, ok := parseAuditTime(w.msg.AuditTime); ok {
+			timestamp = t
+		}
+	}
+
+	fmt.Fprintf(b, "<%d>1 %s %s %s %s - ", w.priority, timestamp.UTC().Format(SYSLOG_TIMESTAMP),
+		syslogHeaderValue(w.hostname), syslogHeaderValue(w.tag), w.pid)
+
+	w.structuredData(b)
+	b.Write(msg)
+
+	if !w.stream {
+		return b.Bytes()
+	}
+
+	if !w.octets {
+		b.WriteByte('\n')
+		return b.Bytes()
+	}
+
+	return append([]byte(strconv.Itoa(b.Len())+" "), b.Bytes()...)
+}
+
+// structuredData writes the element with the event details
+func (w *rfc5424Writer) structuredData(b *bytes.Buffer) {
+	fmt.Fprintf(b, "[%s host=\"%s\"", w.sdID, syslogParamValue(w.hostname))
+
+	if w.msg != nil {
+		fmt.Fprintf(b, " seq=\"%d\"", w.msg.Seq)
+
+		syscall := w.msg.SyscallName
+		if syscall == "" {
+			syscall = w.msg.Syscall
+		}
+
+		if syscall != "" {
+			fmt.Fprintf(b, " syscall=\"%s\"", syslogParamValue(syscall))
+		}
+	}
+
+	b.WriteString("] ")
+}
+
+// isSyslogSDID reports if s is an SD-ID with a private enterprise number, like `go-audit@32473`
+func isSyslogSDID(s string) bool {
+	name, pen, ok := strings.Cut(s, "@")
+	if !ok || name == "" || pen == "" || len(s) > 32 {
+		return false
+	}
+
+	for _, r := range name {
+		if r < 33 || r > 126 || r == '=' || r == ']' || r == '"' {
+			return false
+		}
+	}
+
+	for _, part := range strings.Split(pen, ".") {
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseAuditTime parses the `seconds.milliseconds` timestamp of an audit message
+func parseAuditTime(s string) (time.Time, bool) {
+	secs, frac, _ := strings.Cut(s, ".")
+
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var ms int64
+	if frac != "" {
+		if ms, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return time.Time{}, false
+		}
+	}
+
+	return time.Unix(sec, ms*int64(time.Millisecond)), true
+}
+
+// syslogHeaderValue makes a header field safe, they are printable US-ASCII without spaces and can not be empty
+func syslogHeaderValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, s)
+
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// syslogParamValue escapes the characters that are special inside a structured data parameter value
+func syslogParamValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRFC5424Config(network, address string) *viper.Viper {
+	c := viper.New()
+	c.Set("output.syslog.attempts", 3)
+	c.Set("output.syslog.format", "rfc5424")
+	c.Set("output.syslog.network", network)
+	c.Set("output.syslog.address", address)
+	c.Set("output.syslog.priority", 132)
+	c.Set("output.syslog.tag", "go-audit")
+	c.Set("output.syslog.framing", "octet_counting")
+	c.Set("output.syslog.sd_id", "go-audit@32473")
+	return c
+}
+
+// readOctetCounted reads one RFC 6587 octet counted message
+func readOctetCounted(r *bufio.Reader) (string, error) {
+	n, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+
+	size, err := strconv.Atoi(strings.TrimSuffix(n, " "))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, size)
+	_, err = io.ReadFull(r, msg)
+	return string(msg), err
+}
+
+func Test_rfc5424Writer_format(t *testing.T) {
+	w := &rfc5424Writer{
+		stream:   true,
+		octets:   true,
+		priority: 132,
+		hostname: "host-1",
+		tag:      "go audit",
+		pid:      "42",
+		sdID:     "go-audit@32473",
+		now:      func() time.Time { return time.Unix(1700000001, 0) },
+	}
+
+	g := NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 7, AuditTime: "1700000000.123"})
+	g.SyscallName = "execve"
+	w.Next(g)
+
+	expected := `<132>1 2023-11-14T22:13:20.123Z host-1 goaudit 42 - [go-audit@32473 host="host-1" seq="7" syscall="execve"] {"a":1}`
+	assert.Equal(t, strconv.Itoa(len(expected))+" "+expected, string(w.format([]byte(`{"a":1}`))))
+
+	// Newline framing, the syscall number when there is no name and the current time without an audit time
+	w.octets = false
+	g.SyscallName, g.Syscall, g.AuditTime = "", "59", "nope"
+	assert.Equal(
+		t,
+		`<132>1 2023-11-14T22:13:21.000Z host-1 goaudit 42 - [go-audit@32473 host="host-1" seq="7" syscall="59"] x`+"\n",
+		string(w.format([]byte("x"))),
+	)
+
+	// Datagrams are not framed, parameter values are escaped
+	w.stream = false
+	w.hostname = `h"o]s\t`
+	g.Syscall = ""
+	assert.Equal(
+		t,
+		`<132>1 2023-11-14T22:13:21.000Z h"o]s\t goaudit 42 - [go-audit@32473 host="h\"o\]s\\t" seq="7"] x`,
+		string(w.format([]byte("x"))),
+	)
+}
+
+func Test_isSyslogSDID(t *testing.T) {
+	for _, id := range []string{"go-audit@32473", "a@1", "audit@32473.1.2"} {
+		assert.True(t, isSyslogSDID(id), id)
+	}
+
+	for _, id := range []string{"", "go-audit", "@32473", "go-audit@", "go audit@32473", "go=audit@32473", "go-audit@pen", "go-audit@32473.", "a@b@1", "a-very-long-name-for-an-sd-id@32473"} {
+		assert.False(t, isSyslogSDID(id), id)
+	}
+}
+
+func TestRFC5424Output(t *testing.T) {
+	hookLogger()
+	defer resetLogger()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+
+	w, err := createSyslogOutput(newRFC5424Config("tcp", l.Addr().String()))
+	assert.Nil(t, err)
+	assert.IsType(t, &rfc5424Writer{}, w.w)
+
+	c := <-conns
+	r := bufio.NewReader(c)
+
+	g := NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 1, AuditTime: "1700000000.123", Data: "one"})
+	assert.Nil(t, w.Write(g))
+
+	msg, err := readOctetCounted(r)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(msg, "<132>1 2023-11-14T22:13:20.123Z "), msg)
+	assert.Contains(t, msg, ` go-audit `+strconv.Itoa(os.Getpid())+` - [go-audit@32473 host="`)
+	assert.True(t, strings.HasSuffix(msg, `] {"sequence":1,"timestamp":"1700000000.123","messages":[{"type":1300,"data":"one"}],"uid_map":{}}`), msg)
+
+	// The server drops the connection, writes fail until a new one is made
+	c.Close()
+
+	var c2 net.Conn
+	for i := 2; c2 == nil && i < 10; i++ {
+		assert.Nil(t, w.Write(NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: i, AuditTime: "1", Data: "again"})))
+
+		select {
+		case c2 = <-conns:
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+
+	if assert.NotNil(t, c2) {
+		msg, err = readOctetCounted(bufio.NewReader(c2))
+		assert.Nil(t, err)
+		assert.Contains(t, msg, `"data":"again"`)
+		c2.Close()
+	}
+
+	assert.Nil(t, w.Close())
+}
+
+func TestRFC5424Output_TLS(t *testing.T) {
+	cert, key := newTestCert(t)
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pem, _ := os.ReadFile(cert)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		msg, err := bufio.NewReader(c).ReadString('\n')
+		if err == nil && len(c.(*tls.Conn).ConnectionState().PeerCertificates) == 1 {
+			received <- msg
+		}
+		close(received)
+	}()
+
+	config := newRFC5424Config("tcp", l.Addr().String())
+	config.Set("output.syslog.framing", "non_transparent")
+	config.Set("output.syslog.tls.enabled", true)
+	config.Set("output.syslog.tls.ca", cert)
+	config.Set("output.syslog.tls.cert", cert)
+	config.Set("output.syslog.tls.key", key)
+
+	w, err := createSyslogOutput(config)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Write(NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 1, AuditTime: "1", Data: "secret"})))
+
+	msg := <-received
+	assert.True(t, strings.HasPrefix(msg, "<132>1 1970-01-01T00:00:01.000Z "), msg)
+	assert.True(t, strings.HasSuffix(msg, "\"data\":\"secret\"}],\"uid_map\":{}}\n"), msg)
+	assert.Nil(t, w.Close())
+}
+
+func TestRFC5424Output_UDP(t *testing.T) {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	w, err := createSyslogOutput(newRFC5424Config("udp", l.LocalAddr().String()))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Write(NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 1, AuditTime: "1", Data: "one"})))
+
+	buf := make([]byte, 65536)
+	l.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, err := l.Read(buf)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "<132>1 "))
+	assert.True(t, strings.HasSuffix(string(buf[:n]), `"uid_map":{}}`))
+	assert.Nil(t, w.Close())
+}
+
+func Test_createRFC5424Output(t *testing.T) {
+	tests := []struct {
+		name string
+		set  map[string]interface{}
+		err  string
+	}{
+		{"format", map[string]interface{}{"format": "rfc9999"}, "Output format for syslog must be `rfc3164` or `rfc5424`, got `rfc9999`"},
+		{"priority", map[string]interface{}{"priority": 192}, "Output priority for syslog must be between 0 and 191, got 192"},
+		{"address", map[string]interface{}{"address": ""}, "Output network and address for syslog must be set when the format is rfc5424"},
+		{"framing", map[string]interface{}{"framing": "lines"}, "Output framing for syslog must be `octet_counting` or `non_transparent`, got `lines`"},
+		{"sd_id missing", map[string]interface{}{"sd_id": ""}, "Output sd_id for syslog must be set when the format is rfc5424, like `go-audit@<your private enterprise number>`"},
+		{"sd_id", map[string]interface{}{"sd_id": "go-audit"}, "Output sd_id for syslog must be `name@<private enterprise number>`, got `go-audit`"},
+		{"tls over udp", map[string]interface{}{"network": "udp", "tls.enabled": true}, "Output network for syslog must be tcp to use tls, got `udp`"},
+		{"tls", map[string]interface{}{"tls.enabled": true, "tls.cert": "/cert"}, "output.syslog.tls.cert and output.syslog.tls.key must be set together"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newRFC5424Config("tcp", "127.0.0.1:514")
+			for k, v := range test.set {
+				c.Set("output.syslog."+k, v)
+			}
+
+			w, err := createSyslogOutput(c)
+			assert.EqualError(t, err, test.err)
+			assert.Nil(t, w)
+		})
+	}
+
+	// Nothing is listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	w, err := createSyslogOutput(newRFC5424Config("tcp", addr))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Failed to open syslog writer. Error: dial tcp "+addr+": connect: connection refused")
+	}
+	assert.Nil(t, w)
+}
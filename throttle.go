@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	DEDUP_WINDOW            = time.Minute // How long repeats of an event are held back by default
+	DEDUP_MAX_KEYS          = 10000       // Most distinct events tracked at once, anything new after that is let through
+	THROTTLE_FLUSH_INTERVAL = time.Second // How often summaries are written
+)
+
+// Throttle sits between the marshaller and the outputs. It holds back repeats of the same event within a window and
+// caps how many message groups go out each second. Whatever is held back is reported in summary events
+type Throttle struct {
+	mu      sync.Mutex
+	writer  GroupWriter
+	keys    []fieldRef // Fields that make two events the same, nil if deduplication is disabled
+	window  time.Duration
+	maxKeys int
+	seen    map[string]*dedupEntry
+
+	limit    int // Message groups per second, 0 is unlimited
+	tokens   float64
+	refilled time.Time
+	dropped  int
+
+	now       func() time.Time
+	eventTime bool      // Windows and the rate limit follow the audit timestamps of the groups instead of the clock
+	last      time.Time // Latest audit timestamp seen when eventTime is set
+	closed    bool
+	done      chan struct{}
+}
+
+type dedupEntry struct {
+	fields     string    // key=value pairs of the fields the event was matched on
+	first      time.Time // When the window started
+	firstTime  string    // Audit timestamp of the event that was written
+	lastTime   string    // Audit timestamp of the last repeat
+	suppressed int
+}
+
+// NewThrottle creates a throttle that writes to w. Without keys nothing is deduplicated, a limit of 0 is unlimited
+func NewThrottle(w GroupWriter, keys []fieldRef, window time.Duration, maxKeys int, limit int) *Throttle {
+	return &Throttle{
+		writer:  w,
+		keys:    keys,
+		window:  window,
+		maxKeys: maxKeys,
+		seen:    make(map[string]*dedupEntry),
+		limit:   limit,
+		now:     time.Now,
+		done:    make(chan struct{}),
+	}
+}
+
+func createThrottle(config *viper.Viper, w GroupWriter) (*Throttle, error) {
+	var keys []fieldRef
+	window := config.GetDuration("dedup.window")
+
+	if config.GetBool("dedup.enabled") {
+		names := config.GetStringSlice("dedup.key")
+		if len(names) == 0 {
+			return nil, fmt.Errorf("dedup.key needs at least one field")
+		}
+
+		for i, name := range names {
+			f, err := parseFieldRef(name)
+			if err != nil {
+				return nil, fmt.Errorf("Field %d in dedup.key could not be parsed; Value: `%s`; Error: %s", i+1, name, err)
+			}
+			keys = append(keys, f)
+		}
+
+		if window <= 0 {
+			return nil, fmt.Errorf("dedup.window must be greater than 0, got `%s`", config.GetString("dedup.window"))
+		}
+
+		l.Printf("Deduplicating message groups by %s within %s\n", strings.Join(names, ", "), window)
+	}
+
+	limit := config.GetInt("rate_limit.events_per_second")
+	if limit < 0 {
+		return nil, fmt.Errorf("rate_limit.events_per_second can not be negative, got %d", limit)
+	}
+
+	if limit > 0 {
+		l.Printf("Limiting message groups to %d per second\n", limit)
+	}
+
+	return NewThrottle(w, keys, window, config.GetInt("dedup.max_keys"), limit), nil
+}
+
+// Write passes msg on unless it repeats an event seen within the window or the rate limit was hit
+func (t *Throttle) Write(msg *AuditMessageGroup) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return t.writer.Write(msg)
+	}
+
+	now := t.clock(msg)
+	if t.keys != nil && t.suppress(msg, now) {
+		metricGroupsDeduplicated.Inc()
+		return nil
+	}
+
+	if t.limit > 0 && !t.take(now) {
+		t.dropped++
+		metricGroupsRateLimited.Inc()
+		return nil
+	}
+
+	return t.writer.Write(msg)
+}
+
+// Run writes summaries for windows that ended and for rate limited groups, returns once the throttle is closed
+func (t *Throttle) Run() {
+	ticker := time.NewTicker(THROTTLE_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.mu.Lock()
+			if !t.closed {
+				t.flush(t.clock(nil), false)
+			}
+			t.mu.Unlock()
+
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// Close writes the summaries for everything that was held back, anything written afterwards is passed straight on
+func (t *Throttle) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+
+	t.flush(t.clock(nil), true)
+	t.closed = true
+	close(t.done)
+}
+
+// UseEventTime makes windows and the rate limit follow the audit timestamps of the groups instead of the clock, for
+// replaying old events as fast as they can be read
+func (t *Throttle) UseEventTime() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.eventTime = true
+}
+
+// clock returns the current time, or with eventTime the latest audit timestamp seen including the one of msg.
+// Groups can complete slightly out of order so time never goes back
+func (t *Throttle) clock(msg *AuditMessageGroup) time.Time {
+	if !t.eventTime {
+		return t.now()
+	}
+
+	if msg != nil {
+		if at, ok := parseAuditTime(msg.AuditTime); ok && at.After(t.last) {
+			t.last = at
+		}
+	}
+
+	return t.last
+}
+
+// suppress reports if msg repeats an event we have already written in the current window
+func (t *Throttle) suppress(msg *AuditMessageGroup, now time.Time) bool {
+	key, fields, ok := t.key(msg)
+	if !ok {
+		return false
+	}
+
+	if e, ok := t.seen[key]; ok {
+		if now.Sub(e.first) < t.window {
+			e.suppressed++
+			e.lastTime = msg.AuditTime
+			return true
+		}
+
+		// The window is over, this one is written and starts a new window
+		t.summarize(e)
+		delete(t.seen, key)
+	}
+
+	if len(t.seen) < t.maxKeys {
+		t.seen[key] = &dedupEntry{fields: fields, first: now, firstTime: msg.AuditTime, lastTime: msg.AuditTime}
+	}
+
+	return false
+}
+
+// key builds the deduplication key of a message group, ok is false if any of the key fields has no value. Groups
+// of different syscalls, or of different record types without a syscall, never share a key
+func (t *Throttle) key(msg *AuditMessageGroup) (key string, fields string, ok bool) {
+	g := newFilterGroup(msg)
+	values := make([]string, 0, len(t.keys)+1)
+	pairs := make([]string, 0, len(t.keys)+1)
+
+	switch {
+	case msg.Syscall != "":
+		name := msg.SyscallName
+		if name == "" {
+			name = msg.Syscall
+		}
+		values = append(values, "syscall="+msg.Arch+"/"+msg.Syscall)
+		pairs = append(pairs, "syscall="+strconv.Quote(name))
+	case len(msg.Msgs) > 0:
+		values = append(values, "type="+strconv.Itoa(int(msg.Msgs[0].Type)))
+		pairs = append(pairs, values[0])
+	default:
+		return "", "", false
+	}
+
+	for _, f := range t.keys {
+		v := strings.Join(f.values(g), ",")
+		if v == "" {
+			return "", "", false
+		}
+
+		values = append(values, v)
+		pairs = append(pairs, f.text+"="+strconv.Quote(v))
+	}
+
+	return strings.Join(values, "\x00"), strings.Join(pairs, " "), true
+}
+
+// take uses up one of the message groups allowed this second
+func (t *Throttle) take(now time.Time) bool {
+	if t.refilled.IsZero() {
+		t.tokens = float64(t.limit)
+	} else {
+		t.tokens = min(float64(t.limit), t.tokens+now.Sub(t.refilled).Seconds()*float64(t.limit))
+	}
+	t.refilled = now
+
+	if t.tokens < 1 {
+		return false
+	}
+
+	t.tokens--
+	return true
+}
+
+// flush writes the summaries for windows that are over, or all of them, and for the groups dropped by the rate limit
+func (t *Throttle) flush(now time.Time, all bool) {
+	var ended []string
+	for key, e := range t.seen {
+		if all || now.Sub(e.first) >= t.window {
+			ended = append(ended, key)
+		}
+	}
+
+	// Oldest window first so summaries come out the same way every time
+	sort.Slice(ended, func(i, j int) bool {
+		a, b := t.seen[ended[i]], t.seen[ended[j]]
+		if !a.first.Equal(b.first) {
+			return a.first.Before(b.first)
+		}
+		return ended[i] < ended[j]
+	})
+
+	for _, key := range ended {
+		t.summarize(t.seen[key])
+		delete(t.seen, key)
+	}
+
+	if t.dropped > 0 {
+		data := fmt.Sprintf("op=rate_limit dropped=%d limit=%d", t.dropped, t.limit)
+		if err := t.writer.Write(NewSyntheticMessageGroup(EVENT_RATE_LIMIT_SUMMARY, data)); err != nil {
+			el.Printf("Failed to write the rate limit summary event. Error: %s\n", err)
+		}
+		t.dropped = 0
+	}
+}
+
+// summarize writes a summary of the repeats held back in a window, if there were any
+func (t *Throttle) summarize(e *dedupEntry) {
+	if e.suppressed == 0 {
+		return
+	}
+
+	data := fmt.Sprintf(
+		"op=dedup suppressed=%d window=%s first=%s last=%s %s",
+		e.suppressed, t.window, e.firstTime, e.lastTime, e.fields,
+	)
+
+	if err := t.writer.Write(NewSyntheticMessageGroup(EVENT_DEDUP_SUMMARY, data)); err != nil {
+		el.Printf("Failed to write the dedup summary event. Error: %s\n", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottle_Dedup(t *testing.T) {
+	keys := []fieldRef{}
+	for _, name := range []string{"exe", "uid", "cwd", "argv"} {
+		f, err := parseFieldRef(name)
+		assert.Nil(t, err)
+		keys = append(keys, f)
+	}
+
+	w := &groupRecorder{}
+	th := NewThrottle(w, keys, time.Minute, 2, 0)
+	now := time.Unix(1500000000, 0)
+	th.now = func() time.Time { return now }
+
+	ps := func(ts, uid string) *AuditMessageGroup {
+		return makeGroup(t,
+			`type=SYSCALL msg=audit(`+ts+`:1): arch=c000003e syscall=59 uid=`+uid+` exe="/usr/bin/ps"`,
+			`type=EXECVE msg=audit(`+ts+`:1): argc=2 a0="ps" a1="aux"`,
+			`type=CWD msg=audit(`+ts+`:1): cwd="/"`,
+		)
+	}
+
+	// The first one goes out, repeats within the window are held back
+	assert.Nil(t, th.Write(ps("1.000", "0")))
+	assert.Nil(t, th.Write(ps("2.000", "0")))
+	now = now.Add(30 * time.Second)
+	assert.Nil(t, th.Write(ps("3.000", "0")))
+	assert.Len(t, w.groups, 1)
+
+	// A different key is a different event
+	assert.Nil(t, th.Write(ps("4.000", "1000")))
+	assert.Len(t, w.groups, 2)
+
+	// Groups without all of the key fields are left alone
+	assert.Nil(t, th.Write(NewSyntheticMessageGroup(EVENT_KERNEL_STATUS, "op=status")))
+	assert.Nil(t, th.Write(NewSyntheticMessageGroup(EVENT_KERNEL_STATUS, "op=status")))
+	assert.Len(t, w.groups, 4)
+
+	connect := func(ts, addr string) *AuditMessageGroup {
+		return makeGroup(t,
+			`type=SYSCALL msg=audit(`+ts+`:2): arch=c000003e syscall=42 uid=0 exe="/usr/bin/ps"`,
+			`type=SOCKADDR msg=audit(`+ts+`:2): saddr=`+addr,
+			`type=CWD msg=audit(`+ts+`:2): cwd="/"`,
+		)
+	}
+	assert.Nil(t, th.Write(connect("2.500", "020001BB0A0102030000000000000000")))
+	assert.Nil(t, th.Write(connect("2.600", "020001BB0A0102040000000000000000")))
+	assert.Len(t, w.groups, 6)
+
+	w.groups = w.groups[:4]
+
+	// The same fields in a different syscall are a different event
+	other := ps("2.700", "0")
+	other.Syscall, other.SyscallName = "2", "open"
+	execKey, _, ok := th.key(ps("2.700", "0"))
+	assert.True(t, ok)
+	otherKey, _, ok := th.key(other)
+	assert.True(t, ok)
+	assert.NotEqual(t, execKey, otherKey)
+
+	// Once the window is over the summary goes out
+	now = now.Add(31 * time.Second)
+	th.flush(now, false)
+	assert.Len(t, w.groups, 5)
+	assert.Equal(t, uint16(EVENT_DEDUP_SUMMARY), w.groups[4].Msgs[0].Type)
+	assert.Contains(
+		t,
+		w.groups[4].Msgs[0].Data,
+		`op=dedup suppressed=2 window=1m0s first=1.000 last=3.000 syscall="execve" exe="/usr/bin/ps" uid="0" cwd="/" argv="ps aux"`,
+	)
+
+	// The uid 1000 window had no repeats, no summary for it. The next one starts a new window
+	assert.Nil(t, th.Write(ps("5.000", "0")))
+	assert.Len(t, w.groups, 6)
+
+	// Too many keys to track, anything new goes through
+	assert.Nil(t, th.Write(ps("6.000", "3000")))
+	assert.Nil(t, th.Write(ps("7.000", "2000")))
+	assert.Nil(t, th.Write(ps("8.000", "2000")))
+	assert.Len(t, w.groups, 9)
+
+	// Close writes the summaries still pending and passes everything through after
+	assert.Nil(t, th.Write(ps("9.000", "0")))
+	th.Close()
+	assert.Len(t, w.groups, 10)
+	assert.Contains(t, w.groups[9].Msgs[0].Data, `op=dedup suppressed=1 window=1m0s first=5.000 last=9.000`)
+
+	assert.Nil(t, th.Write(ps("10.000", "0")))
+	assert.Len(t, w.groups, 11)
+	th.Close()
+}
+
+func TestThrottle_EventTime(t *testing.T) {
+	f, err := parseFieldRef("exe")
+	assert.Nil(t, err)
+
+	w := &groupRecorder{}
+	th := NewThrottle(w, []fieldRef{f}, time.Minute, 10, 2)
+	th.now = func() time.Time { panic("the clock is not used") }
+	th.UseEventTime()
+
+	exec := func(ts string) *AuditMessageGroup {
+		return makeGroup(t, `type=SYSCALL msg=audit(`+ts+`:1): arch=c000003e syscall=59 exe="/usr/bin/ps"`)
+	}
+
+	// Repeats an hour apart are not held back, however fast they are read
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, th.Write(exec(strconv.Itoa(1500000000+i*3600)+".000")))
+	}
+	assert.Len(t, w.groups, 4)
+
+	// Repeats within the window are, an older timestamp doesn't take time back
+	assert.Nil(t, th.Write(exec("1500010830.000")))
+	assert.Nil(t, th.Write(exec("1500010000.000")))
+	assert.Len(t, w.groups, 4)
+
+	// The rate limit goes by the timestamps too
+	th.keys = nil
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, th.Write(exec("1500020000.000")))
+	}
+	assert.Nil(t, th.Write(exec("1500020001.000")))
+	assert.Len(t, w.groups, 7)
+
+	th.Close()
+	assert.Contains(t, w.groups[7].Msgs[0].Data, "op=dedup suppressed=2 window=1m0s first=1500010800.000 last=1500010000.000")
+	assert.Contains(t, w.groups[8].Msgs[0].Data, "op=rate_limit dropped=1 limit=2")
+}
+
+func TestThrottle_RateLimit(t *testing.T) {
+	w := &groupRecorder{}
+	th := NewThrottle(w, nil, 0, 0, 2)
+	now := time.Unix(1500000000, 0)
+	th.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, th.Write(new1300Group()))
+	}
+	assert.Len(t, w.groups, 2)
+
+	// Half a second refills one
+	now = now.Add(500 * time.Millisecond)
+	assert.Nil(t, th.Write(new1300Group()))
+	assert.Nil(t, th.Write(new1300Group()))
+	assert.Len(t, w.groups, 3)
+
+	th.flush(now, false)
+	assert.Len(t, w.groups, 4)
+	assert.Equal(t, uint16(EVENT_RATE_LIMIT_SUMMARY), w.groups[3].Msgs[0].Type)
+	assert.Contains(t, w.groups[3].Msgs[0].Data, "op=rate_limit dropped=4 limit=2")
+
+	// Nothing dropped, nothing to report
+	th.flush(now, false)
+	assert.Len(t, w.groups, 4)
+
+	// Never more than a second worth
+	now = now.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, th.Write(new1300Group()))
+	}
+	assert.Len(t, w.groups, 6)
+}
+
+func TestThrottle_Run(t *testing.T) {
+	w := &groupRecorder{}
+	th := NewThrottle(w, nil, 0, 0, 0)
+
+	done := make(chan struct{})
+	go func() {
+		th.Run()
+		close(done)
+	}()
+
+	assert.Nil(t, th.Write(new1300Group()))
+	th.Close()
+	<-done
+	assert.Len(t, w.groups, 1)
+}
+
+func Test_createThrottle(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	config := viper.New()
+	config.Set("dedup.enabled", true)
+	config.Set("dedup.key", []string{"exe", "PATH.name"})
+	config.Set("dedup.window", "30s")
+	config.Set("dedup.max_keys", 10)
+	config.Set("rate_limit.events_per_second", 100)
+
+	th, err := createThrottle(config, &groupRecorder{})
+	assert.Nil(t, err)
+	assert.Len(t, th.keys, 2)
+	assert.Equal(t, 30*time.Second, th.window)
+	assert.Equal(t, 10, th.maxKeys)
+	assert.Equal(t, 100, th.limit)
+	assert.Equal(t, "Deduplicating message groups by exe, PATH.name within 30s\nLimiting message groups to 100 per second\n", lb.String())
+	assert.Empty(t, elb.String())
+
+	// Disabled
+	th, err = createThrottle(viper.New(), &groupRecorder{})
+	assert.Nil(t, err)
+	assert.Nil(t, th.keys)
+	assert.Equal(t, 0, th.limit)
+
+	config.Set("dedup.key", []string{"exe", "NOPE.name"})
+	_, err = createThrottle(config, &groupRecorder{})
+	assert.EqualError(t, err, "Field 2 in dedup.key could not be parsed; Value: `NOPE.name`; Error: Unknown record type `NOPE`")
+
+	config.Set("dedup.key", []string{})
+	_, err = createThrottle(config, &groupRecorder{})
+	assert.EqualError(t, err, "dedup.key needs at least one field")
+
+	config.Set("dedup.key", []string{"exe"})
+	config.Set("dedup.window", "0s")
+	_, err = createThrottle(config, &groupRecorder{})
+	assert.EqualError(t, err, "dedup.window must be greater than 0, got `0s`")
+
+	config.Set("dedup.enabled", false)
+	config.Set("rate_limit.events_per_second", -1)
+	_, err = createThrottle(config, &groupRecorder{})
+	assert.EqualError(t, err, "rate_limit.events_per_second can not be negative, got -1")
+}
+
+func new1300Group() *AuditMessageGroup {
+	return NewAuditMessageGroup(NewAuditMessage(new1300("1")))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/spf13/viper"
+)
+
+// createTLSConfig builds the client side TLS config for an output from the settings under prefix, usually
+// `output.<name>.tls`. Returns nil if TLS is not enabled
+func createTLSConfig(config *viper.Viper, prefix string) (*tls.Config, error) {
+	if !config.GetBool(prefix + ".enabled") {
+		return nil, nil
+	}
+
+	tc := &tls.Config{
+		ServerName:         config.GetString(prefix + ".server_name"),
+		InsecureSkipVerify: config.GetBool(prefix + ".insecure_skip_verify"),
+	}
+
+	if ca := config.GetString(prefix + ".ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s.ca. Error: %s", prefix, err)
+		}
+
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s.ca `%s`", prefix, ca)
+		}
+	}
+
+	cert, key := config.GetString(prefix+".cert"), config.GetString(prefix+".key")
+	if (cert == "") != (key == "") {
+		return nil, fmt.Errorf("%s.cert and %s.key must be set together", prefix, prefix)
+	}
+
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load %s.cert and %s.key. Error: %s", prefix, prefix, err)
+		}
+		tc.Certificates = []tls.Certificate{pair}
+	}
+
+	return tc, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCert writes a self signed certificate for localhost and 127.0.0.1 and its key, the certificate is also
+// its own CA
+func newTestCert(t *testing.T) (cert string, key string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go-audit test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	cert, key = path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	if err := os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func Test_createTLSConfig(t *testing.T) {
+	cert, key := newTestCert(t)
+
+	// Disabled
+	c := viper.New()
+	c.Set("output.test.tls.ca", cert)
+	tc, err := createTLSConfig(c, "output.test.tls")
+	assert.Nil(t, err)
+	assert.Nil(t, tc)
+
+	// Everything set
+	c = viper.New()
+	c.Set("output.test.tls.enabled", true)
+	c.Set("output.test.tls.ca", cert)
+	c.Set("output.test.tls.cert", cert)
+	c.Set("output.test.tls.key", key)
+	c.Set("output.test.tls.server_name", "localhost")
+	tc, err = createTLSConfig(c, "output.test.tls")
+	assert.Nil(t, err)
+	assert.NotNil(t, tc.RootCAs)
+	assert.Len(t, tc.Certificates, 1)
+	assert.Equal(t, "localhost", tc.ServerName)
+	assert.False(t, tc.InsecureSkipVerify)
+
+	// Just enabled uses the system CAs
+	c = viper.New()
+	c.Set("output.test.tls.enabled", true)
+	c.Set("output.test.tls.insecure_skip_verify", true)
+	tc, err = createTLSConfig(c, "output.test.tls")
+	assert.Nil(t, err)
+	assert.Nil(t, tc.RootCAs)
+	assert.Empty(t, tc.Certificates)
+	assert.True(t, tc.InsecureSkipVerify)
+
+	// Missing ca
+	c = viper.New()
+	c.Set("output.test.tls.enabled", true)
+	c.Set("output.test.tls.ca", "/does/not/exist")
+	_, err = createTLSConfig(c, "output.test.tls")
+	assert.EqualError(t, err, "Failed to read output.test.tls.ca. Error: open /does/not/exist: no such file or directory")
+
+	// ca without certificates
+	c.Set("output.test.tls.ca", key)
+	_, err = createTLSConfig(c, "output.test.tls")
+	assert.EqualError(t, err, "No certificates found in output.test.tls.ca `"+key+"`")
+
+	// cert without key
+	c = viper.New()
+	c.Set("output.test.tls.enabled", true)
+	c.Set("output.test.tls.cert", cert)
+	_, err = createTLSConfig(c, "output.test.tls")
+	assert.EqualError(t, err, "output.test.tls.cert and output.test.tls.key must be set together")
+
+	// key that does not go with the cert
+	c.Set("output.test.tls.key", cert)
+	_, err = createTLSConfig(c, "output.test.tls")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Failed to load output.test.tls.cert and output.test.tls.key. Error: ")
+	}
+}
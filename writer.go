@@ -1,35 +1,162 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	OUTPUT_QUEUE_SIZE = 1024             // Default number of message groups that can wait on a single output
+	SPOOL_MAX_BACKOFF = time.Second * 60 // Longest time to wait before retrying a spooled message group
+)
+
+// GroupWriter is anything that can take a completed message group and send it along to an output
+type GroupWriter interface {
+	Write(msg *AuditMessageGroup) error
+}
+
+// groupAware is implemented by writers that need to know which message group they are about to be given
+type groupAware interface {
+	Next(msg *AuditMessageGroup)
+}
+
+// batchSender is implemented by outputs that send message groups in batches. Send must only return nil once the
+// other end has accepted the whole batch, the output is expected to retry on its own before giving up
+type batchSender interface {
+	Send(batch []*batchEntry) error
+	Close() error
+}
+
+// permanentError is returned by outputs for message groups that would fail the same way if they were sent again
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(*permanentError)
+	return ok
+}
+
+// batchEntry is a message group in a batch along with its encoded line, which ends in a newline
+type batchEntry struct {
+	msg  *AuditMessageGroup
+	line []byte
+}
+
 type AuditWriter struct {
-	e        *json.Encoder
-	w        io.Writer
-	attempts int
+	mu        sync.Mutex
+	w         io.Writer
+	attempts  int
+	name      string                                   // Name of the output, used in metrics
+	encode    func(msg *AuditMessageGroup) interface{} // Maps a message group to what is written, nil writes it as it is
+	sender    batchSender                              // Takes whole batches instead of w, nil for everything else
+	batchSize int
+	batchWait time.Duration // Longest time a message group waits for its batch to fill up
 }
 
 func NewAuditWriter(w io.Writer, attempts int) *AuditWriter {
 	return &AuditWriter{
-		e:        json.NewEncoder(w),
 		w:        w,
 		attempts: attempts,
 	}
 }
 
-func (a *AuditWriter) Write(msg *AuditMessageGroup) (err error) {
+// NewBatchWriter returns an AuditWriter that hands message groups to s in batches of up to batchSize, waiting at
+// most batchWait for a batch to fill up
+func NewBatchWriter(s batchSender, batchSize int, batchWait time.Duration) *AuditWriter {
+	return &AuditWriter{
+		sender:    s,
+		batchSize: batchSize,
+		batchWait: batchWait,
+	}
+}
+
+func (a *AuditWriter) Write(msg *AuditMessageGroup) error {
+	return a.WriteBatch([]*AuditMessageGroup{msg})
+}
+
+// WriteBatch writes every message group in order. A batch sender gets them all at once and nothing is retried here,
+// an error means none of them are known to have made it
+func (a *AuditWriter) WriteBatch(msgs []*AuditMessageGroup) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.sender == nil {
+		for _, msg := range msgs {
+			if err := a.write(msg); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	batch := make([]*batchEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		buf := &bytes.Buffer{}
+		if err := json.NewEncoder(buf).Encode(a.value(msg)); err != nil {
+			// Trying again would not change anything, don't hold up the rest of the batch for it
+			metricOutputFailures.WithLabelValues(a.name).Inc()
+			el.Printf("Failed to encode message group %d for output %s. Error: %s\n", msg.Seq, a.name, err)
+			continue
+		}
+
+		batch = append(batch, &batchEntry{msg: msg, line: buf.Bytes()})
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	return a.sender.Send(batch)
+}
+
+// batching returns how many message groups to collect before writing them and how long to wait for that
+func (a *AuditWriter) batching() (int, time.Duration) {
+	if a.sender == nil || a.batchSize < 1 {
+		return 1, 0
+	}
+
+	return a.batchSize, a.batchWait
+}
+
+func (a *AuditWriter) value(msg *AuditMessageGroup) interface{} {
+	if a.encode != nil {
+		return a.encode(msg)
+	}
+
+	return msg
+}
+
+func (a *AuditWriter) write(msg *AuditMessageGroup) (err error) {
+	if g, ok := a.w.(groupAware); ok {
+		g.Next(msg)
+	}
+
+	line, err := json.Marshal(a.value(msg))
+	if err != nil {
+		return &permanentError{err}
+	}
+	line = append(line, '\n')
+
 	for i := 0; i < a.attempts; i++ {
-		err = a.e.Encode(msg)
+		_, err = a.w.Write(line)
 		if err == nil {
 			break
 		}
 
-		if i != a.attempts {
-			// We have to reset the encoder because write errors are kept internally and can not be retried
-			a.e = json.NewEncoder(a.w)
+		if i != a.attempts-1 {
+			metricOutputRetries.WithLabelValues(a.name).Inc()
 			el.Println("Failed to write message, retrying in 1 second. Error:", err)
 			time.Sleep(time.Second * 1)
 		}
@@ -37,3 +164,358 @@ func (a *AuditWriter) Write(msg *AuditMessageGroup) (err error) {
 
 	return err
 }
+
+// Close syncs and closes the underlying writer. os.Stdout and os.Stderr are left open
+func (a *AuditWriter) Close() error {
+	// A batch sender is closed without waiting for the batch it is sending, so it can stop retrying it
+	if a.sender != nil {
+		return a.sender.Close()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.w == os.Stdout || a.w == os.Stderr {
+		return nil
+	}
+
+	if f, ok := a.w.(*os.File); ok {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if c, ok := a.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// SetWriter swaps the underlying writer for a new one and returns the old one
+func (a *AuditWriter) SetWriter(w io.Writer) io.Writer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	old := a.w
+	a.w = w
+	return old
+}
+
+// MultiAuditWriter fans message groups out to every configured output.
+// Each output has its own queue and goroutine so a slow or failing output can not block or kill the others.
+type MultiAuditWriter struct {
+	mu      sync.RWMutex
+	outputs []*auditOutput
+	done    chan struct{} // Closed when the outputs are closed
+}
+
+type auditOutput struct {
+	name        string
+	writer      *AuditWriter
+	queue       chan *AuditMessageGroup
+	spool       *Spool
+	maxAttempts int // Times a spooled batch is sent before it is dropped, 0 to keep trying until it goes through
+	done        chan struct{}
+	stopped     chan struct{}
+	dropped     uint64
+}
+
+func NewMultiAuditWriter() *MultiAuditWriter {
+	return &MultiAuditWriter{done: make(chan struct{})}
+}
+
+// Add starts sending message groups to a new output. queueSize is the number of message groups that can be
+// waiting on the output before new ones are dropped for it, OUTPUT_QUEUE_SIZE is used if it is not set
+func (m *MultiAuditWriter) Add(name string, w *AuditWriter, queueSize int) {
+	if queueSize < 1 {
+		queueSize = OUTPUT_QUEUE_SIZE
+	}
+
+	w.name = name
+	o := &auditOutput{
+		name:    name,
+		writer:  w,
+		queue:   make(chan *AuditMessageGroup, queueSize),
+		stopped: make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	m.outputs = append(m.outputs, o)
+	m.mu.Unlock()
+
+	go func() {
+		defer close(o.stopped)
+		o.run()
+	}()
+}
+
+// AddSpooled starts sending message groups to a new output through an on disk spool.
+// Message groups stay in the spool until the output accepts them, so an output that is down loses nothing. A batch
+// the output refuses for good, or that failed maxAttempts times, is dropped so it does not hold up the rest
+func (m *MultiAuditWriter) AddSpooled(name string, w *AuditWriter, s *Spool, maxAttempts int) {
+	w.name = name
+	o := &auditOutput{
+		name:        name,
+		writer:      w,
+		spool:       s,
+		maxAttempts: maxAttempts,
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	m.outputs = append(m.outputs, o)
+	m.mu.Unlock()
+
+	go func() {
+		defer close(o.stopped)
+		o.runSpool()
+	}()
+}
+
+// Len returns the number of outputs
+func (m *MultiAuditWriter) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.outputs)
+}
+
+// Done is closed once the outputs are closed, or replaced and then closed
+func (m *MultiAuditWriter) Done() <-chan struct{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.done
+}
+
+// Replace moves the outputs of n into m and returns a MultiAuditWriter holding the old outputs, the caller has to
+// Close it. Everything holding m writes to the new outputs from then on. n must not be used afterwards
+func (m *MultiAuditWriter) Replace(n *MultiAuditWriter) *MultiAuditWriter {
+	n.mu.Lock()
+	outputs, done := n.outputs, n.done
+	n.outputs, n.done = nil, nil
+	n.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old := &MultiAuditWriter{outputs: m.outputs, done: m.done}
+	m.outputs, m.done = outputs, done
+	return old
+}
+
+// Swap hands the outputs to swap and writes to the outputs it returns from then on. Writes wait for swap instead of
+// going nowhere, so the old outputs can let go of their spools before the new ones open them
+func (m *MultiAuditWriter) Swap(swap func(old *MultiAuditWriter) *MultiAuditWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := swap(&MultiAuditWriter{outputs: m.outputs, done: m.done})
+
+	n.mu.Lock()
+	m.outputs, m.done = n.outputs, n.done
+	n.outputs, n.done = nil, nil
+	n.mu.Unlock()
+}
+
+// Write queues the message group for every output, it never blocks unless a spool is full and set to block
+func (m *MultiAuditWriter) Write(msg *AuditMessageGroup) error {
+	var spooled []*auditOutput
+
+	metricGroupsWritten.Inc()
+
+	m.mu.RLock()
+	for _, o := range m.outputs {
+		if o.spool != nil {
+			spooled = append(spooled, o)
+			continue
+		}
+
+		select {
+		case o.queue <- msg:
+		default:
+			metricOutputDropped.WithLabelValues(o.name).Inc()
+			if atomic.AddUint64(&o.dropped, 1) == 1 {
+				el.Printf("Output %s is not keeping up, dropping message groups until it does\n", o.name)
+			}
+		}
+	}
+	m.mu.RUnlock()
+
+	// Spools can be configured to block when they are full. That happens without the lock so Close and Replace are
+	// not held up by an output that is down, closing the spool wakes us up
+	for _, o := range spooled {
+		m.spool(o, msg)
+	}
+
+	return nil
+}
+
+func (m *MultiAuditWriter) spool(o *auditOutput, msg *AuditMessageGroup) {
+	err := o.spool.Append(msg)
+	if err == errSpoolClosed {
+		// The output was replaced while we waited on its spool, the one that took its place gets the group instead
+		if n := m.output(o.name); n != nil && n != o && n.spool != nil {
+			err = n.spool.Append(msg)
+		}
+	}
+
+	if err != nil {
+		el.Printf("Failed to spool message group %d for output %s. Error: %s\n", msg.Seq, o.name, err)
+	}
+}
+
+// output returns the output with the name, or nil if there is none
+func (m *MultiAuditWriter) output(name string) *auditOutput {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, o := range m.outputs {
+		if o.name == name {
+			return o
+		}
+	}
+
+	return nil
+}
+
+// Close stops accepting message groups, waits for every output to drain its queue and then closes the outputs.
+// Spooled message groups that have not been sent are left on disk for the next run
+func (m *MultiAuditWriter) Close() error {
+	m.mu.Lock()
+	outputs := m.outputs
+	m.outputs = nil
+	if m.done != nil {
+		close(m.done)
+		m.done = nil
+	}
+	m.mu.Unlock()
+
+	var err error
+	closeWriter := func(o *auditOutput) {
+		if cerr := o.writer.Close(); cerr != nil {
+			el.Printf("Failed to close output %s. Error: %s\n", o.name, cerr)
+			if err == nil {
+				err = cerr
+			}
+		}
+	}
+
+	for _, o := range outputs {
+		if o.spool != nil {
+			close(o.done)
+			o.spool.Close()
+
+			// Unsent message groups stay in the spool, there is no need to wait for a batch that is being retried
+			closeWriter(o)
+			continue
+		}
+
+		close(o.queue)
+	}
+
+	for _, o := range outputs {
+		<-o.stopped
+
+		if o.spool == nil {
+			closeWriter(o)
+		}
+	}
+
+	return err
+}
+
+func (o *auditOutput) run() {
+	size, wait := o.writer.batching()
+	batch := make([]*AuditMessageGroup, 0, size)
+
+	for msg := range o.queue {
+		batch = append(batch[:0], msg)
+		if size > 1 {
+			batch = o.fill(batch, size, wait)
+		}
+
+		if dropped := atomic.SwapUint64(&o.dropped, 0); dropped > 0 {
+			el.Printf("Output %s dropped %d message groups while it was not keeping up\n", o.name, dropped)
+		}
+
+		if err := o.writer.WriteBatch(batch); err != nil {
+			metricOutputFailures.WithLabelValues(o.name).Add(float64(len(batch)))
+			el.Printf("Failed to write %s to output %s. Error: %s\n", describeBatch(batch), o.name, err)
+		}
+	}
+}
+
+// fill takes message groups off the queue until the batch is full, wait has passed or the queue is closed
+func (o *auditOutput) fill(batch []*AuditMessageGroup, size int, wait time.Duration) []*AuditMessageGroup {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for len(batch) < size {
+		select {
+		case msg, ok := <-o.queue:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, msg)
+
+		case <-timer.C:
+			return batch
+		}
+	}
+
+	return batch
+}
+
+func (o *auditOutput) runSpool() {
+	size, wait := o.writer.batching()
+
+	for {
+		batch, err := o.spool.NextBatch(size, wait)
+		if err != nil {
+			return
+		}
+
+		// Keep retrying the same batch until it goes through so nothing is lost or sent out of order
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			err := o.writer.WriteBatch(batch)
+			if err == nil {
+				break
+			}
+
+			if isPermanent(err) || (o.maxAttempts > 0 && attempt >= o.maxAttempts) {
+				metricOutputFailures.WithLabelValues(o.name).Add(float64(len(batch)))
+				el.Printf("Dropped %s for output %s after %d attempts. Error: %s\n", describeBatch(batch), o.name, attempt, err)
+				break
+			}
+
+			metricOutputRetries.WithLabelValues(o.name).Inc()
+			el.Printf("Failed to write %s to output %s, retrying in %s. Error: %s\n", describeBatch(batch), o.name, backoff, err)
+
+			select {
+			case <-o.done:
+				return
+			case <-time.After(backoff):
+			}
+
+			if backoff < SPOOL_MAX_BACKOFF {
+				backoff *= 2
+			}
+		}
+
+		o.spool.Ack()
+	}
+}
+
+// describeBatch names the message groups in a batch for log lines
+func describeBatch(batch []*AuditMessageGroup) string {
+	if len(batch) == 1 {
+		return fmt.Sprintf("message group %d", batch[0].Seq)
+	}
+
+	return fmt.Sprintf("%d message groups %d to %d", len(batch), batch[0].Seq, batch[len(batch)-1].Seq)
+}
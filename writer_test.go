@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditWriter_Write(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	w := &bytes.Buffer{}
+	aw := NewAuditWriter(w, 1)
+	err := aw.Write(&AuditMessageGroup{Seq: 1, AuditTime: "10000001", UidMap: map[string]string{}})
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":null,\"uid_map\":{}}\n", w.String())
+
+	// Failures should not sleep after the last attempt
+	aw = NewAuditWriter(&FailWriter{}, 1)
+	err = aw.Write(&AuditMessageGroup{Seq: 1})
+	assert.EqualError(t, err, "derp")
+	assert.False(t, isPermanent(err))
+	assert.Empty(t, lb.String())
+	assert.Empty(t, elb.String())
+
+	// Something that can't be encoded will never be written
+	aw = NewAuditWriter(w, 1)
+	aw.encode = func(*AuditMessageGroup) interface{} { return make(chan int) }
+	err = aw.Write(&AuditMessageGroup{Seq: 1})
+	assert.EqualError(t, err, "json: unsupported type: chan int")
+	assert.True(t, isPermanent(err))
+}
+
+func TestMultiAuditWriter_Write(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	w1 := &bytes.Buffer{}
+	w2 := &bytes.Buffer{}
+
+	m := NewMultiAuditWriter()
+	m.Add("one", NewAuditWriter(w1, 1), 10)
+	m.Add("broken", NewAuditWriter(&FailWriter{}, 1), 10)
+	m.Add("two", NewAuditWriter(w2, 1), 10)
+	assert.Equal(t, 3, m.Len())
+
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, m.Write(&AuditMessageGroup{Seq: i, AuditTime: "10000001", UidMap: map[string]string{}}))
+	}
+	m.Close()
+
+	expected := "{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":null,\"uid_map\":{}}\n" +
+		"{\"sequence\":2,\"timestamp\":\"10000001\",\"messages\":null,\"uid_map\":{}}\n" +
+		"{\"sequence\":3,\"timestamp\":\"10000001\",\"messages\":null,\"uid_map\":{}}\n"
+	assert.Equal(t, expected, w1.String())
+	assert.Equal(t, expected, w2.String())
+	assert.Empty(t, lb.String())
+	assert.Equal(
+		t,
+		"Failed to write message group 1 to output broken. Error: derp\n"+
+			"Failed to write message group 2 to output broken. Error: derp\n"+
+			"Failed to write message group 3 to output broken. Error: derp\n",
+		elb.String(),
+	)
+}
+
+func TestMultiAuditWriter_WriteFull(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	blocked := &blockingWriter{release: make(chan struct{}), started: make(chan struct{})}
+	w := &bytes.Buffer{}
+
+	m := NewMultiAuditWriter()
+	m.Add("slow", NewAuditWriter(blocked, 1), 1)
+	m.Add("fast", NewAuditWriter(w, 1), 10)
+
+	// The slow output holds on to the first group, queues the second and drops the rest
+	for i := 1; i <= 5; i++ {
+		assert.Nil(t, m.Write(&AuditMessageGroup{Seq: i, UidMap: map[string]string{}}))
+		<-blocked.started
+	}
+
+	close(blocked.release)
+	m.Close()
+
+	assert.Equal(t, 5, bytes.Count(w.Bytes(), []byte("\n")), "The fast output should have gotten every group")
+	assert.Equal(t, 2, blocked.writes, "The slow output should have dropped groups")
+	assert.Empty(t, lb.String())
+	assert.Equal(
+		t,
+		"Output slow is not keeping up, dropping message groups until it does\n"+
+			"Output slow dropped 3 message groups while it was not keeping up\n",
+		elb.String(),
+	)
+}
+
+// blockingWriter holds every write until release is closed
+type blockingWriter struct {
+	release chan struct{}
+	started chan struct{}
+	once    sync.Once
+	writes  int
+}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	b.once.Do(func() { close(b.started) })
+	<-b.release
+	b.writes++
+	return len(p), nil
+}
+
+func TestMultiAuditWriter_Spooled(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	s, err := OpenSpool(t.TempDir(), 1024*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &flakyWriter{failures: 1}
+	m := NewMultiAuditWriter()
+	m.AddSpooled("flaky", NewAuditWriter(w, 1), s, 0)
+
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, m.Write(&AuditMessageGroup{Seq: i, AuditTime: "10000001", UidMap: map[string]string{}}))
+	}
+
+	// The first group fails once and is retried, nothing should be lost or reordered
+	for i := 0; i < 300 && strings.Count(w.String(), "\n") < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.Close()
+
+	assert.Equal(
+		t,
+		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":null,\"uid_map\":{}}\n"+
+			"{\"sequence\":2,\"timestamp\":\"10000001\",\"messages\":null,\"uid_map\":{}}\n"+
+			"{\"sequence\":3,\"timestamp\":\"10000001\",\"messages\":null,\"uid_map\":{}}\n",
+		w.String(),
+	)
+	assert.Empty(t, lb.String())
+	assert.Equal(t, "Failed to write message group 1 to output flaky, retrying in 1s. Error: derp\n", elb.String())
+}
+
+func TestMultiAuditWriter_SpoolBlocked(t *testing.T) {
+	hookLogger()
+	defer resetLogger()
+
+	s, err := OpenSpool(t.TempDir(), SPOOL_MIN_SEGMENT_SIZE*2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMultiAuditWriter()
+	m.AddSpooled("down", NewAuditWriter(&flakyWriter{failures: 1000}, 1), s, 0)
+
+	// Keep writing until the full spool blocks
+	var seq int32
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 1; i <= 100; i++ {
+			atomic.StoreInt32(&seq, int32(i))
+			m.Write(&AuditMessageGroup{Seq: i, AuditTime: "10000001", UidMap: map[string]string{}, Msgs: []*AuditMessage{{Type: 1300, Data: strings.Repeat("a", 8192)}}})
+		}
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("Write should have blocked on the full spool")
+	case <-time.After(100 * time.Millisecond):
+	}
+	blocked := int(atomic.LoadInt32(&seq))
+
+	// Replacing the output is not held up by the blocked write, which goes to the new output instead
+	s2, err := OpenSpool(t.TempDir(), 1024*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &flakyWriter{}
+	n := NewMultiAuditWriter()
+	n.AddSpooled("down", NewAuditWriter(w, 1), s2, 0)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		m.Replace(n).Close()
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Replace and Close are stuck behind the full spool")
+	}
+
+	<-written
+	assert.Eventually(t, func() bool { return strings.Count(w.String(), "\n") == 101-blocked }, time.Second*5, time.Millisecond*10)
+	assert.True(t, strings.HasPrefix(w.String(), fmt.Sprintf(`{"sequence":%d,`, blocked)))
+	assert.Nil(t, m.Close())
+}
+
+// flakyWriter fails the first few writes and then starts working
+type flakyWriter struct {
+	mu       sync.Mutex
+	failures int
+	buf      bytes.Buffer
+}
+
+func (f *flakyWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failures > 0 {
+		f.failures--
+		return 0, errors.New("derp")
+	}
+
+	return f.buf.Write(p)
+}
+
+func (f *flakyWriter) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.buf.String()
+}
+
+func TestMultiAuditWriter_Batches(t *testing.T) {
+	b := &batchRecorder{}
+	m := NewMultiAuditWriter()
+	m.Add("batch", NewBatchWriter(b, 2, time.Hour), 10)
+
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, m.Write(&AuditMessageGroup{Seq: i, AuditTime: "10000001", UidMap: map[string]string{}}))
+	}
+
+	// A full batch goes out right away, the rest on close
+	assert.Eventually(t, func() bool { return len(b.Batches()) == 1 }, time.Second*5, time.Millisecond*10)
+	m.Close()
+
+	assert.Equal(t, [][]int{{1, 2}, {3}}, b.Batches())
+	assert.True(t, b.closed)
+}
+
+func TestMultiAuditWriter_SpooledBatches(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	s, err := OpenSpool(t.TempDir(), 1024*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &batchRecorder{failures: 1}
+	m := NewMultiAuditWriter()
+	m.AddSpooled("batch", NewBatchWriter(b, 3, time.Hour), s, 0)
+
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, m.Write(&AuditMessageGroup{Seq: i, AuditTime: "10000001", UidMap: map[string]string{}}))
+	}
+
+	// The failed batch is not acknowledged, it is sent again as a whole
+	assert.Eventually(t, func() bool { return len(b.Batches()) == 2 }, time.Second*5, time.Millisecond*10)
+	m.Close()
+
+	assert.Equal(t, [][]int{{1, 2, 3}, {1, 2, 3}}, b.Batches())
+	assert.Equal(t, "Failed to write 3 message groups 1 to 3 to output batch, retrying in 1s. Error: derp\n", elb.String())
+}
+
+func TestMultiAuditWriter_SpoolDrops(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	newGroup := func(seq int) *AuditMessageGroup {
+		return &AuditMessageGroup{Seq: seq, AuditTime: "10000001", UidMap: map[string]string{}}
+	}
+
+	// A batch the output refuses for good is dropped right away instead of holding up the rest
+	s, err := OpenSpool(t.TempDir(), 1024*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &batchRecorder{failures: 1, permanent: true}
+	m := NewMultiAuditWriter()
+	m.AddSpooled("batch", NewBatchWriter(b, 2, time.Hour), s, 0)
+	for i := 1; i <= 4; i++ {
+		assert.Nil(t, m.Write(newGroup(i)))
+	}
+
+	assert.Eventually(t, func() bool { return len(b.Batches()) == 2 }, time.Second*5, time.Millisecond*10)
+	m.Close()
+	assert.Equal(t, [][]int{{1, 2}, {3, 4}}, b.Batches())
+	assert.Equal(t, "Dropped 2 message groups 1 to 2 for output batch after 1 attempts. Error: derp\n", elb.String())
+
+	// So is one that failed max attempts times
+	elb.Reset()
+	s, err = OpenSpool(t.TempDir(), 1024*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b = &batchRecorder{failures: 2}
+	m = NewMultiAuditWriter()
+	m.AddSpooled("batch", NewBatchWriter(b, 2, time.Hour), s, 2)
+	for i := 1; i <= 4; i++ {
+		assert.Nil(t, m.Write(newGroup(i)))
+	}
+
+	assert.Eventually(t, func() bool { return len(b.Batches()) == 3 }, time.Second*5, time.Millisecond*10)
+	m.Close()
+	assert.Equal(t, [][]int{{1, 2}, {1, 2}, {3, 4}}, b.Batches())
+	assert.Equal(
+		t,
+		"Failed to write 2 message groups 1 to 2 to output batch, retrying in 1s. Error: derp\n"+
+			"Dropped 2 message groups 1 to 2 for output batch after 2 attempts. Error: derp\n",
+		elb.String(),
+	)
+}
+
+// batchRecorder keeps the sequence numbers of every batch it is sent and fails the first few
+type batchRecorder struct {
+	mu        sync.Mutex
+	failures  int
+	permanent bool // Fail as if sending again would not help
+	batches   [][]int
+	closed    bool
+}
+
+func (b *batchRecorder) Send(batch []*batchEntry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var seqs []int
+	for _, e := range batch {
+		seqs = append(seqs, e.msg.Seq)
+	}
+	b.batches = append(b.batches, seqs)
+
+	if b.failures > 0 {
+		b.failures--
+		if b.permanent {
+			return &permanentError{errors.New("derp")}
+		}
+		return errors.New("derp")
+	}
+
+	return nil
+}
+
+func (b *batchRecorder) Batches() [][]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([][]int(nil), b.batches...)
+}
+
+func (b *batchRecorder) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	return nil
+}
+
+func TestMultiAuditWriter_Replace(t *testing.T) {
+	w1 := &bytes.Buffer{}
+	w2 := &bytes.Buffer{}
+
+	m := NewMultiAuditWriter()
+	m.Add("one", NewAuditWriter(w1, 1), 10)
+	done := m.Done()
+
+	n := NewMultiAuditWriter()
+	n.Add("two", NewAuditWriter(w2, 1), 10)
+
+	old := m.Replace(n)
+	assert.Equal(t, 1, m.Len())
+	assert.Nil(t, m.Write(&AuditMessageGroup{Seq: 1, AuditTime: "10000001", UidMap: map[string]string{}}))
+
+	// Closing the old outputs leaves the new ones alone
+	old.Close()
+	<-done
+	assert.Equal(t, 1, m.Len())
+
+	m.Close()
+	assert.Empty(t, w1.String())
+	assert.Equal(t, "{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":null,\"uid_map\":{}}\n", w2.String())
+}
+
+func TestAuditWriter_Close(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "go-audit")
+	assert.Nil(t, err)
+
+	w := NewAuditWriter(f, 1)
+	assert.Nil(t, w.Write(&AuditMessageGroup{Seq: 1, AuditTime: "10000001"}))
+	assert.Nil(t, w.Close())
+
+	_, err = f.Write([]byte("nope"))
+	assert.Error(t, err, "The file should have been closed")
+
+	// stdout is left open
+	assert.Nil(t, NewAuditWriter(os.Stdout, 1).Close())
+	_, err = os.Stdout.Stat()
+	assert.Nil(t, err)
+}